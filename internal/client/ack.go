@@ -0,0 +1,189 @@
+package client
+
+import (
+  "encoding/binary"
+  "errors"
+  "strconv"
+)
+
+var (
+  ErrBadAck = errors.New("client: invalid acknowledgement")
+)
+
+// Sizes of the payloads of the acknowledgement messages.
+const (
+  ACK_MODE_LENGTH = 1
+  ACK_LENGTH      = 6
+)
+
+// More version 2 message types, for acknowledgements.
+const (
+  // MessageAckMode asks the server to acknowledge Readings (device to server), and confirms the
+  // AckMode the server will use (server to device). Its payload is the AckMode.
+  MessageAckMode MessageType = 2
+
+  // MessageAck acknowledges one or more Readings (server to device). Its payload is an Ack.
+  MessageAck MessageType = 3
+)
+
+// AckMode is how a server acknowledges the Readings of a connection. A connection starts without
+// acknowledgements, for devices that don't expect them.
+type AckMode uint8
+
+const (
+  // AckNone sends no acknowledgement.
+  AckNone AckMode = iota
+
+  // AckEach acknowledges every Reading on its own, as soon as it is processed.
+  AckEach
+
+  // AckCumulative acknowledges all the Readings received so far at once, whenever the server has
+  // processed everything the device sent. Rejected Readings are still nacked on their own, as soon
+  // as they are processed.
+  AckCumulative
+)
+
+// String returns the name of the mode.
+func (m AckMode) String() string {
+  switch m {
+  case AckNone:
+    return "none"
+  case AckEach:
+    return "each"
+  case AckCumulative:
+    return "cumulative"
+  }
+  return "mode " + strconv.Itoa(int(m))
+}
+
+// AckCode is the outcome of a Reading, as reported by an Ack.
+type AckCode uint8
+
+const (
+  // AckAccepted reports Readings recorded by the server.
+  AckAccepted AckCode = iota
+
+  // NackOutOfRange reports a Reading with a field out of its valid range (see Ack.Field).
+  NackOutOfRange
+
+  // NackMalformed reports a Reading message too short to hold a Reading, or with an invalid
+  // extension.
+  NackMalformed
+
+  // NackNotRecorded reports a valid Reading the server failed to record.
+  NackNotRecorded
+)
+
+// String returns the name of the code.
+func (code AckCode) String() string {
+  switch code {
+  case AckAccepted:
+    return "accepted"
+  case NackOutOfRange:
+    return "out of range"
+  case NackMalformed:
+    return "malformed"
+  case NackNotRecorded:
+    return "not recorded"
+  }
+  return "code " + strconv.Itoa(int(code))
+}
+
+// NoField is the Field of an Ack that is not about a field out of range.
+const NoField Field = 0xff
+
+// Ack is the payload of a MessageAck.
+//
+// Readings are numbered from 1 in the order they are sent on the connection (those of a
+// MessageReadingBatch in order too), from the time the acknowledgements are enabled. An Ack with
+// code AckAccepted acknowledges Reading Seq (and in AckCumulative mode, all the Readings before it
+// not nacked already); an Ack with any other code rejects Reading Seq alone.
+type Ack struct {
+  Seq  uint32
+  Code AckCode
+
+  // Field is the first field out of range of a Reading nacked with NackOutOfRange, and NoField
+  // for an extra sensor (see Extras) or a timestamp (see MessageReadingBatch) out of range, or any
+  // other code.
+  Field Field
+}
+
+// AppendAck appends the payload of a MessageAck to b.
+func AppendAck(b []byte, ack Ack) []byte {
+  b = append(b, 0, 0, 0, 0, byte(ack.Code), byte(ack.Field))
+  binary.BigEndian.PutUint32(b[len(b) - ACK_LENGTH:], ack.Seq)
+  return b
+}
+
+// DecodeAck decodes the payload of a MessageAck.
+func DecodeAck(payload []byte) (Ack, error) {
+  if len(payload) < ACK_LENGTH {
+    return Ack{}, ErrBadAck
+  }
+  ack := Ack{
+    Seq:   binary.BigEndian.Uint32(payload[0:4]),
+    Code:  AckCode(payload[4]),
+    Field: Field(payload[5]),
+  }
+  if ack.Seq == 0 {
+    return Ack{}, ErrBadAck
+  }
+  return ack, nil
+}
+
+// PendingReading is a Reading sent and not acknowledged yet.
+type PendingReading struct {
+  Seq     uint32
+  Payload []byte
+}
+
+// Unacked tracks the Readings a device sent, until the server acknowledges them. It is not safe
+// for concurrent use.
+type Unacked struct {
+  last    uint32
+  pending []PendingReading
+}
+
+// Sent records the Reading with payload as sent (after acknowledgements were enabled), and returns
+// its sequence number. Unacked keeps payload until the Reading is acknowledged.
+func (u *Unacked) Sent(payload []byte) uint32 {
+  u.last++
+  u.pending = append(u.pending, PendingReading{Seq: u.last, Payload: payload})
+  return u.last
+}
+
+// Ack applies ack, and returns the Readings it acknowledged as accepted (all up to ack.Seq) or
+// rejected (just ack.Seq). It returns ErrBadAck for a Reading never sent.
+func (u *Unacked) Ack(ack Ack) (accepted []PendingReading, rejected *PendingReading, err error) {
+  if ack.Seq > u.last {
+    return nil, nil, ErrBadAck
+  }
+  if ack.Code != AckAccepted {
+    for i := range u.pending {
+      if u.pending[i].Seq == ack.Seq {
+        rejected := u.pending[i]
+        u.pending = append(u.pending[:i], u.pending[i+1:]...)
+        return nil, &rejected, nil
+      }
+    }
+    return nil, nil, nil
+  }
+
+  n := 0
+  for n < len(u.pending) && u.pending[n].Seq <= ack.Seq {
+    n++
+  }
+  accepted = append([]PendingReading(nil), u.pending[:n]...)
+  u.pending = append(u.pending[:0], u.pending[n:]...)
+  return accepted, nil, nil
+}
+
+// Pending returns the Readings sent and not acknowledged yet, oldest first.
+func (u *Unacked) Pending() []PendingReading {
+  return u.pending
+}
+
+// Len returns the number of Readings not acknowledged yet.
+func (u *Unacked) Len() int {
+  return len(u.pending)
+}
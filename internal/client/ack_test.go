@@ -0,0 +1,44 @@
+package client
+
+import (
+  "testing"
+)
+
+func TestAckRoundTrip(t *testing.T) {
+  ack := Ack{Seq: 70000, Code: NackOutOfRange, Field: FieldBatteryLevel}
+  got, err := DecodeAck(AppendAck(nil, ack))
+  if err != nil || got != ack {
+    t.Errorf("DecodeAck = %+v, %v", got, err)
+  }
+  if _, err := DecodeAck(AppendAck(nil, Ack{Seq: 0})); err != ErrBadAck {
+    t.Errorf("Ack of Reading 0: unexpected error %v", err)
+  }
+  if _, err := DecodeAck([]byte{0, 0, 0, 1, 0}); err != ErrBadAck {
+    t.Errorf("Short ack: unexpected error %v", err)
+  }
+}
+
+// Unacked must drop the Readings acknowledged, cumulatively or not, and only the Reading nacked.
+func TestUnacked(t *testing.T) {
+  var u Unacked
+  for i := 1; i <= 5; i++ {
+    if seq := u.Sent([]byte{byte(i)}); seq != uint32(i) {
+      t.Fatalf("Reading %d numbered %d", i, seq)
+    }
+  }
+
+  _, rejected, err := u.Ack(Ack{Seq: 2, Code: NackMalformed, Field: NoField})
+  if err != nil || rejected == nil || rejected.Payload[0] != 2 || u.Len() != 4 {
+    t.Errorf("Nack: %+v, %v (%d pending)", rejected, err, u.Len())
+  }
+  accepted, _, err := u.Ack(Ack{Seq: 3, Code: AckAccepted, Field: NoField})
+  if err != nil || len(accepted) != 2 || accepted[0].Seq != 1 || accepted[1].Seq != 3 {
+    t.Errorf("Cumulative ack: %+v, %v", accepted, err)
+  }
+  if pending := u.Pending(); len(pending) != 2 || pending[0].Seq != 4 {
+    t.Errorf("Unexpected pending Readings %+v", pending)
+  }
+  if _, _, err := u.Ack(Ack{Seq: 6, Code: AckAccepted}); err != ErrBadAck {
+    t.Errorf("Ack of a Reading never sent: unexpected error %v", err)
+  }
+}
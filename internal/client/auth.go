@@ -0,0 +1,33 @@
+package client
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "io"
+)
+
+// Sizes of the messages of the authentication step that follows the login when the server
+// requires it: the server sends a random nonce, and the device answers with AuthResponse.
+const (
+  NONCE_LENGTH         = 16
+  AUTH_RESPONSE_LENGTH = sha256.Size
+)
+
+// AuthResponse returns the answer to the server's nonce: its HMAC-SHA256 under the device's secret
+// key.
+func AuthResponse(key []byte, nonce []byte) []byte {
+  mac := hmac.New(sha256.New, key)
+  mac.Write(nonce)
+  return mac.Sum(nil)
+}
+
+// Authenticate performs the device's side of the authentication step on rw, right after the login:
+// it reads the server's nonce and answers it with key.
+func Authenticate(rw io.ReadWriter, key []byte) error {
+  var nonce [NONCE_LENGTH]byte
+  if _, err := io.ReadFull(rw, nonce[:]); err != nil {
+    return err
+  }
+  _, err := rw.Write(AuthResponse(key, nonce[:]))
+  return err
+}
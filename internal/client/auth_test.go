@@ -0,0 +1,42 @@
+package client
+
+import (
+  "bytes"
+  "encoding/hex"
+  "net"
+  "testing"
+)
+
+// AuthResponse must be the plain HMAC-SHA256 of the nonce (RFC 4231, test case 2).
+func TestAuthResponse(t *testing.T) {
+  got := hex.EncodeToString(AuthResponse([]byte("Jefe"), []byte("what do ya want for nothing?")))
+  if got != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+    t.Errorf("Unexpected response %v", got)
+  }
+}
+
+// Authenticate must read exactly one nonce and answer it.
+func TestAuthenticate(t *testing.T) {
+  device, server := net.Pipe()
+  defer server.Close()
+  key := []byte("0123456789abcdef")
+  done := make(chan error, 1)
+  go func() {
+    done <- Authenticate(device, key)
+  }()
+
+  nonce := bytes.Repeat([]byte{7}, NONCE_LENGTH)
+  if _, err := server.Write(nonce); err != nil {
+    t.Fatalf("Unable to send nonce: %v", err)
+  }
+  answer := make([]byte, AUTH_RESPONSE_LENGTH)
+  if _, err := server.Read(answer); err != nil {
+    t.Fatalf("Unable to read answer: %v", err)
+  }
+  if !bytes.Equal(answer, AuthResponse(key, nonce)) {
+    t.Errorf("Unexpected answer %x", answer)
+  }
+  if err := <-done; err != nil {
+    t.Errorf("Authenticate failed: %v", err)
+  }
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+  "encoding/binary"
+  "errors"
+)
+
+var (
+  ErrBadBatch = errors.New("client: invalid Reading batch")
+)
+
+// MessageReadingBatch carries Readings a device recorded while it could not reach the server
+// (device to server), oldest first, each with the time the device took it. Its payload is the
+// number of Readings (2 bytes), then for each Reading: the time it was taken, in nanoseconds since
+// the Unix epoch (8 bytes), the length of the Reading (2 bytes) and the Reading, encoded as in a
+// MessageReading (extension included).
+//
+// Each Reading of a batch is acknowledged as if sent in a MessageReading of its own, in order; one
+// timestamped in the future (past the server's allowance for clock drift) is out of range. A
+// malformed batch drops the connection: as its Readings can't be told apart, they can't be
+// acknowledged.
+const MessageReadingBatch MessageType = 10
+
+// Sizes of the parts of a MessageReadingBatch payload.
+const (
+  BATCH_HEADER_LENGTH       = 2
+  BATCH_ENTRY_HEADER_LENGTH = 10
+)
+
+// BatchEntry is a Reading of a MessageReadingBatch.
+type BatchEntry struct {
+  // Timestamp is the time the Reading was taken, in nanoseconds since the Unix epoch.
+  Timestamp int64
+
+  // Reading is the encoded Reading.
+  Reading []byte
+}
+
+// AppendBatch appends the payload of the MessageReadingBatch carrying entries, oldest first, to b.
+func AppendBatch(b []byte, entries []BatchEntry) []byte {
+  b = append(b, byte(len(entries) >> 8), byte(len(entries)))
+  for _, entry := range entries {
+    b = appendUint64(b, uint64(entry.Timestamp))
+    b = append(b, byte(len(entry.Reading) >> 8), byte(len(entry.Reading)))
+    b = append(b, entry.Reading...)
+  }
+  return b
+}
+
+// Batch decodes the payload of a MessageReadingBatch in place: the Readings it yields point into
+// the payload.
+type Batch struct {
+  // Timestamp and Reading are those of the current Reading, as set by Next.
+  Timestamp int64
+  Reading   []byte
+
+  rest []byte
+  left int
+}
+
+// Reset starts decoding payload, and returns the number of Readings it holds. The whole payload is
+// checked first, so that none of the Readings of a malformed batch is used: Reset returns 0 and
+// ErrBadBatch if the payload does not hold exactly the Readings it announces, or they are not
+// oldest first. The Readings themselves are not decoded.
+//
+// Reset does NOT allocate.
+func (bt *Batch) Reset(payload []byte) (int, error) {
+  bt.Timestamp, bt.Reading, bt.rest, bt.left = 0, nil, nil, 0
+  if len(payload) < BATCH_HEADER_LENGTH {
+    return 0, ErrBadBatch
+  }
+  n := int(binary.BigEndian.Uint16(payload))
+  rest := payload[BATCH_HEADER_LENGTH:]
+  previous := int64(0)
+  for i := 0; i < n; i++ {
+    if len(rest) < BATCH_ENTRY_HEADER_LENGTH {
+      return 0, ErrBadBatch
+    }
+    timestamp := int64(binary.BigEndian.Uint64(rest))
+    length := BATCH_ENTRY_HEADER_LENGTH + int(binary.BigEndian.Uint16(rest[8:]))
+    if timestamp <= 0 || timestamp < previous || len(rest) < length {
+      return 0, ErrBadBatch
+    }
+    previous = timestamp
+    rest = rest[length:]
+  }
+  if len(rest) > 0 {
+    return 0, ErrBadBatch
+  }
+  bt.rest, bt.left = payload[BATCH_HEADER_LENGTH:], n
+  return n, nil
+}
+
+// Next advances to the next Reading of the batch, and reports whether there was one.
+func (bt *Batch) Next() bool {
+  if bt.left == 0 {
+    bt.Timestamp, bt.Reading = 0, nil
+    return false
+  }
+  length := BATCH_ENTRY_HEADER_LENGTH + int(binary.BigEndian.Uint16(bt.rest[8:]))
+  bt.Timestamp = int64(binary.BigEndian.Uint64(bt.rest))
+  bt.Reading = bt.rest[BATCH_ENTRY_HEADER_LENGTH:length]
+  bt.rest = bt.rest[length:]
+  bt.left--
+  return true
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+  var extras Extras
+  extras.Set(SensorHumidity, 45.5)
+  entries := []BatchEntry{
+    {Timestamp: 1257894000000000000, Reading: make([]byte, READING_LENGTH)},
+    {Timestamp: 1257894000000000000, Reading: extras.Append(make([]byte, READING_LENGTH))},
+    {Timestamp: 1257894060000000000, Reading: []byte{1, 2, 3}},
+  }
+  payload := AppendBatch(nil, entries)
+
+  var batch Batch
+  if n, err := batch.Reset(payload); n != len(entries) || err != nil {
+    t.Fatalf("Reset = %d, %v", n, err)
+  }
+  for i := 0; batch.Next(); i++ {
+    if batch.Timestamp != entries[i].Timestamp || !bytes.Equal(batch.Reading, entries[i].Reading) {
+      t.Errorf("Reading %d: %d %x", i, batch.Timestamp, batch.Reading)
+    }
+  }
+  if batch.Next() {
+    t.Errorf("Reading past the end of the batch")
+  }
+
+  allocs := testing.AllocsPerRun(100, func() {
+    batch.Reset(payload)
+    for batch.Next() {
+    }
+  })
+  if allocs != 0 {
+    t.Errorf("Batch allocated %v times", allocs)
+  }
+}
+
+func TestBatchErrors(t *testing.T) {
+  reading := make([]byte, READING_LENGTH)
+  valid := AppendBatch(nil, []BatchEntry{{1, reading}, {2, reading}})
+
+  for name, payload := range map[string][]byte{
+    "no header":      {0},
+    "truncated":      valid[:len(valid) - 1],
+    "trailing bytes": append(append([]byte{}, valid...), 0),
+    "out of order":   AppendBatch(nil, []BatchEntry{{2, reading}, {1, reading}}),
+    "no timestamp":   AppendBatch(nil, []BatchEntry{{0, reading}}),
+  } {
+    var batch Batch
+    if _, err := batch.Reset(payload); err != ErrBadBatch {
+      t.Errorf("%s: unexpected error %v", name, err)
+    }
+    if batch.Next() {
+      t.Errorf("%s: Reading of a malformed batch", name)
+    }
+  }
+
+  // the number of Readings announced is not trusted
+  var batch Batch
+  if n, err := batch.Reset([]byte{0xff, 0xff, 0}); n != 0 || err != ErrBadBatch {
+    t.Errorf("Reset = %d, %v", n, err)
+  }
+}
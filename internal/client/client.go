@@ -3,6 +3,7 @@
 package client
 
 import (
+  "crypto/tls"
   "github.com/MarcKriguer/thermomatic/internal/common"
   "net"
   "strconv"
@@ -11,12 +12,68 @@ import (
 
 var ValidImei = []byte { 4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
 
+// The same IMEI, as sent by newer firmware (ASCII digits).
+var ValidAsciiImei = []byte("490154203237518")
+
+// Config configures how a simulated device connects to the server. The zero Config connects to the
+// default port on localhost over plain TCP, without authenticating.
+type Config struct {
+  // Address is the server's TCP address (default "localhost:1337").
+  Address string
+
+  // Key is the device's secret key, for servers requiring authentication (default nil, none).
+  Key []byte
+
+  // TLS, if set, makes Connect dial over TLS (default nil, plain TCP). Set its Certificates to
+  // present a client certificate.
+  TLS *tls.Config
+
+  // Protocol is the version of the wire protocol to ask the server for (default PROTOCOL_V1, the
+  // bare stream, which needs no negotiation).
+  Protocol int
+
+  // Acks is how to ask the server to acknowledge the Readings (default AckNone, no
+  // acknowledgements). It needs PROTOCOL_V2; Connect then only reports "OK" once every Reading is
+  // acknowledged as accepted.
+  Acks AckMode
+
+  // Sensors lists the extra sensors of the device, whose random values follow each Reading (see
+  // Extras). It needs PROTOCOL_V2 (default nil, none).
+  Sensors []SensorID
+
+  // Backlog is the number of Readings the device recorded while it could not reach the server,
+  // sent in MessageReadingBatch messages before the others, one reporting interval apart (default
+  // 0, none). It needs PROTOCOL_V2.
+  Backlog int
+
+  // Firmware, if set, is the device's firmware, which takes the updates the server offers over
+  // PROTOCOL_V2 (default nil, declining them). Connect waits for an update started on the
+  // connection to complete before returning.
+  Firmware *Firmware
+}
+
 // function to connect to the server, send a number of messages, and close the connection.
 // return value is a diagnostic message.
 func Connect(imei []byte, imei_timeout_in_millis uint64, reading_timeout_in_millis uint64,
     readings_to_send int) string {
-  url := "localhost:" + strconv.Itoa(common.DefaultTheromaticPort)
-  conn, err := net.Dial("tcp", url)
+  return Config{}.Connect(imei, imei_timeout_in_millis, reading_timeout_in_millis,
+      readings_to_send)
+}
+
+// Connect is like the package's Connect function, but connects as configured by cfg.
+func (cfg Config) Connect(imei []byte, imei_timeout_in_millis uint64,
+    reading_timeout_in_millis uint64, readings_to_send int) string {
+  url := cfg.Address
+  if url == "" {
+    url = "localhost:" + strconv.Itoa(common.DefaultTheromaticPort)
+  }
+  var conn net.Conn
+  var err error
+  if cfg.TLS != nil {
+    conn, err = tls.Dial("tcp", url, cfg.TLS)
+  } else {
+    conn, err = net.Dial("tcp", url)
+  }
   if err != nil {
     common.LogError(err)
     return "Unable to connect: " + err.Error()
@@ -36,10 +93,81 @@ func Connect(imei []byte, imei_timeout_in_millis uint64, reading_timeout_in_mill
     return "Unable to login: " + err.Error()
   }
 
+  // answer the server's challenge, if it expects one
+  if cfg.Key != nil {
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if err := Authenticate(conn, cfg.Key); err != nil {
+      common.LogError(err)
+      conn.Close()
+      return "Unable to authenticate: " + err.Error()
+    }
+  }
+
+  // negotiate a later protocol version, if asked to
+  version := PROTOCOL_V1
+  if cfg.Protocol > PROTOCOL_V1 {
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if version, err = Negotiate(conn, cfg.Protocol); err != nil {
+      common.LogError(err)
+      conn.Close()
+      return "Unable to negotiate protocol: " + err.Error()
+    }
+  }
+
+  // from protocol v2 on, the server may send messages of its own: receive them in the background
+  var sess *session
+  if version >= PROTOCOL_V2 {
+    conn.SetReadDeadline(time.Time{})
+    sess = newSession(conn, DeviceSettings{ReportingInterval: uint32(reading_timeout_in_millis),
+        Profile: DefaultProfile})
+    sess.firmware = cfg.Firmware
+  }
+
+  // ask for acknowledgements, if wanted
+  if cfg.Acks != AckNone {
+    if sess == nil {
+      conn.Close()
+      return "Unable to enable acknowledgements: protocol v" + strconv.Itoa(version)
+    }
+    if err := sess.enableAcks(cfg.Acks); err != nil {
+      common.LogError(err)
+      conn.Close()
+      return "Unable to enable acknowledgements: " + err.Error()
+    }
+  }
+
+  // catch up on the Readings recorded while offline, if any
+  if cfg.Backlog > 0 {
+    if sess == nil {
+      conn.Close()
+      return "Unable to send backlog: protocol v" + strconv.Itoa(version)
+    }
+    if err := sess.sendBacklog(cfg.Backlog, cfg.Sensors); err != nil {
+      common.LogError(err)
+      conn.Close()
+      return "Unable to send backlog: " + err.Error()
+    }
+  }
+
   var reading Reading
+  var extras Extras
+  interval := time.Duration(reading_timeout_in_millis) * time.Millisecond
   // send "readings_to_send" readings to the server
   for i := 0; i < readings_to_send; i++ {
-    _, err = conn.Write(reading.GenerateRandomReading())
+    message := reading.GenerateRandomReading()
+    if sess != nil {
+      sess.poll()
+      if len(cfg.Sensors) > 0 {
+        extras.GenerateRandom(cfg.Sensors)
+        message = extras.Append(message)
+      }
+      if sess.acking() {
+        sess.unacked.Sent(message)
+      }
+      message = AppendMessage(nil, MessageReading, message)
+    }
+    sentAt := time.Now()
+    _, err = conn.Write(message)
     if err != nil {
       common.LogError(err)
       conn.Close()
@@ -48,10 +176,272 @@ func Connect(imei []byte, imei_timeout_in_millis uint64, reading_timeout_in_mill
     }
 
     // Actually do a Sleep (for the specified number of milliseconds) before logging in, in order to
-    // test the reading_timeout functionality.
-    time.Sleep(time.Duration(reading_timeout_in_millis) * time.Millisecond)
+    // test the reading_timeout functionality. A protocol v2 device handles the messages received in
+    // the meantime, which may change the interval.
+    if sess != nil {
+      sess.sleep(sentAt)
+    } else {
+      time.Sleep(interval)
+    }
+  }
+
+  // wait for the remaining acknowledgements, and the end of the update in progress
+  if sess != nil && sess.acking() {
+    sess.wait(func() bool { return sess.unacked.Len() == 0 }, 5 * time.Second)
+  }
+  if sess != nil && sess.updating {
+    sess.wait(func() bool { return !sess.updating }, 5 * time.Second)
   }
 
   conn.Close()
-  return "OK" // all readings successfully sent.
+  switch {
+  case sess != nil && sess.rejection != "":
+    return sess.rejection
+  case sess != nil && sess.unacked.Len() > 0:
+    return strconv.Itoa(sess.unacked.Len()) + " reading(s) not acknowledged"
+  }
+  return "OK" // all readings successfully sent (and acknowledged, if asked to).
+}
+
+// message is a message received from the server.
+type message struct {
+  t       MessageType
+  payload []byte
+}
+
+// session is a simulated device's protocol v2 session with the server. The messages the server
+// sends are received in the background, and handled by the device between Readings.
+type session struct {
+  conn     net.Conn
+  messages chan message // closed once the connection fails or is closed
+
+  settings  DeviceSettings
+  ackMode   AckMode
+  answered  bool   // whether the server answered the request for acknowledgements
+  unacked   Unacked
+  rejection string // first Reading rejected (or acknowledgement invalid), if any
+
+  firmware *Firmware // nil if the device takes no update
+  updating bool      // whether an update offered on this connection is in progress
+}
+
+// newSession starts receiving the messages the server sends on conn, for a device running with
+// settings.
+func newSession(conn net.Conn, settings DeviceSettings) *session {
+  sess := &session{conn: conn, messages: make(chan message, 64), settings: settings}
+  go sess.receive(NewMessageReader(conn))
+  return sess
+}
+
+// receive queues the messages read from messages, until the connection fails.
+func (sess *session) receive(messages *MessageReader) {
+  defer close(sess.messages)
+  for {
+    t, payload, err := messages.Next()
+    if err != nil {
+      return
+    }
+    sess.messages <- message{t, append([]byte(nil), payload...)}
+  }
+}
+
+// acking reports whether the server acknowledges the Readings.
+func (sess *session) acking() bool {
+  return sess.ackMode != AckNone
+}
+
+// enableAcks asks the server for acknowledgements in mode, and waits for its answer.
+func (sess *session) enableAcks(mode AckMode) error {
+  request := AppendMessage(nil, MessageAckMode, []byte{byte(mode)})
+  if _, err := sess.conn.Write(request); err != nil {
+    return err
+  }
+  if !sess.wait(func() bool { return sess.answered }, 5 * time.Second) {
+    return ErrBadAck
+  }
+  return nil
+}
+
+// sendBacklog sends n random Readings (with values of the extra sensors), taken one reporting
+// interval apart up to now, in as few MessageReadingBatch messages as they fit in.
+func (sess *session) sendBacklog(n int, sensors []SensorID) error {
+  var reading Reading
+  var extras Extras
+  interval := time.Duration(sess.settings.ReportingInterval) * time.Millisecond
+  start := time.Now().Add(-time.Duration(n) * interval)
+
+  var entries []BatchEntry
+  size := BATCH_HEADER_LENGTH
+  for i := 0; i < n; i++ {
+    message := reading.GenerateRandomReading()
+    if len(sensors) > 0 {
+      extras.GenerateRandom(sensors)
+      message = extras.Append(message)
+    }
+    if size + BATCH_ENTRY_HEADER_LENGTH + len(message) > MAX_PAYLOAD_LENGTH {
+      if err := sess.sendBatch(entries); err != nil {
+        return err
+      }
+      entries, size = entries[:0], BATCH_HEADER_LENGTH
+    }
+    taken := start.Add(time.Duration(i) * interval).UnixNano()
+    entries = append(entries, BatchEntry{Timestamp: taken, Reading: message})
+    size += BATCH_ENTRY_HEADER_LENGTH + len(message)
+  }
+  return sess.sendBatch(entries)
+}
+
+// sendBatch sends a MessageReadingBatch carrying entries.
+func (sess *session) sendBatch(entries []BatchEntry) error {
+  if sess.acking() {
+    for _, entry := range entries {
+      sess.unacked.Sent(entry.Reading)
+    }
+  }
+  _, err := sess.conn.Write(AppendMessage(nil, MessageReadingBatch, AppendBatch(nil, entries)))
+  return err
+}
+
+// poll handles the messages received so far, without waiting for more.
+func (sess *session) poll() {
+  for {
+    select {
+    case m, ok := <-sess.messages:
+      if !ok {
+        return
+      }
+      sess.handle(m)
+    default:
+      return
+    }
+  }
+}
+
+// sleep handles the messages received until the reporting interval has elapsed since the given
+// time, or the connection ended. A change of interval applies to the current one.
+func (sess *session) sleep(since time.Time) {
+  for {
+    interval := time.Duration(sess.settings.ReportingInterval) * time.Millisecond
+    remaining := time.Until(since.Add(interval))
+    if remaining <= 0 {
+      return
+    }
+    timer := time.NewTimer(remaining)
+    select {
+    case m, ok := <-sess.messages:
+      timer.Stop()
+      if !ok {
+        return
+      }
+      sess.handle(m)
+    case <-timer.C:
+      return
+    }
+  }
+}
+
+// wait handles the messages received until done reports true, and reports whether it did before
+// timeout (and the connection ended).
+func (sess *session) wait(done func() bool, timeout time.Duration) bool {
+  expired := time.After(timeout)
+  for !done() {
+    select {
+    case m, ok := <-sess.messages:
+      if !ok {
+        return false
+      }
+      sess.handle(m)
+    case <-expired:
+      return false
+    }
+  }
+  return true
+}
+
+// handle handles message m from the server.
+func (sess *session) handle(m message) {
+  switch m.t {
+  case MessageAckMode:
+    if len(m.payload) >= ACK_MODE_LENGTH {
+      sess.ackMode = AckMode(m.payload[0])
+      sess.answered = true
+    }
+
+  case MessageAck:
+    ack, err := DecodeAck(m.payload)
+    if err == nil {
+      _, _, err = sess.unacked.Ack(ack)
+    }
+    switch {
+    case sess.rejection != "":
+      // only the first one is reported
+    case err != nil:
+      sess.rejection = "Invalid acknowledgement: " + err.Error()
+    case ack.Code != AckAccepted:
+      sess.rejection = "Reading #" + strconv.Itoa(int(ack.Seq)) + " rejected: " + ack.Code.String()
+    }
+
+  case MessageConfig:
+    // apply the new settings, and confirm the change
+    id, change, err := DecodeConfig(m.payload)
+    status := ConfigApplied
+    if err != nil {
+      common.LogError(err)
+      status = ConfigRejected
+    } else {
+      sess.settings = change.Apply(sess.settings)
+    }
+    sess.send(MessageConfigAck, AppendConfigAck(nil, id, status))
+
+  case MessageFirmwareOffer:
+    offer, err := DecodeFirmwareOffer(m.payload)
+    if err != nil {
+      common.LogError(err)
+      return
+    }
+    offset, accepted := uint32(0), false
+    if sess.firmware != nil {
+      offset, accepted = sess.firmware.Accept(offer)
+    }
+    if !accepted {
+      sess.send(MessageFirmwareStatus, AppendFirmwareStatus(nil, offer.Version, FirmwareDeclined))
+      return
+    }
+    sess.updating = true
+    sess.send(MessageFirmwareRequest, AppendFirmwareRequest(nil, offer.Version, offset))
+
+  case MessageFirmwareChunk:
+    version, offset, data, err := DecodeFirmwareChunk(m.payload)
+    if !sess.updating || version != sess.firmware.Offer.Version {
+      return
+    }
+    next := uint32(len(sess.firmware.Image))
+    done := false
+    switch {
+    case err == ErrChunkChecksum:
+      // ask for it again
+    case err != nil:
+      common.LogError(err)
+      return
+    default:
+      next, done, err = sess.firmware.Receive(offset, data)
+    }
+    switch {
+    case err == ErrFirmwareDigest:
+      sess.updating = false
+      sess.send(MessageFirmwareStatus, AppendFirmwareStatus(nil, version, FirmwareCorrupted))
+    case done:
+      sess.updating = false
+      sess.send(MessageFirmwareStatus, AppendFirmwareStatus(nil, version, FirmwareInstalled))
+    default:
+      sess.send(MessageFirmwareRequest, AppendFirmwareRequest(nil, version, next))
+    }
+  }
+}
+
+// send sends a message of type t carrying payload to the server.
+func (sess *session) send(t MessageType, payload []byte) {
+  if _, err := sess.conn.Write(AppendMessage(nil, t, payload)); err != nil {
+    common.LogError(err)
+  }
 }
@@ -0,0 +1,256 @@
+package client
+
+import (
+  "encoding/binary"
+  "errors"
+  "math"
+  "math/rand"
+  "strconv"
+)
+
+var (
+  ErrBadExtras     = errors.New("client: invalid Reading extension")
+  ErrUnknownSensor = errors.New("client: unknown sensor")
+)
+
+// Readings from later hardware revisions carry the values of their extra sensors in an extension,
+// following the 40 bytes of the Reading in a MessageReading: a list of type-length-value fields,
+// each a SensorID (1 byte), the length of the value (1 byte) and the value (a float64 for the
+// sensors registered so far). Decoders skip the sensors they don't know, so that devices can add
+// sensors before servers learn about them. Version 1 Readings have no extension.
+const (
+  EXTRA_HEADER_LENGTH = 2
+
+  // MAX_EXTRAS is the most sensors an extension holds.
+  MAX_EXTRAS = 16
+)
+
+// SensorID identifies an extra sensor, in the extension of a Reading.
+type SensorID uint8
+
+const (
+  SensorHumidity     SensorID = 1
+  SensorSoilMoisture SensorID = 2
+  SensorLight        SensorID = 3
+)
+
+// Sensor describes a registered extra sensor.
+type Sensor struct {
+  ID SensorID
+
+  // Name identifies the sensor in records (as a column or JSON field) and logs.
+  Name string
+
+  // Unit is the unit of the sensor's values.
+  Unit string
+
+  // Range is the valid range of the sensor's values.
+  Range Range
+}
+
+// Sensors lists the registered extra sensors, sorted by ID. IDs are never reused: a sensor retired
+// keeps its ID.
+var Sensors = []Sensor{
+  {ID: SensorHumidity, Name: "humidity", Unit: "%RH", Range: Range{Min: 0, Max: 100}},
+  {ID: SensorSoilMoisture, Name: "soil_moisture", Unit: "%VWC", Range: Range{Min: 0, Max: 100}},
+  {ID: SensorLight, Name: "light", Unit: "lx", Range: Range{Min: 0, Max: 200000}},
+}
+
+// LookupSensor returns the registered sensor with the given ID, or nil.
+func LookupSensor(id SensorID) *Sensor {
+  for i := range Sensors {
+    if Sensors[i].ID == id {
+      return &Sensors[i]
+    }
+  }
+  return nil
+}
+
+// String returns the name of the sensor.
+func (id SensorID) String() string {
+  if sensor := LookupSensor(id); sensor != nil {
+    return sensor.Name
+  }
+  return "sensor " + strconv.Itoa(int(id))
+}
+
+// ParseSensor returns the ID of the registered sensor with the given name.
+func ParseSensor(name string) (SensorID, error) {
+  for _, sensor := range Sensors {
+    if sensor.Name == name {
+      return sensor.ID, nil
+    }
+  }
+  return 0, ErrUnknownSensor
+}
+
+// MarshalText returns the name of the sensor, which must be registered.
+func (id SensorID) MarshalText() ([]byte, error) {
+  sensor := LookupSensor(id)
+  if sensor == nil {
+    return nil, ErrUnknownSensor
+  }
+  return []byte(sensor.Name), nil
+}
+
+// UnmarshalText sets the sensor to the registered one named text.
+func (id *SensorID) UnmarshalText(text []byte) (err error) {
+  *id, err = ParseSensor(string(text))
+  return err
+}
+
+// Extra is the value of an extra sensor.
+type Extra struct {
+  Sensor SensorID
+  Value  float64
+}
+
+// Extras holds the values of the extra sensors of a Reading, in the order of its extension. Its
+// storage is fixed: decoding into an Extras reused across Readings does not allocate.
+type Extras struct {
+  n      int
+  values [MAX_EXTRAS]Extra
+}
+
+// Len returns the number of values held.
+func (x *Extras) Len() int {
+  return x.n
+}
+
+// At returns the ith value held.
+func (x *Extras) At(i int) Extra {
+  return x.values[i]
+}
+
+// Get returns the value of sensor id, if held.
+func (x *Extras) Get(id SensorID) (float64, bool) {
+  for _, extra := range x.values[:x.n] {
+    if extra.Sensor == id {
+      return extra.Value, true
+    }
+  }
+  return 0, false
+}
+
+// Set sets the value of sensor id. It returns ErrBadExtras if x holds MAX_EXTRAS values already.
+func (x *Extras) Set(id SensorID, value float64) error {
+  for i := range x.values[:x.n] {
+    if x.values[i].Sensor == id {
+      x.values[i].Value = value
+      return nil
+    }
+  }
+  if x.n == MAX_EXTRAS {
+    return ErrBadExtras
+  }
+  x.values[x.n] = Extra{Sensor: id, Value: value}
+  x.n++
+  return nil
+}
+
+// Reset empties x.
+func (x *Extras) Reset() {
+  x.n = 0
+}
+
+// Append appends the extension holding the values of x to b.
+func (x *Extras) Append(b []byte) []byte {
+  for _, extra := range x.values[:x.n] {
+    b = append(b, byte(extra.Sensor), 8)
+    b = appendUint64(b, math.Float64bits(extra.Value))
+  }
+  return b
+}
+
+// Decode decodes the extension b into x, skipping the sensors not registered. It returns
+// ErrBadExtras if the extension is truncated, lists a sensor twice, holds more than MAX_EXTRAS
+// registered sensors, or a value of the wrong length.
+//
+// Decode does NOT allocate.
+func (x *Extras) Decode(b []byte) error {
+  x.n = 0
+  for len(b) > 0 {
+    if len(b) < EXTRA_HEADER_LENGTH || len(b) < EXTRA_HEADER_LENGTH + int(b[1]) {
+      return ErrBadExtras
+    }
+    id, value := SensorID(b[0]), b[EXTRA_HEADER_LENGTH:EXTRA_HEADER_LENGTH + int(b[1])]
+    b = b[EXTRA_HEADER_LENGTH + len(value):]
+    if LookupSensor(id) == nil {
+      continue
+    }
+    if _, listed := x.Get(id); listed || len(value) != 8 || x.n == MAX_EXTRAS {
+      return ErrBadExtras
+    }
+    x.values[x.n] = Extra{Sensor: id, Value: math.Float64frombits(binary.BigEndian.Uint64(value))}
+    x.n++
+  }
+  return nil
+}
+
+// Validate checks that every value of x is within the valid range of its sensor, as per
+// DefaultProfile (values of sensors not registered are not checked). NaN and infinite values are
+// never valid.
+//
+// Returns nil if x is valid, or a *SensorRangeError describing the first invalid value. Validate
+// does NOT allocate unless a value is out of range.
+func (x *Extras) Validate() error {
+  return x.ValidateWith(&DefaultProfile)
+}
+
+// ValidateWith is like Validate, but checks the values against the ranges of profile p.
+func (x *Extras) ValidateWith(p *Profile) error {
+  for _, extra := range x.values[:x.n] {
+    if rg, ok := p.SensorRange(extra.Sensor); ok && !rg.Contains(extra.Value) {
+      return &SensorRangeError{Sensor: extra.Sensor, Value: extra.Value, Range: rg,
+          Profile: p.Name}
+    }
+  }
+  return nil
+}
+
+// TryDecodeExtended is like TryDecodeWith, but also decodes the extension following the first 40
+// bytes of b (if any) into x, and validates it against p too. It returns ErrBadExtras for an
+// invalid extension, and a *SensorRangeError for an extra sensor out of range.
+//
+// TryDecodeExtended does NOT allocate, unless a field is out of range.
+func (r *Reading) TryDecodeExtended(b []byte, p *Profile, x *Extras) error {
+  if err := r.TryDecodeWith(b, p); err != nil {
+    x.Reset()
+    return err
+  }
+  if err := x.Decode(b[READING_LENGTH:]); err != nil {
+    return err
+  }
+  return x.ValidateWith(p)
+}
+
+// SensorRangeError reports an extra sensor whose value is outside its valid range (or isn't a
+// number at all).
+type SensorRangeError struct {
+  Sensor SensorID
+  Value  float64
+  Range  Range
+
+  // Profile is the name of the profile the Reading was validated against.
+  Profile string
+}
+
+func (e *SensorRangeError) Error() string {
+  message := "client: " + e.Sensor.String() + " out of range: " +
+      strconv.FormatFloat(e.Value, 'g', -1, 64) + " not in " + e.Range.String()
+  if e.Profile != "" && e.Profile != DefaultProfile.Name {
+    message += " (profile " + e.Profile + ")"
+  }
+  return message
+}
+
+// GenerateRandom sets x to random valid values of the registered sensors among sensors [this
+// method only used by test methods]
+func (x *Extras) GenerateRandom(sensors []SensorID) {
+  x.Reset()
+  for _, id := range sensors {
+    if sensor := LookupSensor(id); sensor != nil {
+      x.Set(id, sensor.Range.Min + rand.Float64() * (sensor.Range.Max - sensor.Range.Min))
+    }
+  }
+}
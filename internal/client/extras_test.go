@@ -0,0 +1,108 @@
+package client
+
+import (
+  "math"
+  "testing"
+)
+
+func TestExtrasRoundTrip(t *testing.T) {
+  var x, decoded Extras
+  x.Set(SensorHumidity, 45.5)
+  x.Set(SensorLight, 1200)
+  if err := decoded.Decode(x.Append(nil)); err != nil || decoded != x {
+    t.Errorf("Decode = %+v, %v", decoded, err)
+  }
+
+  // sensors not registered are skipped, whatever the length of their value
+  b := append([]byte{200, 3, 1, 2, 3}, x.Append(nil)...)
+  if err := decoded.Decode(b); err != nil || decoded != x {
+    t.Errorf("Decode with an unknown sensor = %+v, %v", decoded, err)
+  }
+
+  // an empty extension holds no values
+  if err := decoded.Decode(nil); err != nil || decoded.Len() != 0 {
+    t.Errorf("Decode(nil) = %+v, %v", decoded, err)
+  }
+}
+
+func TestExtrasDecodeErrors(t *testing.T) {
+  var x Extras
+  x.Set(SensorHumidity, 45.5)
+  valid := x.Append(nil)
+
+  for name, b := range map[string][]byte{
+    "truncated header": {byte(SensorHumidity)},
+    "truncated value":  valid[:len(valid) - 1],
+    "listed twice":     append(append([]byte{}, valid...), valid...),
+    "wrong length":     {byte(SensorHumidity), 4, 0, 0, 0, 0},
+  } {
+    if err := x.Decode(b); err != ErrBadExtras {
+      t.Errorf("%s: unexpected error %v", name, err)
+    }
+  }
+}
+
+func TestExtrasValidate(t *testing.T) {
+  var x Extras
+  x.Set(SensorHumidity, 45.5)
+  x.Set(SensorID(200), -1e9)
+  if err := x.Validate(); err != nil {
+    t.Errorf("Unexpected error %v", err)
+  }
+
+  for _, value := range []float64{101, -0.5, math.NaN()} {
+    x.Set(SensorHumidity, value)
+    err, ok := x.Validate().(*SensorRangeError)
+    if !ok || err.Sensor != SensorHumidity {
+      t.Errorf("Humidity %v: unexpected error %v", value, x.Validate())
+    }
+  }
+
+  // a profile may restrict the sensors' ranges
+  greenhouse := Profile{Name: "greenhouse", Ranges: DefaultProfile.Ranges,
+      Sensors: map[SensorID]Range{SensorHumidity: {Min: 20, Max: 90}}}
+  x.Set(SensorHumidity, 45.5)
+  if err := x.ValidateWith(&greenhouse); err != nil {
+    t.Errorf("Unexpected error %v", err)
+  }
+  x.Set(SensorHumidity, 95)
+  if x.Validate() != nil {
+    t.Errorf("Humidity 95 refused by the default profile")
+  }
+  err, ok := x.ValidateWith(&greenhouse).(*SensorRangeError)
+  if !ok || err.Range != greenhouse.Sensors[SensorHumidity] || err.Profile != "greenhouse" {
+    t.Errorf("Humidity 95: unexpected error %v", x.ValidateWith(&greenhouse))
+  }
+}
+
+func TestTryDecodeExtended(t *testing.T) {
+  reading := Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4,
+      BatteryLevel: 0.25666}
+  var x, decoded Extras
+  x.Set(SensorSoilMoisture, 31.2)
+  encoded := x.Append(reading.Encode())
+
+  var r Reading
+  if err := r.TryDecodeExtended(encoded, &DefaultProfile, &decoded); err != nil || r != reading ||
+      decoded != x {
+    t.Errorf("TryDecodeExtended = %+v, %+v, %v", r, decoded, err)
+  }
+  // a version 1 Reading has no extension
+  if err := r.TryDecodeExtended(reading.Encode(), &DefaultProfile, &decoded); err != nil ||
+      decoded.Len() != 0 {
+    t.Errorf("TryDecodeExtended without extension = %+v, %v", decoded, err)
+  }
+
+  allocs := testing.AllocsPerRun(100, func() {
+    r.TryDecodeExtended(encoded, &DefaultProfile, &decoded)
+  })
+  if allocs != 0 {
+    t.Errorf("TryDecodeExtended allocated %v times", allocs)
+  }
+
+  x.Set(SensorSoilMoisture, 120)
+  encoded = x.Append(reading.Encode())
+  if _, ok := r.TryDecodeExtended(encoded, &DefaultProfile, &decoded).(*SensorRangeError); !ok {
+    t.Errorf("Soil moisture out of range accepted")
+  }
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/binary"
+  "errors"
+  "hash/crc32"
+  "strconv"
+)
+
+var (
+  ErrBadFirmwareMessage = errors.New("client: invalid firmware message")
+  ErrChunkChecksum      = errors.New("client: firmware chunk checksum mismatch")
+  ErrFirmwareDigest     = errors.New("client: firmware image digest mismatch")
+)
+
+// More version 2 message types, for firmware updates.
+//
+// The server offers an update right after login. A device taking it asks for the image chunk by
+// chunk, each request acknowledging the bytes before its offset; a device that lost its connection
+// mid-download asks for the rest when it is offered the same update again. Once it has the whole
+// image, the device checks its digest and reports the outcome.
+const (
+  // MessageFirmwareOffer offers a firmware update (server to device). Its payload is a
+  // FirmwareOffer.
+  MessageFirmwareOffer MessageType = 6
+
+  // MessageFirmwareRequest asks for the chunk of the image starting at an offset (device to
+  // server). Its payload is the version of the image and the offset.
+  MessageFirmwareRequest MessageType = 7
+
+  // MessageFirmwareChunk carries a chunk of the image (server to device). Its payload is the
+  // version of the image, the offset of the chunk, its CRC-32 (IEEE) and its data.
+  MessageFirmwareChunk MessageType = 8
+
+  // MessageFirmwareStatus reports the outcome of an update (device to server). Its payload is the
+  // version of the image and a FirmwareStatus.
+  MessageFirmwareStatus MessageType = 9
+)
+
+// Sizes of the payloads of the firmware messages.
+const (
+  FIRMWARE_OFFER_LENGTH        = 10 + sha256.Size
+  FIRMWARE_REQUEST_LENGTH      = 8
+  FIRMWARE_CHUNK_HEADER_LENGTH = 12
+  FIRMWARE_STATUS_LENGTH       = 5
+
+  // MAX_FIRMWARE_CHUNK is the most data a MessageFirmwareChunk carries.
+  MAX_FIRMWARE_CHUNK = MAX_PAYLOAD_LENGTH - FIRMWARE_CHUNK_HEADER_LENGTH
+)
+
+// FirmwareOffer is the payload of a MessageFirmwareOffer.
+type FirmwareOffer struct {
+  Version uint32
+  Size    uint32
+
+  // ChunkSize is the size of the chunks the server sends (the last one may be shorter).
+  ChunkSize uint16
+
+  // Digest is the SHA-256 of the whole image.
+  Digest [sha256.Size]byte
+}
+
+// AppendFirmwareOffer appends the payload of a MessageFirmwareOffer to b.
+func AppendFirmwareOffer(b []byte, offer FirmwareOffer) []byte {
+  b = appendUint32(appendUint32(b, offer.Version), offer.Size)
+  b = append(b, byte(offer.ChunkSize >> 8), byte(offer.ChunkSize))
+  return append(b, offer.Digest[:]...)
+}
+
+// DecodeFirmwareOffer decodes the payload of a MessageFirmwareOffer.
+func DecodeFirmwareOffer(payload []byte) (FirmwareOffer, error) {
+  var offer FirmwareOffer
+  if len(payload) < FIRMWARE_OFFER_LENGTH {
+    return offer, ErrBadFirmwareMessage
+  }
+  offer.Version = binary.BigEndian.Uint32(payload[0:4])
+  offer.Size = binary.BigEndian.Uint32(payload[4:8])
+  offer.ChunkSize = binary.BigEndian.Uint16(payload[8:10])
+  copy(offer.Digest[:], payload[10:])
+  if offer.ChunkSize == 0 || offer.ChunkSize > MAX_FIRMWARE_CHUNK {
+    return offer, ErrBadFirmwareMessage
+  }
+  return offer, nil
+}
+
+// AppendFirmwareRequest appends the payload of the MessageFirmwareRequest asking for the chunk of
+// image version at offset to b.
+func AppendFirmwareRequest(b []byte, version uint32, offset uint32) []byte {
+  return appendUint32(appendUint32(b, version), offset)
+}
+
+// DecodeFirmwareRequest decodes the payload of a MessageFirmwareRequest.
+func DecodeFirmwareRequest(payload []byte) (version uint32, offset uint32, err error) {
+  if len(payload) < FIRMWARE_REQUEST_LENGTH {
+    return 0, 0, ErrBadFirmwareMessage
+  }
+  return binary.BigEndian.Uint32(payload[0:4]), binary.BigEndian.Uint32(payload[4:8]), nil
+}
+
+// AppendFirmwareChunk appends the payload of the MessageFirmwareChunk carrying data, at offset in
+// image version, to b. It panics if data is longer than MAX_FIRMWARE_CHUNK.
+func AppendFirmwareChunk(b []byte, version uint32, offset uint32, data []byte) []byte {
+  if len(data) > MAX_FIRMWARE_CHUNK {
+    panic(ErrMessageLength)
+  }
+  b = appendUint32(appendUint32(b, version), offset)
+  b = appendUint32(b, crc32.ChecksumIEEE(data))
+  return append(b, data...)
+}
+
+// DecodeFirmwareChunk decodes the payload of a MessageFirmwareChunk. The data points into payload.
+// It returns ErrChunkChecksum if the data does not match its checksum.
+func DecodeFirmwareChunk(payload []byte) (version uint32, offset uint32, data []byte, err error) {
+  if len(payload) < FIRMWARE_CHUNK_HEADER_LENGTH {
+    return 0, 0, nil, ErrBadFirmwareMessage
+  }
+  version = binary.BigEndian.Uint32(payload[0:4])
+  offset = binary.BigEndian.Uint32(payload[4:8])
+  data = payload[FIRMWARE_CHUNK_HEADER_LENGTH:]
+  if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(payload[8:12]) {
+    return version, offset, nil, ErrChunkChecksum
+  }
+  return version, offset, data, nil
+}
+
+// FirmwareStatus is the outcome of a firmware update, as reported by the device.
+type FirmwareStatus uint8
+
+const (
+  // FirmwareInstalled reports an image received whole, matching its digest, and installed.
+  FirmwareInstalled FirmwareStatus = iota
+
+  // FirmwareCorrupted reports an image received whole, not matching its digest. The device drops
+  // it, and starts over when offered the update again.
+  FirmwareCorrupted
+
+  // FirmwareDeclined reports an update the device does not take (it runs that version or a later
+  // one, or does not take updates).
+  FirmwareDeclined
+)
+
+// String returns the name of the status.
+func (st FirmwareStatus) String() string {
+  switch st {
+  case FirmwareInstalled:
+    return "installed"
+  case FirmwareCorrupted:
+    return "corrupted"
+  case FirmwareDeclined:
+    return "declined"
+  }
+  return "status " + strconv.Itoa(int(st))
+}
+
+// AppendFirmwareStatus appends the payload of the MessageFirmwareStatus reporting status for image
+// version to b.
+func AppendFirmwareStatus(b []byte, version uint32, status FirmwareStatus) []byte {
+  return append(appendUint32(b, version), byte(status))
+}
+
+// DecodeFirmwareStatus decodes the payload of a MessageFirmwareStatus.
+func DecodeFirmwareStatus(payload []byte) (uint32, FirmwareStatus, error) {
+  if len(payload) < FIRMWARE_STATUS_LENGTH {
+    return 0, 0, ErrBadFirmwareMessage
+  }
+  return binary.BigEndian.Uint32(payload), FirmwareStatus(payload[4]), nil
+}
+
+// Firmware is the firmware of a simulated device, with the update it is downloading, if any. It
+// outlives connections: an interrupted download resumes where it stopped. It is not safe for
+// concurrent use.
+type Firmware struct {
+  // Version is the version installed.
+  Version uint32
+
+  // Offer is the update being downloaded, if any, and Image the part of it received so far.
+  Offer *FirmwareOffer
+  Image []byte
+}
+
+// Accept reports whether the device takes offer, and if it does, returns the offset to ask for
+// first: where an earlier download of the same image stopped, or 0.
+//
+// The image grows as its chunks arrive: the size offered is not trusted to allocate it upfront.
+func (fw *Firmware) Accept(offer FirmwareOffer) (uint32, bool) {
+  if offer.Version <= fw.Version {
+    return 0, false
+  }
+  if fw.Offer == nil || *fw.Offer != offer {
+    fw.Offer = &offer
+    fw.Image = nil
+  }
+  return uint32(len(fw.Image)), true
+}
+
+// Receive takes the chunk data of the image being downloaded, at offset, and returns the offset to
+// ask for next. A chunk that is not the one expected is ignored.
+//
+// Once the image is complete, Receive installs it and returns done. If the image does not match
+// its digest, Receive drops it and returns ErrFirmwareDigest.
+func (fw *Firmware) Receive(offset uint32, data []byte) (next uint32, done bool, err error) {
+  if fw.Offer == nil {
+    return 0, false, ErrBadFirmwareMessage
+  }
+  if int(offset) == len(fw.Image) && len(fw.Image) + len(data) <= int(fw.Offer.Size) {
+    fw.Image = append(fw.Image, data...)
+  }
+  if len(fw.Image) < int(fw.Offer.Size) {
+    return uint32(len(fw.Image)), false, nil
+  }
+
+  offer := fw.Offer
+  digest := sha256.Sum256(fw.Image)
+  fw.Offer, fw.Image = nil, nil
+  if !bytes.Equal(digest[:], offer.Digest[:]) {
+    return 0, false, ErrFirmwareDigest
+  }
+  fw.Version = offer.Version
+  return offer.Size, true, nil
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+  "crypto/sha256"
+  "testing"
+)
+
+func TestFirmwareMessagesRoundTrip(t *testing.T) {
+  offer := FirmwareOffer{Version: 3, Size: 70000, ChunkSize: 1024, Digest: sha256.Sum256(nil)}
+  if got, err := DecodeFirmwareOffer(AppendFirmwareOffer(nil, offer)); err != nil || got != offer {
+    t.Errorf("DecodeFirmwareOffer = %+v, %v", got, err)
+  }
+  offer.ChunkSize = 0
+  if _, err := DecodeFirmwareOffer(AppendFirmwareOffer(nil, offer)); err != ErrBadFirmwareMessage {
+    t.Errorf("Offer without chunks: unexpected error %v", err)
+  }
+
+  version, offset, err := DecodeFirmwareRequest(AppendFirmwareRequest(nil, 3, 2048))
+  if err != nil || version != 3 || offset != 2048 {
+    t.Errorf("DecodeFirmwareRequest = %d, %d, %v", version, offset, err)
+  }
+
+  chunk := AppendFirmwareChunk(nil, 3, 2048, []byte("firmware"))
+  version, offset, data, err := DecodeFirmwareChunk(chunk)
+  if err != nil || version != 3 || offset != 2048 || string(data) != "firmware" {
+    t.Errorf("DecodeFirmwareChunk = %d, %d, %q, %v", version, offset, data, err)
+  }
+  chunk[len(chunk) - 1] ^= 1
+  if _, _, _, err := DecodeFirmwareChunk(chunk); err != ErrChunkChecksum {
+    t.Errorf("Corrupted chunk: unexpected error %v", err)
+  }
+
+  version, status, err := DecodeFirmwareStatus(AppendFirmwareStatus(nil, 3, FirmwareCorrupted))
+  if err != nil || version != 3 || status != FirmwareCorrupted {
+    t.Errorf("DecodeFirmwareStatus = %d, %v, %v", version, status, err)
+  }
+}
+
+// A download must resume where it stopped, and only install an image matching its digest.
+func TestFirmwareDownload(t *testing.T) {
+  image := []byte("0123456789")
+  offer := FirmwareOffer{Version: 2, Size: uint32(len(image)), ChunkSize: 4,
+      Digest: sha256.Sum256(image)}
+  fw := Firmware{Version: 1}
+
+  if _, ok := fw.Accept(FirmwareOffer{Version: 1}); ok {
+    t.Errorf("Installed version accepted")
+  }
+  if offset, ok := fw.Accept(offer); !ok || offset != 0 {
+    t.Fatalf("Accept = %d, %v", offset, ok)
+  }
+  if next, done, err := fw.Receive(0, image[0:4]); next != 4 || done || err != nil {
+    t.Errorf("Receive = %d, %v, %v", next, done, err)
+  }
+  // a chunk out of place is ignored
+  if next, done, err := fw.Receive(8, image[8:]); next != 4 || done || err != nil {
+    t.Errorf("Receive out of place = %d, %v, %v", next, done, err)
+  }
+
+  // offered again (on a new connection), it resumes
+  if offset, ok := fw.Accept(offer); !ok || offset != 4 {
+    t.Fatalf("Accept again = %d, %v", offset, ok)
+  }
+  fw.Receive(4, image[4:8])
+  if next, done, err := fw.Receive(8, image[8:]); next != 10 || !done || err != nil {
+    t.Errorf("Receive last = %d, %v, %v", next, done, err)
+  }
+  if fw.Version != 2 || fw.Offer != nil || fw.Image != nil {
+    t.Errorf("Image not installed: %+v", fw)
+  }
+
+  offer.Version = 3
+  fw.Accept(offer)
+  if _, _, err := fw.Receive(0, []byte("0123456780")); err != ErrFirmwareDigest {
+    t.Errorf("Corrupted image: unexpected error %v", err)
+  }
+  if fw.Version != 2 || fw.Offer != nil {
+    t.Errorf("Corrupted image installed: %+v", fw)
+  }
+
+  // the size offered is not allocated upfront
+  offer.Size = 1 << 32 - 1
+  allocs := testing.AllocsPerRun(10, func() {
+    fw.Offer = nil
+    fw.Accept(offer)
+  })
+  if allocs > 1 || cap(fw.Image) != 0 {
+    t.Errorf("Accept allocated %v times, the image %d bytes", allocs, cap(fw.Image))
+  }
+}
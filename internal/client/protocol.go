@@ -0,0 +1,204 @@
+package client
+
+import (
+  "encoding/binary"
+  "errors"
+  "hash/crc32"
+  "io"
+  "strconv"
+)
+
+var (
+  ErrBadHello        = errors.New("client: invalid protocol hello")
+  ErrMessageLength   = errors.New("client: message too long or truncated")
+  ErrMessageChecksum = errors.New("client: message checksum mismatch")
+)
+
+// Versions of the wire protocol.
+//
+// Version 1 is the original bare stream: the login, then 40-byte Readings back to back. A device
+// asks for a later version by sending a hello right after logging in (and authenticating); the
+// server answers with a hello of its own, carrying the version the connection speaks from then on.
+// In version 2 every message is framed: a header (type, payload length and CRC32) then the payload.
+const (
+  PROTOCOL_V1 = 1
+  PROTOCOL_V2 = 2
+
+  // LATEST_PROTOCOL is the latest version this package speaks.
+  LATEST_PROTOCOL = PROTOCOL_V2
+)
+
+// Sizes of the protocol's messages.
+const (
+  HELLO_LENGTH       = 4
+  HEADER_LENGTH      = 7
+  MAX_PAYLOAD_LENGTH = 4096 - HEADER_LENGTH
+)
+
+// helloMagic starts a hello. As the first bytes of a version 1 Reading, it would make the
+// temperature about -2.2e305, far out of the valid range: a server can tell a hello from a Reading.
+var helloMagic = [3]byte{0xff, 'T', 'M'}
+
+// MessageType identifies the kind of a version 2 message.
+type MessageType uint8
+
+const (
+  // MessageReading carries a Reading, encoded as in version 1. Later hardware revisions append an
+  // extension with their extra sensors (see Extras): decoders that don't know about it ignore the
+  // bytes past the first 40.
+  MessageReading MessageType = 1
+)
+
+// String returns the name of the message type.
+func (t MessageType) String() string {
+  switch t {
+  case MessageReading:
+    return "reading"
+  }
+  return "type " + strconv.Itoa(int(t))
+}
+
+// AppendHello appends the hello asking for (or agreeing on) protocol version to b.
+func AppendHello(b []byte, version int) []byte {
+  return append(b, helloMagic[0], helloMagic[1], helloMagic[2], byte(version))
+}
+
+// IsHello reports whether b starts with a hello.
+func IsHello(b []byte) bool {
+  return len(b) >= HELLO_LENGTH && b[0] == helloMagic[0] && b[1] == helloMagic[1] &&
+      b[2] == helloMagic[2]
+}
+
+// ParseHello returns the protocol version carried by the hello at the start of b, or ErrBadHello
+// if b does not start with a valid hello.
+func ParseHello(b []byte) (int, error) {
+  if !IsHello(b) || b[3] < PROTOCOL_V1 {
+    return 0, ErrBadHello
+  }
+  return int(b[3]), nil
+}
+
+// Negotiate asks the server on rw for protocol version, and returns the version the server agreed
+// on (at most version). The caller sets rw's deadlines: a server too old to know about versions
+// does not answer.
+func Negotiate(rw io.ReadWriter, version int) (int, error) {
+  if _, err := rw.Write(AppendHello(nil, version)); err != nil {
+    return 0, err
+  }
+  var hello [HELLO_LENGTH]byte
+  if _, err := io.ReadFull(rw, hello[:]); err != nil {
+    return 0, err
+  }
+  agreed, err := ParseHello(hello[:])
+  if err != nil {
+    return 0, err
+  }
+  if agreed > version {
+    return 0, ErrBadHello
+  }
+  return agreed, nil
+}
+
+// Header is the header of a version 2 message.
+type Header struct {
+  Type MessageType
+
+  // Length is the length of the payload following the header.
+  Length int
+
+  // Checksum is the CRC-32 (IEEE) of the type, the length and the payload.
+  Checksum uint32
+}
+
+// DecodeHeader decodes the header at the start of b. It returns ErrMessageLength if b is shorter
+// than a header, or the header announces a payload longer than MAX_PAYLOAD_LENGTH.
+func DecodeHeader(b []byte) (Header, error) {
+  if len(b) < HEADER_LENGTH {
+    return Header{}, ErrMessageLength
+  }
+  h := Header{
+    Type:     MessageType(b[0]),
+    Length:   int(binary.BigEndian.Uint16(b[1:3])),
+    Checksum: binary.BigEndian.Uint32(b[3:7]),
+  }
+  if h.Length > MAX_PAYLOAD_LENGTH {
+    return Header{}, ErrMessageLength
+  }
+  return h, nil
+}
+
+// AppendMessage appends a version 2 message of type t carrying payload to b. It panics if payload
+// is longer than MAX_PAYLOAD_LENGTH.
+func AppendMessage(b []byte, t MessageType, payload []byte) []byte {
+  if len(payload) > MAX_PAYLOAD_LENGTH {
+    panic(ErrMessageLength)
+  }
+  start := len(b)
+  b = append(b, byte(t), byte(len(payload) >> 8), byte(len(payload)), 0, 0, 0, 0)
+  binary.BigEndian.PutUint32(b[start+3:], messageChecksum(b[start:], payload))
+  b = append(b, payload...)
+  return b
+}
+
+// DecodeMessage decodes the version 2 message b, which holds exactly one message, and returns its
+// type and payload (pointing into b). It returns ErrMessageLength if the length of b does not match
+// its header, and ErrMessageChecksum if the message was corrupted.
+//
+// DecodeMessage does NOT allocate.
+func DecodeMessage(b []byte) (MessageType, []byte, error) {
+  h, err := DecodeHeader(b)
+  if err != nil {
+    return 0, nil, err
+  }
+  if len(b) != HEADER_LENGTH + h.Length {
+    return 0, nil, ErrMessageLength
+  }
+  payload := b[HEADER_LENGTH:]
+  if messageChecksum(b, payload) != h.Checksum {
+    return 0, nil, ErrMessageChecksum
+  }
+  return h.Type, payload, nil
+}
+
+// messageChecksum returns the checksum of the message with header h (whose checksum is ignored)
+// and payload.
+func messageChecksum(h []byte, payload []byte) uint32 {
+  return crc32.Update(crc32.ChecksumIEEE(h[:3]), crc32.IEEETable, payload)
+}
+
+// MessageReader reads version 2 messages from a stream, into a buffer it reuses.
+type MessageReader struct {
+  r   io.Reader
+  buf []byte
+}
+
+// NewMessageReader returns a MessageReader reading from r.
+func NewMessageReader(r io.Reader) *MessageReader {
+  return &MessageReader{r: r, buf: make([]byte, HEADER_LENGTH, 256)}
+}
+
+// Next reads the next message, and returns its type and payload. The payload is only valid until
+// the next call.
+func (mr *MessageReader) Next() (MessageType, []byte, error) {
+  header := mr.buf[:HEADER_LENGTH]
+  if _, err := io.ReadFull(mr.r, header); err != nil {
+    return 0, nil, err
+  }
+  h, err := DecodeHeader(header)
+  if err != nil {
+    return 0, nil, err
+  }
+  if size := HEADER_LENGTH + h.Length; cap(mr.buf) < size {
+    mr.buf = append(make([]byte, 0, size), header...)
+  }
+  message := mr.buf[:HEADER_LENGTH + h.Length]
+  if _, err := io.ReadFull(mr.r, message[HEADER_LENGTH:]); err != nil {
+    return 0, nil, err
+  }
+  return DecodeMessage(message)
+}
+
+// EncodeMessage encodes r as a version 2 Reading message.
+func (r *Reading) EncodeMessage() []byte {
+  return AppendMessage(nil, MessageReading, r.Encode())
+}
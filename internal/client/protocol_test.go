@@ -0,0 +1,98 @@
+package client
+
+import (
+  "bytes"
+  "math/rand"
+  "net"
+  "testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+  payload := testReadingBytes()
+  message := AppendMessage([]byte("prefix"), MessageReading, payload)[len("prefix"):]
+  if len(message) != HEADER_LENGTH + READING_LENGTH {
+    t.Fatalf("Unexpected message length %d", len(message))
+  }
+  typ, got, err := DecodeMessage(message)
+  if err != nil || typ != MessageReading || !bytes.Equal(got, payload) {
+    t.Fatalf("DecodeMessage = %v, %x, %v", typ, got, err)
+  }
+  if allocs := testing.AllocsPerRun(100, func() { DecodeMessage(message) }); allocs != 0 {
+    t.Errorf("DecodeMessage allocates %v times", allocs)
+  }
+
+  // every single bit flipped must be caught
+  for i := range message {
+    corrupt := append([]byte(nil), message...)
+    corrupt[i] ^= 0x10
+    if _, _, err := DecodeMessage(corrupt); err == nil {
+      t.Errorf("Corruption of byte %d not detected", i)
+    }
+  }
+  if _, _, err := DecodeMessage(message[:len(message) - 1]); err != ErrMessageLength {
+    t.Errorf("Truncated message: unexpected error %v", err)
+  }
+  if _, err := DecodeHeader([]byte{1, 0xff, 0xff, 0, 0, 0, 0}); err != ErrMessageLength {
+    t.Errorf("Oversized payload: unexpected error %v", err)
+  }
+}
+
+// No valid version 1 Reading may be taken for a hello.
+func TestHelloIsNoReading(t *testing.T) {
+  var reading Reading
+  for i := 0; i < 1000; i++ {
+    if IsHello(reading.GenerateRandomReading()) {
+      t.Fatal("Reading taken for a hello")
+    }
+  }
+  for _, temperature := range []float64{-300, -0.0, 0, 300} {
+    reading := Reading{Temperature: temperature}
+    if IsHello(reading.Encode()) {
+      t.Errorf("Reading with temperature %v taken for a hello", temperature)
+    }
+  }
+
+  if version, err := ParseHello(AppendHello(nil, PROTOCOL_V2)); err != nil || version != 2 {
+    t.Errorf("ParseHello = %v, %v", version, err)
+  }
+  if _, err := ParseHello([]byte{0xff, 'T', 'M', 0}); err != ErrBadHello {
+    t.Errorf("Hello for version 0: unexpected error %v", err)
+  }
+}
+
+// Negotiate must settle on the version the server answers with, but never on a later one than
+// asked for.
+func TestNegotiate(t *testing.T) {
+  for _, c := range []struct {
+    answer int
+    agreed int
+    err    error
+  }{
+    {PROTOCOL_V2, PROTOCOL_V2, nil},
+    {PROTOCOL_V1, PROTOCOL_V1, nil},
+    {3, 0, ErrBadHello},
+  } {
+    device, server := net.Pipe()
+    go func() {
+      hello := make([]byte, HELLO_LENGTH)
+      server.Read(hello)
+      server.Write(AppendHello(nil, c.answer))
+    }()
+    agreed, err := Negotiate(device, PROTOCOL_V2)
+    if agreed != c.agreed || err != c.err {
+      t.Errorf("Server answering v%d: Negotiate = %v, %v", c.answer, agreed, err)
+    }
+    device.Close()
+    server.Close()
+  }
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+  b.ReportAllocs()
+  payload := make([]byte, READING_LENGTH)
+  rand.Read(payload)
+  message := AppendMessage(nil, MessageReading, payload)
+  for i := 0; i < b.N; i++ {
+    DecodeMessage(message)
+  }
+}
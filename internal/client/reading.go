@@ -4,7 +4,6 @@ import (
   "bytes"
   "encoding/binary"
   "errors"
-  "fmt"
   "github.com/MarcKriguer/thermomatic/internal/common"
   "math"
   "math/rand"
@@ -19,33 +18,55 @@ const READING_LENGTH = 40
 // Reading is the set of device readings.
 type Reading struct {
 	// Temperature denotes the temperature reading of the message.  Valid range [-300, 300].
-	Temperature float64
+	Temperature float64 `json:"temperature"`
 
 	// Altitude denotes the altitude reading of the message.  Valid range [-20000, 20000].
-	Altitude float64
+	Altitude float64 `json:"altitude"`
 
 	// Latitude denotes the latitude reading of the message.  Valid range [-90, 90].
-	Latitude float64
+	Latitude float64 `json:"latitude"`
 
 	// Longitude denotes the longitude reading of the message.  Valid range [-180, 180].
-	Longitude float64
+	Longitude float64 `json:"longitude"`
 
 	// BatteryLevel denotes the battery level reading of the message.  Valid range (0, 100].
-	BatteryLevel float64
+	BatteryLevel float64 `json:"battery_level"`
 }
 
 // Decode the reading message payload in the given byte array into a Reading.
 //
-// Returns true if all fields are within min/max ranges, false if any are outside their range.
+// Returns nil if all fields are within the ranges of DefaultProfile, or the *RangeError describing
+// the first field that isn't (see Validate). The fields are decoded either way.
 //
-// Decode does NOT allocate under any condition.
-// Additionally, it panics if b isn't at least 40 bytes long.
-func (r *Reading) Decode(b []byte) (ok bool) {
+// Decode does NOT allocate, unless a field is out of range.
+// Additionally, it panics if b isn't at least 40 bytes long: use TryDecode on untrusted input.
+func (r *Reading) Decode(b []byte) error {
+  return r.DecodeWith(b, &DefaultProfile)
+}
+
+// DecodeWith is like Decode, but validates the Reading against profile p.
+func (r *Reading) DecodeWith(b []byte, p *Profile) error {
   // panic if byte array is too small
   if len(b) < READING_LENGTH {
     common.LogError(ErrReadingLength)
     panic(ErrReadingLength)
   }
+  return r.TryDecodeWith(b, p)
+}
+
+// TryDecode is like Decode, but safe on untrusted input of any length: if b is less than 40 bytes
+// long, it returns ErrReadingLength (leaving r untouched) instead of panicking. It does not log.
+//
+// TryDecode does NOT allocate, unless a field is out of range.
+func (r *Reading) TryDecode(b []byte) error {
+  return r.TryDecodeWith(b, &DefaultProfile)
+}
+
+// TryDecodeWith is like TryDecode, but validates the Reading against profile p.
+func (r *Reading) TryDecodeWith(b []byte, p *Profile) error {
+  if len(b) < READING_LENGTH {
+    return ErrReadingLength
+  }
 
   // extract each field
   r.Temperature  = math.Float64frombits(binary.BigEndian.Uint64(b[0:8]))
@@ -54,29 +75,44 @@ func (r *Reading) Decode(b []byte) (ok bool) {
   r.Longitude    = math.Float64frombits(binary.BigEndian.Uint64(b[24:32]))
   r.BatteryLevel = math.Float64frombits(binary.BigEndian.Uint64(b[32:40]))
 
-  // validate each field, returning false if any of them are outside their range
-  if r.Temperature > 300 || r.Temperature < -300 {
-    common.LogOutput("Temperature out of range: " + fmt.Sprintf("%f", r.Temperature))
-    return false
-  }
-  if r.Altitude > 20000 || r.Altitude < -20000 {
-    common.LogOutput("Altitude out of range: " + fmt.Sprintf("%f", r.Altitude))
-    return false
-  }
-  if r.Latitude > 90 || r.Latitude < -90 {
-    common.LogOutput("Latitude out of range: " + fmt.Sprintf("%f", r.Latitude))
-    return false
-  }
-  if r.Longitude > 180 || r.Longitude < -180 {
-    common.LogOutput("Longitude out of range: " + fmt.Sprintf("%f", r.Longitude))
-    return false
-  }
-  if r.BatteryLevel > 100 || r.BatteryLevel <= 0 {
-    common.LogOutput("BatteryLevel out of range: " + fmt.Sprintf("%f", r.BatteryLevel))
-    return false
+  return r.ValidateWith(p)
+}
+
+// Validate checks that every field of r is within its valid range, as per DefaultProfile. NaN and
+// infinite values are never valid.
+//
+// Returns nil if r is valid, or a *RangeError describing the first invalid field. Validate never
+// logs, and does NOT allocate unless a field is out of range.
+func (r *Reading) Validate() error {
+  return r.ValidateWith(&DefaultProfile)
+}
+
+// ValidateWith is like Validate, but checks the fields against the ranges of profile p.
+func (r *Reading) ValidateWith(p *Profile) error {
+  for field := Field(0); field < NumFields; field++ {
+    value := r.Field(field)
+    if !p.Ranges[field].Contains(value) {
+      return &RangeError{Field: field, Value: value, Range: p.Ranges[field], Profile: p.Name}
+    }
   }
+  return nil
+}
 
-  return true
+// Field returns the value of the given field of r.
+func (r *Reading) Field(field Field) float64 {
+  switch field {
+  case FieldTemperature:
+    return r.Temperature
+  case FieldAltitude:
+    return r.Altitude
+  case FieldLatitude:
+    return r.Latitude
+  case FieldLongitude:
+    return r.Longitude
+  case FieldBatteryLevel:
+    return r.BatteryLevel
+  }
+  return math.NaN()
 }
 
 // Encode encodes the reading message payload in the given r into a byte array.
@@ -18,9 +18,9 @@ func TestReadingDecodeExact40(t *testing.T) {
     0x3f, 0xd0, 0x6d, 0x1e, 0x10, 0x8c, 0x3f, 0x3e, // battery level
   }
 
-  result := reading.Decode(byteArray)
-  if !result {
-    t.Errorf("Failed to decode byte array")
+  err := reading.Decode(byteArray)
+  if err != nil {
+    t.Errorf("Failed to decode byte array: %v", err)
   }
 
   if reading.Temperature != 67.77 {
@@ -43,9 +43,9 @@ func TestReadingDecodeExact40(t *testing.T) {
 // Test the Decode function, for a randomly-generated Reading.
 func TestReadingDecodeRandom(t *testing.T) {
   var reading Reading
-  result := reading.Decode(reading.GenerateRandomReading())
-  if !result {
-    t.Errorf("Failed to decode random byte array")
+  err := reading.Decode(reading.GenerateRandomReading())
+  if err != nil {
+    t.Errorf("Failed to decode random byte array: %v", err)
   }
 }
 
@@ -63,9 +63,9 @@ func TestReadingDecodeOver40(t *testing.T) {
     0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ignored
   }
 
-  result := reading.Decode(byteArray)
-  if !result {
-    t.Errorf("Failed to decode larger byte array")
+  err := reading.Decode(byteArray)
+  if err != nil {
+    t.Errorf("Failed to decode larger byte array: %v", err)
   }
 
   if reading.Temperature != 67.77 {
@@ -104,13 +104,50 @@ func TestReadingDecodeUnder40(t *testing.T) {
     }
   }()
 
-  result := reading.Decode(byteArray)
-  if !result {
+  err := reading.Decode(byteArray)
+  if err != nil {
     t.Errorf("Error (but not expected panic) when calling Reading.Decode with too few bytes.")
   }
 }
 
-// Test that the Decode function returns false (but doesn't panic) when a field is out of range
+// Test that TryDecode returns ErrReadingLength, without panicking nor allocating, whatever the
+// length of a too short byte array.
+func TestReadingTryDecodeShort(t *testing.T) {
+  var reading Reading
+  encoded := testReadingBytes()
+  for n := 0; n < READING_LENGTH; n++ {
+    if err := reading.TryDecode(encoded[:n]); err != ErrReadingLength {
+      t.Errorf("TryDecode of %d bytes returned %v", n, err)
+    }
+  }
+  if reading != (Reading{}) {
+    t.Errorf("TryDecode modified the Reading: %+v", reading)
+  }
+  if err := reading.TryDecode(encoded); err != nil || reading.Temperature != 67.77 {
+    t.Errorf("Failed to decode byte array: %v, %+v", err, reading)
+  }
+
+  allocs := testing.AllocsPerRun(100, func() {
+    reading.TryDecode(encoded[:10])
+    reading.TryDecode(encoded)
+  })
+  if allocs != 0 {
+    t.Errorf("TryDecode allocated %v times", allocs)
+  }
+}
+
+// testReadingBytes returns the encoding of the README's example Reading.
+func testReadingBytes() []byte {
+  return []uint8{
+    0x40, 0x50, 0xf1, 0x47, 0xae, 0x14, 0x7a, 0xe1, // temperature
+    0x40, 0x05, 0x15, 0x9b, 0x3d, 0x07, 0xc8, 0x4b, // altitude
+    0x40, 0x40, 0xb4, 0x7a, 0xe1, 0x47, 0xae, 0x14, // latitude
+    0x40, 0x46, 0x33, 0x33, 0x33, 0x33, 0x33, 0x33, // longitude
+    0x3f, 0xd0, 0x6d, 0x1e, 0x10, 0x8c, 0x3f, 0x3e, // battery level
+  }
+}
+
+// Test that the Decode function returns a RangeError (but doesn't panic) when a field is out of range
 func TestReadingDecodeWithInvalidBatteryLevel(t *testing.T) {
   var reading Reading
 
@@ -125,13 +162,21 @@ func TestReadingDecodeWithInvalidBatteryLevel(t *testing.T) {
 
   defer func() {
    if r := recover(); r != nil {
-      t.Errorf("Reading.Decode panicked when it just should have returned false")
+      t.Errorf("Reading.Decode panicked when it just should have returned an error")
     }
   }()
 
-  result := reading.Decode(byteArray)
-  if result {
-    t.Errorf("Did not get a false (error) result when calling Reading.Decode with invalid data.")
+  err := reading.Decode(byteArray)
+  rangeErr, ok := err.(*RangeError)
+  if !ok {
+    t.Fatalf("Did not get a RangeError when calling Reading.Decode with invalid data (got %v).", err)
+  }
+  if rangeErr.Field != FieldBatteryLevel || rangeErr.Value != -5 ||
+      rangeErr.Range != (Range{Min: 0, Max: 100, MinExclusive: true}) {
+    t.Errorf("Unexpected RangeError %+v", rangeErr)
+  }
+  if rangeErr.Error() != "client: BatteryLevel out of range: -5 not in (0, 100]" {
+    t.Errorf("Unexpected error message %q", rangeErr.Error())
   }
 }
 
@@ -187,8 +232,8 @@ func BenchmarkReadingDecode(b *testing.B) {
   }
 
   for i := 0; i < b.N; i++ {
-    result := reading.Decode(byteArray)
-    if !result {
+    err := reading.Decode(byteArray)
+    if err != nil {
       b.Errorf("Failed to decode byte array in Benchmark.")
     }
   
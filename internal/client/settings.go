@@ -0,0 +1,276 @@
+package client
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "math"
+  "strconv"
+)
+
+var (
+  ErrBadSettings = errors.New("client: invalid settings")
+)
+
+// More version 2 message types, to configure devices.
+const (
+  // MessageConfig pushes a change of Settings to the device (server to device). Its payload is
+  // the change's ID followed by the settings changed (see AppendConfig).
+  MessageConfig MessageType = 4
+
+  // MessageConfigAck confirms the device received a MessageConfig (device to server). Its payload
+  // is the change's ID followed by a ConfigStatus.
+  MessageConfigAck MessageType = 5
+)
+
+// Size of the payload of a MessageConfigAck.
+const CONFIG_ACK_LENGTH = 5
+
+// MIN_REPORTING_INTERVAL is the shortest reporting interval a device may be set to, in
+// milliseconds: a shorter one would drain its battery, and flood the server.
+const MIN_REPORTING_INTERVAL = 1000
+
+// Tags of the settings in a MessageConfig.
+const (
+  settingInterval   = 1 // milliseconds (uint32)
+  settingSensor     = 2 // field (uint8), enabled (uint8)
+  settingRange      = 3 // field (uint8), exclusive bounds (uint8: 1 min, 2 max), min, max (float64)
+  settingExtraRange = 4 // extra sensor (uint8), then as settingRange
+)
+
+// ConfigStatus is the outcome of a configuration change, as confirmed by the device.
+type ConfigStatus uint8
+
+const (
+  // ConfigApplied reports a change the device applied.
+  ConfigApplied ConfigStatus = iota
+
+  // ConfigRejected reports a change the device could not apply (it keeps its previous settings).
+  ConfigRejected
+)
+
+// String returns the name of the status.
+func (st ConfigStatus) String() string {
+  switch st {
+  case ConfigApplied:
+    return "applied"
+  case ConfigRejected:
+    return "rejected"
+  }
+  return "status " + strconv.Itoa(int(st))
+}
+
+// Settings is a change to the settings of a device. The settings left unset (nil) are left as
+// they are.
+type Settings struct {
+  // ReportingInterval is the time between Readings, in milliseconds (at least
+  // MIN_REPORTING_INTERVAL).
+  ReportingInterval *uint32 `json:"reporting_interval_ms,omitempty"`
+
+  // Sensors enables (true) or disables (false) the sensors behind the given fields.
+  Sensors map[Field]bool `json:"sensors,omitempty"`
+
+  // Ranges replaces the valid ranges the device checks the given fields against.
+  Ranges map[Field]Range `json:"ranges,omitempty"`
+
+  // SensorRanges replaces the valid ranges the device checks the given extra sensors against.
+  SensorRanges map[SensorID]Range `json:"sensor_ranges,omitempty"`
+}
+
+// Validate returns ErrBadSettings (with details) if s changes nothing, or holds a setting out of
+// bounds.
+func (s *Settings) Validate() error {
+  if s.ReportingInterval == nil && len(s.Sensors) == 0 && len(s.Ranges) == 0 &&
+      len(s.SensorRanges) == 0 {
+    return fmt.Errorf("%v: no setting to change", ErrBadSettings)
+  }
+  if s.ReportingInterval != nil && *s.ReportingInterval < MIN_REPORTING_INTERVAL {
+    return fmt.Errorf("%v: reporting interval under %d ms", ErrBadSettings, MIN_REPORTING_INTERVAL)
+  }
+  for field := range s.Sensors {
+    if field < 0 || field >= NumFields {
+      return fmt.Errorf("%v: unknown field %v", ErrBadSettings, field)
+    }
+  }
+  for field, rg := range s.Ranges {
+    if field < 0 || field >= NumFields {
+      return fmt.Errorf("%v: unknown field %v", ErrBadSettings, field)
+    }
+    if !(rg.Min <= rg.Max) {
+      return fmt.Errorf("%v: empty range %v for %v", ErrBadSettings, rg, field)
+    }
+  }
+  for id, rg := range s.SensorRanges {
+    if LookupSensor(id) == nil {
+      return fmt.Errorf("%v: unknown %v", ErrBadSettings, id)
+    }
+    if !(rg.Min <= rg.Max) {
+      return fmt.Errorf("%v: empty range %v for %v", ErrBadSettings, rg, id)
+    }
+  }
+  return nil
+}
+
+// Apply applies the change s to the device settings current, and returns the result.
+func (s *Settings) Apply(current DeviceSettings) DeviceSettings {
+  if s.ReportingInterval != nil {
+    current.ReportingInterval = *s.ReportingInterval
+  }
+  for field, enabled := range s.Sensors {
+    current.Disabled[field] = !enabled
+  }
+  for field, rg := range s.Ranges {
+    current.Profile.Ranges[field] = rg
+  }
+  if len(s.SensorRanges) > 0 {
+    // the map is shared with the copies of the profile
+    sensors := make(map[SensorID]Range, len(current.Profile.Sensors) + len(s.SensorRanges))
+    for id, rg := range current.Profile.Sensors {
+      sensors[id] = rg
+    }
+    for id, rg := range s.SensorRanges {
+      sensors[id] = rg
+    }
+    current.Profile.Sensors = sensors
+  }
+  return current
+}
+
+// DeviceSettings are the settings a device runs with.
+type DeviceSettings struct {
+  // ReportingInterval is the time between Readings, in milliseconds.
+  ReportingInterval uint32
+
+  // Disabled reports the fields whose sensor is disabled, indexed by Field.
+  Disabled [NumFields]bool
+
+  // Profile holds the ranges the device checks its Readings against.
+  Profile Profile
+}
+
+// AppendConfig appends the payload of the MessageConfig pushing change id, of settings s, to b. The
+// settings must be valid (see Validate).
+func AppendConfig(b []byte, id uint32, s *Settings) []byte {
+  b = appendUint32(b, id)
+  if s.ReportingInterval != nil {
+    b = append(b, settingInterval)
+    b = appendUint32(b, *s.ReportingInterval)
+  }
+  for field := Field(0); field < NumFields; field++ {
+    if enabled, ok := s.Sensors[field]; ok {
+      flag := byte(0)
+      if enabled {
+        flag = 1
+      }
+      b = append(b, settingSensor, byte(field), flag)
+    }
+  }
+  for field := Field(0); field < NumFields; field++ {
+    if rg, ok := s.Ranges[field]; ok {
+      b = appendRange(append(b, settingRange, byte(field)), rg)
+    }
+  }
+  for _, sensor := range Sensors {
+    if rg, ok := s.SensorRanges[sensor.ID]; ok {
+      b = appendRange(append(b, settingExtraRange, byte(sensor.ID)), rg)
+    }
+  }
+  return b
+}
+
+// appendRange appends the exclusive bounds, min and max of rg, as in a MessageConfig, to b.
+func appendRange(b []byte, rg Range) []byte {
+  exclusive := byte(0)
+  if rg.MinExclusive {
+    exclusive |= 1
+  }
+  if rg.MaxExclusive {
+    exclusive |= 2
+  }
+  b = append(b, exclusive)
+  b = appendUint64(b, math.Float64bits(rg.Min))
+  return appendUint64(b, math.Float64bits(rg.Max))
+}
+
+// decodeRange decodes the range appended by appendRange at the start of b (17 bytes).
+func decodeRange(b []byte) Range {
+  return Range{
+    Min:          math.Float64frombits(binary.BigEndian.Uint64(b[1:9])),
+    Max:          math.Float64frombits(binary.BigEndian.Uint64(b[9:17])),
+    MinExclusive: b[0] & 1 != 0,
+    MaxExclusive: b[0] & 2 != 0,
+  }
+}
+
+// DecodeConfig decodes the payload of a MessageConfig into the ID and settings of the change.
+func DecodeConfig(payload []byte) (uint32, Settings, error) {
+  var s Settings
+  if len(payload) < 4 {
+    return 0, s, ErrBadSettings
+  }
+  id := binary.BigEndian.Uint32(payload)
+  for b := payload[4:]; len(b) > 0; {
+    switch b[0] {
+    case settingInterval:
+      if len(b) < 5 {
+        return id, s, ErrBadSettings
+      }
+      interval := binary.BigEndian.Uint32(b[1:5])
+      s.ReportingInterval = &interval
+      b = b[5:]
+    case settingSensor:
+      if len(b) < 3 {
+        return id, s, ErrBadSettings
+      }
+      if s.Sensors == nil {
+        s.Sensors = make(map[Field]bool)
+      }
+      s.Sensors[Field(b[1])] = b[2] != 0
+      b = b[3:]
+    case settingRange:
+      if len(b) < 19 {
+        return id, s, ErrBadSettings
+      }
+      if s.Ranges == nil {
+        s.Ranges = make(map[Field]Range)
+      }
+      s.Ranges[Field(b[1])] = decodeRange(b[2:])
+      b = b[19:]
+    case settingExtraRange:
+      if len(b) < 19 {
+        return id, s, ErrBadSettings
+      }
+      if s.SensorRanges == nil {
+        s.SensorRanges = make(map[SensorID]Range)
+      }
+      s.SensorRanges[SensorID(b[1])] = decodeRange(b[2:])
+      b = b[19:]
+    default:
+      return id, s, ErrBadSettings
+    }
+  }
+  return id, s, s.Validate()
+}
+
+// AppendConfigAck appends the payload of the MessageConfigAck confirming change id to b.
+func AppendConfigAck(b []byte, id uint32, status ConfigStatus) []byte {
+  return append(appendUint32(b, id), byte(status))
+}
+
+// DecodeConfigAck decodes the payload of a MessageConfigAck.
+func DecodeConfigAck(payload []byte) (uint32, ConfigStatus, error) {
+  if len(payload) < CONFIG_ACK_LENGTH {
+    return 0, 0, ErrBadSettings
+  }
+  return binary.BigEndian.Uint32(payload), ConfigStatus(payload[4]), nil
+}
+
+// appendUint32 appends v to b, big-endian.
+func appendUint32(b []byte, v uint32) []byte {
+  return append(b, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v))
+}
+
+// appendUint64 appends v to b, big-endian.
+func appendUint64(b []byte, v uint64) []byte {
+  return appendUint32(appendUint32(b, uint32(v >> 32)), uint32(v))
+}
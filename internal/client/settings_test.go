@@ -0,0 +1,81 @@
+package client
+
+import (
+  "encoding/json"
+  "reflect"
+  "testing"
+)
+
+func TestConfigRoundTrip(t *testing.T) {
+  interval := uint32(90000)
+  settings := Settings{
+    ReportingInterval: &interval,
+    Sensors:           map[Field]bool{FieldAltitude: false, FieldLatitude: true},
+    Ranges:            map[Field]Range{FieldTemperature: {Min: -40, Max: 85, MaxExclusive: true}},
+    SensorRanges:      map[SensorID]Range{SensorHumidity: {Min: 20, Max: 95, MinExclusive: true}},
+  }
+  id, got, err := DecodeConfig(AppendConfig(nil, 7, &settings))
+  if err != nil || id != 7 || !reflect.DeepEqual(got, settings) {
+    t.Errorf("DecodeConfig = %d, %+v, %v", id, got, err)
+  }
+
+  for _, payload := range [][]byte{
+    {0, 0, 1},
+    {0, 0, 0, 1},                      // no setting
+    {0, 0, 0, 1, settingInterval, 0},  // truncated
+    {0, 0, 0, 1, 99, 1, 2, 3},         // unknown setting
+    {0, 0, 0, 1, settingSensor, 9, 1}, // unknown field
+    append([]byte{0, 0, 0, 1, settingExtraRange, 200}, make([]byte, 17)...), // unknown sensor
+  } {
+    if _, _, err := DecodeConfig(payload); err == nil {
+      t.Errorf("DecodeConfig(%x) did not fail", payload)
+    }
+  }
+
+  id, status, err := DecodeConfigAck(AppendConfigAck(nil, 7, ConfigRejected))
+  if err != nil || id != 7 || status != ConfigRejected {
+    t.Errorf("DecodeConfigAck = %d, %v, %v", id, status, err)
+  }
+}
+
+func TestSettingsJSON(t *testing.T) {
+  var settings Settings
+  err := json.Unmarshal([]byte(`{"reporting_interval_ms": 5000, "sensors": {"Altitude": false},
+      "ranges": {"BatteryLevel": {"min": 5, "max": 100}},
+      "sensor_ranges": {"humidity": {"min": 20, "max": 95}}}`), &settings)
+  if err != nil || settings.Validate() != nil || *settings.ReportingInterval != 5000 ||
+      settings.Sensors[FieldAltitude] || settings.Ranges[FieldBatteryLevel].Min != 5 ||
+      settings.SensorRanges[SensorHumidity].Max != 95 {
+    t.Errorf("Unexpected settings %+v (%v)", settings, err)
+  }
+  if err := json.Unmarshal([]byte(`{"sensors": {"Pressure": true}}`), &settings); err == nil {
+    t.Errorf("Unknown field accepted")
+  }
+  if err := json.Unmarshal([]byte(`{"sensor_ranges": {"pressure": {}}}`), &settings); err == nil {
+    t.Errorf("Unknown sensor accepted")
+  }
+}
+
+func TestSettingsApply(t *testing.T) {
+  interval := uint32(10000)
+  settings := Settings{
+    ReportingInterval: &interval,
+    Sensors:           map[Field]bool{FieldAltitude: false},
+    Ranges:            map[Field]Range{FieldBatteryLevel: {Min: 5, Max: 100}},
+    SensorRanges:      map[SensorID]Range{SensorHumidity: {Min: 20, Max: 95}},
+  }
+  current := DeviceSettings{ReportingInterval: 1000, Profile: DefaultProfile}
+  current.Profile.Sensors = map[SensorID]Range{SensorLight: {Min: 0, Max: 1000}}
+  got := settings.Apply(current)
+  if got.ReportingInterval != 10000 || !got.Disabled[FieldAltitude] ||
+      got.Disabled[FieldLatitude] || got.Profile.Ranges[FieldBatteryLevel].Min != 5 ||
+      got.Profile.Ranges[FieldTemperature] != DefaultProfile.Ranges[FieldTemperature] ||
+      got.Profile.Sensors[SensorHumidity].Max != 95 ||
+      got.Profile.Sensors[SensorLight].Max != 1000 {
+    t.Errorf("Unexpected settings %+v", got)
+  }
+  if current.ReportingInterval != 1000 || current.Disabled[FieldAltitude] ||
+      len(current.Profile.Sensors) != 1 {
+    t.Errorf("Current settings changed: %+v", current)
+  }
+}
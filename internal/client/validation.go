@@ -0,0 +1,167 @@
+package client
+
+import (
+  "errors"
+  "math"
+  "strconv"
+)
+
+var (
+  ErrUnknownField = errors.New("client: unknown Reading field")
+)
+
+// Field identifies one of the fields of a Reading.
+type Field int
+
+const (
+  FieldTemperature Field = iota
+  FieldAltitude
+  FieldLatitude
+  FieldLongitude
+  FieldBatteryLevel
+
+  // NumFields is the number of fields in a Reading.
+  NumFields
+)
+
+// names of the fields, indexed by Field
+var fieldNames = [NumFields]string{"Temperature", "Altitude", "Latitude", "Longitude",
+    "BatteryLevel"}
+
+// String returns the name of the field, as in the Reading struct.
+func (f Field) String() string {
+  if f < 0 || f >= NumFields {
+    return "Field(" + strconv.Itoa(int(f)) + ")"
+  }
+  return fieldNames[f]
+}
+
+// ParseField returns the field with the given name (as returned by Field.String).
+func ParseField(name string) (Field, error) {
+  for field := Field(0); field < NumFields; field++ {
+    if fieldNames[field] == name {
+      return field, nil
+    }
+  }
+  return 0, ErrUnknownField
+}
+
+// MarshalText returns the name of the field.
+func (f Field) MarshalText() ([]byte, error) {
+  if f < 0 || f >= NumFields {
+    return nil, ErrUnknownField
+  }
+  return []byte(fieldNames[f]), nil
+}
+
+// UnmarshalText sets the field to the one named text.
+func (f *Field) UnmarshalText(text []byte) (err error) {
+  *f, err = ParseField(string(text))
+  return err
+}
+
+// Range is an interval of valid values for a field. Each bound is inclusive unless marked exclusive.
+type Range struct {
+  Min          float64 `json:"min"`
+  Max          float64 `json:"max"`
+  MinExclusive bool    `json:"min_exclusive,omitempty"`
+  MaxExclusive bool    `json:"max_exclusive,omitempty"`
+}
+
+// Contains reports whether v lies within the range. NaN is never within a range, and neither are
+// infinities.
+func (rg Range) Contains(v float64) bool {
+  if math.IsNaN(v) || math.IsInf(v, 0) {
+    return false
+  }
+  if v < rg.Min || (rg.MinExclusive && v == rg.Min) {
+    return false
+  }
+  if v > rg.Max || (rg.MaxExclusive && v == rg.Max) {
+    return false
+  }
+  return true
+}
+
+// String returns the range in interval notation, e.g. "(0, 100]".
+func (rg Range) String() string {
+  buf := make([]byte, 0, 32)
+  if rg.MinExclusive {
+    buf = append(buf, '(')
+  } else {
+    buf = append(buf, '[')
+  }
+  buf = strconv.AppendFloat(buf, rg.Min, 'g', -1, 64)
+  buf = append(buf, ", "...)
+  buf = strconv.AppendFloat(buf, rg.Max, 'g', -1, 64)
+  if rg.MaxExclusive {
+    buf = append(buf, ')')
+  } else {
+    buf = append(buf, ']')
+  }
+  return string(buf)
+}
+
+// Profile is a set of valid ranges, one per field and extra sensor, that Readings are validated
+// against.
+type Profile struct {
+  // Name identifies the profile in logs and configuration.
+  Name string
+
+  // Ranges holds the valid range of each field, indexed by Field.
+  Ranges [NumFields]Range
+
+  // Sensors holds the valid range of the extra sensors the profile restricts; the others keep the
+  // range they are registered with (see Sensors). Copies of the profile share it: replace it
+  // rather than change it.
+  Sensors map[SensorID]Range
+}
+
+// SensorRange returns the valid range of sensor id, and false if the sensor is not registered.
+func (p *Profile) SensorRange(id SensorID) (Range, bool) {
+  sensor := LookupSensor(id)
+  if sensor == nil {
+    return Range{}, false
+  }
+  if rg, ok := p.Sensors[id]; ok {
+    return rg, true
+  }
+  return sensor.Range, true
+}
+
+// DefaultProfile holds the valid ranges documented in the README. Decode and Validate use it.
+var DefaultProfile = Profile{
+  Name: "default",
+  Ranges: [NumFields]Range{
+    FieldTemperature:  {Min: -300, Max: 300},
+    FieldAltitude:     {Min: -20000, Max: 20000},
+    FieldLatitude:     {Min: -90, Max: 90},
+    FieldLongitude:    {Min: -180, Max: 180},
+    FieldBatteryLevel: {Min: 0, Max: 100, MinExclusive: true},
+  },
+}
+
+// RangeError reports a field of a Reading whose value is outside its valid range (or isn't a
+// number at all).
+type RangeError struct {
+  // Field is the invalid field.
+  Field Field
+
+  // Value is the field's offending value.
+  Value float64
+
+  // Range is the field's valid range.
+  Range Range
+
+  // Profile is the name of the profile the Reading was validated against.
+  Profile string
+}
+
+func (e *RangeError) Error() string {
+  message := "client: " + e.Field.String() + " out of range: " +
+      strconv.FormatFloat(e.Value, 'g', -1, 64) + " not in " + e.Range.String()
+  if e.Profile != "" && e.Profile != DefaultProfile.Name {
+    message += " (profile " + e.Profile + ")"
+  }
+  return message
+}
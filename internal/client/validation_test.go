@@ -0,0 +1,131 @@
+package client
+
+import (
+  "math"
+  "testing"
+)
+
+// validReading is the Reading from the README's output format example.
+var validReading = Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4,
+    BatteryLevel: 0.25666}
+
+// Test that Validate accepts the bounds of each range (except the exclusive ones) and rejects
+// values beyond them, naming the field.
+func TestReadingValidateBounds(t *testing.T) {
+  cases := []struct {
+    field Field
+    value float64
+    valid bool
+  }{
+    {FieldTemperature, -300, true},
+    {FieldTemperature, 300, true},
+    {FieldTemperature, 300.0001, false},
+    {FieldAltitude, -20000, true},
+    {FieldAltitude, -20000.5, false},
+    {FieldLatitude, 90, true},
+    {FieldLatitude, -91, false},
+    {FieldLongitude, -180, true},
+    {FieldLongitude, 181, false},
+    {FieldBatteryLevel, 100, true},
+    {FieldBatteryLevel, 0, false},
+    {FieldBatteryLevel, 100.1, false},
+  }
+
+  for _, c := range cases {
+    reading := validReading
+    reading.set(c.field, c.value)
+    err := reading.Validate()
+    if c.valid {
+      if err != nil {
+        t.Errorf("%v = %v unexpectedly rejected: %v", c.field, c.value, err)
+      }
+      continue
+    }
+    rangeErr, ok := err.(*RangeError)
+    if !ok || rangeErr.Field != c.field || rangeErr.Value != c.value {
+      t.Errorf("%v = %v: unexpected error %v", c.field, c.value, err)
+    }
+  }
+}
+
+// Test that NaN and infinities are rejected in every field.
+func TestReadingValidateNotANumber(t *testing.T) {
+  for field := Field(0); field < NumFields; field++ {
+    for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+      reading := validReading
+      reading.set(field, value)
+      rangeErr, ok := reading.Validate().(*RangeError)
+      if !ok || rangeErr.Field != field {
+        t.Errorf("%v = %v not rejected", field, value)
+      }
+    }
+  }
+}
+
+// Test that Validate doesn't allocate for a valid Reading.
+func TestReadingValidateAllocs(t *testing.T) {
+  reading := validReading
+  allocs := testing.AllocsPerRun(100, func() {
+    if reading.Validate() != nil {
+      t.Errorf("Valid Reading rejected")
+    }
+  })
+  if allocs != 0 {
+    t.Errorf("Validate allocated %v times", allocs)
+  }
+}
+
+func TestFieldString(t *testing.T) {
+  if FieldBatteryLevel.String() != "BatteryLevel" || Field(42).String() != "Field(42)" {
+    t.Errorf("Unexpected field names %q, %q", FieldBatteryLevel.String(), Field(42).String())
+  }
+  if field, err := ParseField("Latitude"); field != FieldLatitude || err != nil {
+    t.Errorf("Unable to parse field name: %v, %v", field, err)
+  }
+  if _, err := ParseField("Humidity"); err != ErrUnknownField {
+    t.Errorf("Expected ErrUnknownField, got %v", err)
+  }
+}
+
+// Test that ValidateWith applies the given profile, and names it in the error.
+func TestReadingValidateWithProfile(t *testing.T) {
+  greenhouse := DefaultProfile
+  greenhouse.Name = "greenhouse"
+  greenhouse.Ranges[FieldTemperature] = Range{Min: -10, Max: 60}
+
+  reading := validReading
+  err := reading.ValidateWith(&greenhouse)
+  if err == nil || err.Error() !=
+      "client: Temperature out of range: 67.77 not in [-10, 60] (profile greenhouse)" {
+    t.Errorf("Unexpected error %v", err)
+  }
+  if reading.Validate() != nil {
+    t.Errorf("Reading rejected by the default profile")
+  }
+}
+
+// set sets the given field of r to value (test helper).
+func (r *Reading) set(field Field, value float64) {
+  switch field {
+  case FieldTemperature:
+    r.Temperature = value
+  case FieldAltitude:
+    r.Altitude = value
+  case FieldLatitude:
+    r.Latitude = value
+  case FieldLongitude:
+    r.Longitude = value
+  case FieldBatteryLevel:
+    r.BatteryLevel = value
+  }
+}
+
+func BenchmarkReadingValidate(b *testing.B) {
+  b.ReportAllocs()
+  reading := validReading
+  for i := 0; i < b.N; i++ {
+    if reading.Validate() != nil {
+      b.Errorf("Valid Reading rejected")
+    }
+  }
+}
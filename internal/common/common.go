@@ -14,7 +14,7 @@ func LogError(input error) {
   os.Stderr.WriteString("\n")
 }
 
-// Outputs a server message to StdOut
+// Outputs a server message to StdErr (StdOut is reserved for Reading records)
 func LogOutput(input string) {
-  os.Stdout.WriteString("Thermomatic: " + input + "\n")
+  os.Stderr.WriteString("Thermomatic: " + input + "\n")
 }
@@ -0,0 +1,197 @@
+package imei
+
+import (
+  "math/rand"
+)
+
+// Layout of an IMEI: an 8-digit Type Allocation Code, a 6-digit serial number, and a check digit.
+const (
+  TAC_LENGTH    = 8
+  SERIAL_LENGTH = 6
+  BODY_LENGTH   = TAC_LENGTH + SERIAL_LENGTH
+)
+
+const (
+  bodyLimit   = 100000000000000 // 10^14, the first number with more digits than an IMEI body
+  serialLimit = 1000000         // 10^6, the first number with more digits than a serial number
+)
+
+// TACLimit is 10^TAC_LENGTH, the first number with more digits than a TAC.
+var TACLimit = uint32(pow10(TAC_LENGTH))
+
+// pow10 returns 10^n.
+func pow10(n int) uint64 {
+  p := uint64(1)
+  for i := 0; i < n; i++ {
+    p *= 10
+  }
+  return p
+}
+
+// IMEI is an IMEI code, as returned by Decode. Its text forms are the 15 decimal digits of the
+// code, leading zeros included.
+type IMEI uint64
+
+// New returns the IMEI made of the 14-digit body (TAC and serial number) followed by its check
+// digit. Only the 14 low-order decimal digits of body are used.
+func New(body uint64) IMEI {
+  body %= bodyLimit
+  return IMEI(body * 10 + uint64(CheckDigit(body)))
+}
+
+// CheckDigit returns the Luhn check digit completing the 14-digit IMEI body. Only the 14 low-order
+// decimal digits of body are used.
+func CheckDigit(body uint64) uint8 {
+  // walk the digits from the rightmost, which is doubled as it is followed by the check digit
+  var sum uint8 = 0
+  for i := 0; i < BODY_LENGTH; i++ {
+    digit := uint8(body % 10)
+    body /= 10
+    if i % 2 == 0 {
+      digit *= 2
+      if digit > 9 {
+        digit -= 9
+      }
+    }
+    sum += digit
+  }
+  return (10 - sum % 10) % 10
+}
+
+// Random returns a random valid IMEI, drawn from rng (or from the default source of math/rand if
+// rng is nil).
+func Random(rng *rand.Rand) IMEI {
+  return New(randomUint64(rng, bodyLimit))
+}
+
+// RandomWithTAC returns a random valid IMEI with the given Type Allocation Code, drawn from rng
+// (or from the default source of math/rand if rng is nil).
+func RandomWithTAC(rng *rand.Rand, tac uint32) IMEI {
+  return New(uint64(tac) * serialLimit + randomUint64(rng, serialLimit))
+}
+
+// randomUint64 returns a random number in [0, n) from rng, or the default source if rng is nil.
+func randomUint64(rng *rand.Rand, n uint64) uint64 {
+  if rng == nil {
+    return uint64(rand.Int63n(int64(n)))
+  }
+  return uint64(rng.Int63n(int64(n)))
+}
+
+// TAC returns the Type Allocation Code of the IMEI, its first 8 digits, identifying the model of
+// the device.
+func (i IMEI) TAC() uint32 {
+  return uint32(uint64(i) / 10 / serialLimit % uint64(TACLimit))
+}
+
+// SerialNumber returns the serial number of the IMEI, the 6 digits following the TAC.
+func (i IMEI) SerialNumber() uint32 {
+  return uint32(uint64(i) / 10 % serialLimit)
+}
+
+// CheckDigit returns the check digit of the IMEI, its last digit.
+func (i IMEI) CheckDigit() uint8 {
+  return uint8(i % 10)
+}
+
+// Body returns the IMEI without its check digit: the TAC followed by the serial number.
+func (i IMEI) Body() uint64 {
+  return uint64(i) / 10 % bodyLimit
+}
+
+// Valid reports whether the IMEI fits in 15 digits and its check digit is right.
+func (i IMEI) Valid() bool {
+  return uint64(i) < bodyLimit * 10 && CheckDigit(i.Body()) == i.CheckDigit()
+}
+
+// String returns the IMEI as 15 decimal digits.
+func (i IMEI) String() string {
+  var buf [IMEI_LENGTH]byte
+  return string(i.appendDigits(buf[:0]))
+}
+
+// AppendText appends the IMEI, as 15 decimal digits, to b and returns the extended buffer. It never
+// fails, and does not allocate if b has room for the digits.
+func (i IMEI) AppendText(b []byte) ([]byte, error) {
+  return i.appendDigits(b), nil
+}
+
+// MarshalText returns the IMEI as 15 decimal digits.
+func (i IMEI) MarshalText() ([]byte, error) {
+  return i.appendDigits(make([]byte, 0, IMEI_LENGTH)), nil
+}
+
+// MarshalJSON returns the IMEI as a JSON string of 15 decimal digits. JSON numbers would lose the
+// leading zeros.
+func (i IMEI) MarshalJSON() ([]byte, error) {
+  b := make([]byte, 0, IMEI_LENGTH + 2)
+  b = append(b, '"')
+  b = i.appendDigits(b)
+  return append(b, '"'), nil
+}
+
+// UnmarshalText sets the IMEI to the one written in text, as accepted by Parse.
+func (i *IMEI) UnmarshalText(text []byte) error {
+  code, err := Parse(string(text))
+  if err != nil {
+    return err
+  }
+  *i = code
+  return nil
+}
+
+// appendDigits appends the 15 low-order decimal digits of the IMEI to b.
+func (i IMEI) appendDigits(b []byte) []byte {
+  var digits [IMEI_LENGTH]byte
+  code := uint64(i)
+  for j := IMEI_LENGTH - 1; j >= 0; j-- {
+    digits[j] = byte('0' + code % 10)
+    code /= 10
+  }
+  return append(b, digits[:]...)
+}
+
+// NoSoftwareVersion is the software version number DecodeLogin reports for a plain IMEI.
+const NoSoftwareVersion = -1
+
+// IMEISV is an IMEI software version code, as returned by DecodeSV: the 14-digit body of an IMEI
+// (TAC and serial number) followed by a 2-digit software version number instead of the check
+// digit. Its text form is the 16 decimal digits of the code, leading zeros included.
+type IMEISV uint64
+
+// NewSV returns the IMEISV made of the 14-digit body and the software version number svn. Only the
+// 14 low-order decimal digits of body and the 2 of svn are used.
+func NewSV(body uint64, svn uint8) IMEISV {
+  return IMEISV(body % bodyLimit * 100 + uint64(svn % 100))
+}
+
+// IMEI returns the IMEI of the device: the same body, completed by its check digit.
+func (sv IMEISV) IMEI() IMEI {
+  return New(sv.Body())
+}
+
+// Body returns the IMEISV without its software version number: the TAC followed by the serial
+// number.
+func (sv IMEISV) Body() uint64 {
+  return uint64(sv) / 100 % bodyLimit
+}
+
+// SoftwareVersion returns the software version number of the IMEISV, its last 2 digits.
+func (sv IMEISV) SoftwareVersion() uint8 {
+  return uint8(sv % 100)
+}
+
+// String returns the IMEISV as 16 decimal digits.
+func (sv IMEISV) String() string {
+  var buf [IMEISV_LENGTH]byte
+  b, _ := sv.AppendText(buf[:0])
+  return string(b)
+}
+
+// AppendText appends the IMEISV, as 16 decimal digits, to b and returns the extended buffer. It
+// never fails, and does not allocate if b has room for the digits.
+func (sv IMEISV) AppendText(b []byte) ([]byte, error) {
+  b, _ = sv.IMEI().AppendText(b)
+  b[len(b) - 1] = byte('0' + sv.SoftwareVersion() / 10)
+  return append(b, byte('0' + sv.SoftwareVersion() % 10)), nil
+}
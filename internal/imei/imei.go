@@ -1,4 +1,4 @@
-// Package imei implements an IMEI decoder.
+// Package imei implements an IMEI (and IMEISV) decoder, and the types representing decoded codes.
 package imei
 
 // NOTE: for more information about IMEI codes and their structure you may
@@ -12,14 +12,57 @@ import (
 )
 
 var (
-  ErrChecksum = errors.New("imei: invalid IMEI checksum")
-  ErrImeiSize = errors.New("imei: invalid IMEI size (must be 15 characters)")
-  ErrInvalid  = errors.New("imei: invalid IMEI character(s)")
+  ErrChecksum   = errors.New("imei: invalid IMEI checksum")
+  ErrImeiSize   = errors.New("imei: invalid IMEI size (must be 15 characters)")
+  ErrImeisvSize = errors.New("imei: invalid IMEISV size (must be 16 characters)")
+  ErrInvalid    = errors.New("imei: invalid IMEI character(s)")
+
+  ErrUnknownEncoding = errors.New("imei: unknown IMEI digit encoding")
+)
+
+const (
+  IMEI_LENGTH   = 15
+  IMEISV_LENGTH = 16
 )
 
-const IMEI_LENGTH = 15
+// Encoding tells how the digits of an IMEI are encoded in a login message.
+type Encoding int
+
+const (
+  // RawDigits encodes each digit as its value, 0 to 9.
+  RawDigits Encoding = 1 << iota
+
+  // ASCIIDigits encodes each digit as an ASCII character, '0' to '9'.
+  ASCIIDigits
+
+  // AnyDigits accepts either encoding. All the digits of a given IMEI must use the same one.
+  AnyDigits = RawDigits | ASCIIDigits
+)
+
+// String returns the name of the encoding, as accepted by ParseEncoding.
+func (e Encoding) String() string {
+  switch e {
+  case RawDigits:
+    return "raw"
+  case ASCIIDigits:
+    return "ascii"
+  case AnyDigits:
+    return "any"
+  }
+  return "unknown"
+}
+
+// ParseEncoding returns the encoding named name ("raw", "ascii" or "any").
+func ParseEncoding(name string) (Encoding, error) {
+  for _, e := range []Encoding{RawDigits, ASCIIDigits, AnyDigits} {
+    if e.String() == name {
+      return e, nil
+    }
+  }
+  return 0, ErrUnknownEncoding
+}
 
-// Decode returns the IMEI code contained in b.
+// Decode returns the IMEI code contained in b, whose digits are raw values (see RawDigits).
 //
 // If b isn't exactly 15 bytes long, the returned error will be ErrImeiSize.
 //
@@ -28,30 +71,119 @@ const IMEI_LENGTH = 15
 // In case b's checksum is wrong, the returned error will be ErrChecksum.
 //
 // Decode does NOT allocate under any condition. Additionally, it panics if b
+// isn't exactly 15 bytes long: use TryDecode on untrusted input.
+func Decode(b []byte) (code IMEI, err error) {
+  return DecodeEncoding(b, RawDigits)
+}
+
+// DecodeEncoding is like Decode, but accepts the digits in b in the given encoding(s). With
+// AnyDigits, the encoding is that of the first byte, and the other bytes must use the same one:
+// mixing encodings yields ErrInvalid.
+//
+// DecodeEncoding does NOT allocate under any condition. Additionally, it panics if b
 // isn't exactly 15 bytes long.
-func Decode(b []byte) (code uint64, err error) {
+func DecodeEncoding(b []byte, enc Encoding) (code IMEI, err error) {
   // make sure length is correct
   if (len(b) != IMEI_LENGTH) {
     common.LogError(ErrImeiSize)
     panic(ErrImeiSize)
   }
 
-  // go through each byte of b -- build up checksum and code, byte by byte (return an error, but
-  // not panic, if either the checksum is wrong or an invalid byte is encountered).
-  var checksum uint8  = 0
-  var results  uint64 = 0
-  var digit    uint8
+  code, err = TryDecodeEncoding(b, enc)
+  if err != nil {
+    common.LogError(err)
+  }
+  return code, err
+}
 
-  for i := 0; i < IMEI_LENGTH; i++ {
-    // make sure the byte represents a digit
-    digit = uint8(b[i])
+// TryDecode is like Decode, but safe on untrusted input of any length: if b isn't exactly 15 bytes
+// long, the returned error is ErrImeiSize, and TryDecode never panics. It does not log either, and
+// does NOT allocate under any condition.
+func TryDecode(b []byte) (code IMEI, err error) {
+  return TryDecodeEncoding(b, RawDigits)
+}
+
+// TryDecodeEncoding is like DecodeEncoding, but never panics nor logs (see TryDecode).
+func TryDecodeEncoding(b []byte, enc Encoding) (code IMEI, err error) {
+  if len(b) != IMEI_LENGTH {
+    return 0, ErrImeiSize
+  }
+
+  // return an error if either an invalid byte is encountered or the checksum is wrong.
+  results, checksum, err := decodeDigits(b, enc)
+  if err != nil {
+    return 0, err
+  }
+
+  // checksum needs to end with a zero (after all bytes have been counted) to be valid
+  if checksum % 10 != 0 {
+    return 0, ErrChecksum
+  }
+  return IMEI(results), nil
+}
+
+// DecodeSV returns the IMEISV contained in b, 16 digits in the given encoding(s) (see
+// DecodeEncoding). An IMEISV has no check digit, so any 16 digits make a valid one.
+//
+// If b isn't exactly 16 bytes long, the returned error will be ErrImeisvSize: unlike Decode,
+// DecodeSV does not panic. In case b isn't strictly composed of digits, the returned error will be
+// ErrInvalid. DecodeSV does not allocate.
+func DecodeSV(b []byte, enc Encoding) (code IMEISV, err error) {
+  if len(b) != IMEISV_LENGTH {
+    return 0, ErrImeisvSize
+  }
+  results, _, err := decodeDigits(b, enc)
+  if err != nil {
+    return 0, err
+  }
+  return IMEISV(results), nil
+}
+
+// DecodeLogin returns the identity of the device whose login message is b, either a 15-digit IMEI
+// or a 16-digit IMEISV in the given encoding(s). An IMEISV is mapped onto the IMEI of the same
+// device (see IMEISV.IMEI), and its software version number is returned as svn; for a plain IMEI,
+// svn is NoSoftwareVersion.
+//
+// If b is neither 15 nor 16 bytes long, the returned error will be ErrImeiSize. Otherwise the
+// errors are those of TryDecodeEncoding or DecodeSV. DecodeLogin never panics nor logs, and does
+// not allocate.
+func DecodeLogin(b []byte, enc Encoding) (code IMEI, svn int, err error) {
+  switch len(b) {
+  case IMEI_LENGTH:
+    code, err = TryDecodeEncoding(b, enc)
+    return code, NoSoftwareVersion, err
+  case IMEISV_LENGTH:
+    sv, err := DecodeSV(b, enc)
+    if err != nil {
+      return 0, NoSoftwareVersion, err
+    }
+    return sv.IMEI(), int(sv.SoftwareVersion()), nil
+  }
+  return 0, NoSoftwareVersion, ErrImeiSize
+}
+
+// decodeDigits returns the number written by the digits in b, in the given encoding(s), along with
+// their IMEI checksum (which ends with a zero for a valid IMEI). With AnyDigits, the encoding is
+// that of the first byte. b must be at most 19 digits long.
+func decodeDigits(b []byte, enc Encoding) (results uint64, checksum uint8, err error) {
+  if len(b) == 0 {
+    return 0, 0, ErrInvalid
+  }
+
+  // the value of the byte encoding digit 0 (with AnyDigits, as decided by the first byte)
+  var zero uint8 = 0
+  if enc == ASCIIDigits || (enc == AnyDigits && b[0] >= '0') {
+    zero = '0'
+  }
+
+  for i := 0; i < len(b); i++ {
+    // make sure the byte represents a digit (wrapping around below zero makes digit > 9)
+    digit := uint8(b[i]) - zero
     if digit > 9 {
-      common.LogError(ErrInvalid)
-      return 0, ErrInvalid
+      return 0, 0, ErrInvalid
     }
+    results = results * 10 + uint64(digit)
 
-    results *= uint64(10)
-    results += uint64(digit)
     // checksum adds the value of even-positioned digits,
     // and double the value of odd-positioned digits (plus 1 if a 2-digit result)
     if (i % 2 == 0) {
@@ -63,11 +195,15 @@ func Decode(b []byte) (code uint64, err error) {
       }
     }
   }
+  return results, checksum, nil
+}
 
-  // checksum needs to end with a zero (after all bytes have been counted) to be valid
-  if checksum % 10 != 0 {
-    common.LogError(ErrChecksum)
-    return 0, ErrChecksum
-  }
-  return results, nil
+// Parse returns the IMEI code written in s as 15 ASCII decimal digits (e.g. in a URL), applying the
+// same rules as Decode.
+//
+// If s isn't exactly 15 characters long, the returned error will be ErrImeiSize. Otherwise the
+// errors are those of DecodeEncoding with ASCIIDigits, but Parse does not panic, nor log (see
+// TryDecodeEncoding).
+func Parse(s string) (code IMEI, err error) {
+  return TryDecodeEncoding([]byte(s), ASCIIDigits)
 }
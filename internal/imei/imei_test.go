@@ -1,7 +1,9 @@
-package imei
+package imei_test
 
 import (
+	"encoding/json"
 	"github.com/MarcKriguer/thermomatic/internal/imei"
+	"math/rand"
 	"testing"
 )
 
@@ -76,6 +78,71 @@ func TestDecodeBadCharacter(t *testing.T) {
   }
 }
 
+func TestDecodeEncoding(t *testing.T) {
+  raw := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+  ascii := []byte("490154203237518")
+  mixed := []byte{'4', 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+  mixedRaw := []byte{4, '9', 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
+  badAscii := []byte("4901542032375a8")
+  badChecksum := []byte("490154203237519")
+
+  cases := []struct {
+    b    []byte
+    enc  imei.Encoding
+    code imei.IMEI
+    err  error
+  }{
+    {raw, imei.RawDigits, 490154203237518, nil},
+    {raw, imei.ASCIIDigits, 0, imei.ErrInvalid},
+    {raw, imei.AnyDigits, 490154203237518, nil},
+    {ascii, imei.ASCIIDigits, 490154203237518, nil},
+    {ascii, imei.RawDigits, 0, imei.ErrInvalid},
+    {ascii, imei.AnyDigits, 490154203237518, nil},
+    {mixed, imei.AnyDigits, 0, imei.ErrInvalid},
+    {mixedRaw, imei.AnyDigits, 0, imei.ErrInvalid},
+    {badAscii, imei.AnyDigits, 0, imei.ErrInvalid},
+    {badChecksum, imei.AnyDigits, 0, imei.ErrChecksum},
+  }
+
+  for _, c := range cases {
+    code, err := imei.DecodeEncoding(c.b, c.enc)
+    if code != c.code || err != c.err {
+      t.Errorf("DecodeEncoding(%q, %v) = %v, %v instead of %v, %v", c.b, c.enc, code, err,
+          c.code, c.err)
+    }
+  }
+}
+
+func TestParseEncoding(t *testing.T) {
+  for _, enc := range []imei.Encoding{imei.RawDigits, imei.ASCIIDigits, imei.AnyDigits} {
+    if parsed, err := imei.ParseEncoding(enc.String()); parsed != enc || err != nil {
+      t.Errorf("Unable to parse %q: %v, %v", enc.String(), parsed, err)
+    }
+  }
+  if _, err := imei.ParseEncoding("ebcdic"); err != imei.ErrUnknownEncoding {
+    t.Errorf("Expected ErrUnknownEncoding, got %v", err)
+  }
+}
+
+func TestParse(t *testing.T) {
+  // Happy path: the IMEI written in ASCII
+  result, err := imei.Parse("490154203237518")
+  if err != nil || result != 490154203237518 {
+    t.Errorf("Unexpected result %v, %v", result, err)
+  }
+
+  // unhappy paths: wrong length, non-digits and wrong checksum (none of which panic)
+  if _, err := imei.Parse("49015420323751"); err != imei.ErrImeiSize {
+    t.Errorf("Expected ErrImeiSize, got %v", err)
+  }
+  if _, err := imei.Parse("49015420323751x"); err != imei.ErrInvalid {
+    t.Errorf("Expected ErrInvalid, got %v", err)
+  }
+  if _, err := imei.Parse("490154203237519"); err != imei.ErrChecksum {
+    t.Errorf("Expected ErrChecksum, got %v", err)
+  }
+}
+
 func BenchmarkDecode(b *testing.B) {
   b.ReportAllocs()
   var validimei = [...]byte { 4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}
@@ -91,3 +158,180 @@ func BenchmarkDecode(b *testing.B) {
     }
   }
 }
+
+func BenchmarkDecodeAscii(b *testing.B) {
+  b.ReportAllocs()
+  validimei := []byte("490154203237518")
+  for i := 0; i < b.N; i++ {
+    result, err := imei.DecodeEncoding(validimei, imei.AnyDigits)
+    if err != nil || result != 490154203237518 {
+      b.Error("Unexpected result in Benchmark.")
+    }
+  }
+}
+
+func TestIMEIText(t *testing.T) {
+  code := imei.IMEI(12345678901237)
+  if code.String() != "012345678901237" {
+    t.Errorf("Unexpected String %q", code.String())
+  }
+  if b, _ := code.AppendText([]byte("imei=")); string(b) != "imei=012345678901237" {
+    t.Errorf("Unexpected AppendText %q", b)
+  }
+  b, err := json.Marshal(struct{ IMEI imei.IMEI }{code})
+  if err != nil || string(b) != `{"IMEI":"012345678901237"}` {
+    t.Errorf("Unexpected JSON %s, %v", b, err)
+  }
+
+  var decoded struct{ IMEI imei.IMEI }
+  if err := json.Unmarshal(b, &decoded); err != nil || decoded.IMEI != code {
+    t.Errorf("Unexpected round trip %v, %v", decoded.IMEI, err)
+  }
+  if err := decoded.IMEI.UnmarshalText([]byte("012345678901232")); err != imei.ErrChecksum {
+    t.Errorf("Expected ErrChecksum, got %v", err)
+  }
+}
+
+func TestIMEIParts(t *testing.T) {
+  code := imei.IMEI(490154203237518)
+  if code.TAC() != 49015420 || code.SerialNumber() != 323751 || code.CheckDigit() != 8 {
+    t.Errorf("Unexpected breakdown %v %v %v", code.TAC(), code.SerialNumber(), code.CheckDigit())
+  }
+  if code.Body() != 49015420323751 || !code.Valid() {
+    t.Errorf("Unexpected body %v or validity", code.Body())
+  }
+  if imei.TACLimit != 100000000 || imei.IMEI(999999999999994).TAC() != imei.TACLimit - 1 {
+    t.Errorf("Unexpected TAC limit %v", imei.TACLimit)
+  }
+  if imei.IMEI(490154203237519).Valid() || imei.IMEI(1490154203237518).Valid() {
+    t.Error("Invalid IMEI reported valid")
+  }
+}
+
+func TestCheckDigit(t *testing.T) {
+  cases := []struct {
+    body  uint64
+    digit uint8
+  }{
+    {49015420323751, 8},
+    {35693803564380, 9},
+    {0, 0},
+    {1, 8},
+  }
+  for _, c := range cases {
+    if digit := imei.CheckDigit(c.body); digit != c.digit {
+      t.Errorf("CheckDigit(%d) = %d instead of %d", c.body, digit, c.digit)
+    }
+  }
+  if imei.New(49015420323751) != 490154203237518 {
+    t.Errorf("Unexpected New %v", imei.New(49015420323751))
+  }
+}
+
+func TestRandom(t *testing.T) {
+  rng := rand.New(rand.NewSource(1))
+  for i := 0; i < 1000; i++ {
+    code := imei.Random(rng)
+    // every random IMEI must be accepted by the decoder
+    if parsed, err := imei.Parse(code.String()); err != nil || parsed != code {
+      t.Fatalf("Random IMEI %v rejected: %v", code, err)
+    }
+  }
+
+  code := imei.RandomWithTAC(rng, 35693803)
+  if code.TAC() != 35693803 || !code.Valid() {
+    t.Errorf("Unexpected IMEI %v for TAC 35693803", code)
+  }
+}
+
+func BenchmarkAppendText(b *testing.B) {
+  b.ReportAllocs()
+  code := imei.IMEI(490154203237518)
+  buf := make([]byte, 0, imei.IMEI_LENGTH)
+  for i := 0; i < b.N; i++ {
+    buf, _ = code.AppendText(buf[:0])
+  }
+}
+
+func TestDecodeSV(t *testing.T) {
+  sv, err := imei.DecodeSV([]byte("4901542032375107"), imei.AnyDigits)
+  if err != nil || sv != 4901542032375107 {
+    t.Fatalf("Unexpected result %v, %v", sv, err)
+  }
+  if sv.SoftwareVersion() != 7 || sv.Body() != 49015420323751 || sv.IMEI() != 490154203237518 {
+    t.Errorf("Unexpected breakdown %v %v %v", sv.SoftwareVersion(), sv.Body(), sv.IMEI())
+  }
+  if sv.String() != "4901542032375107" {
+    t.Errorf("Unexpected String %q", sv.String())
+  }
+  if padded := imei.NewSV(1234567890123, 42).String(); padded != "0123456789012342" {
+    t.Errorf("Unexpected String %q", padded)
+  }
+
+  raw := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 0, 7}
+  if decoded, err := imei.DecodeSV(raw, imei.RawDigits); err != nil || decoded != sv {
+    t.Errorf("Unexpected result %v, %v", decoded, err)
+  }
+  if _, err := imei.DecodeSV([]byte("490154203237510x"), imei.AnyDigits); err != imei.ErrInvalid {
+    t.Errorf("Expected ErrInvalid, got %v", err)
+  }
+  if _, err := imei.DecodeSV([]byte("490154203237518"), imei.AnyDigits); err != imei.ErrImeisvSize {
+    t.Errorf("Expected ErrImeisvSize, got %v", err)
+  }
+}
+
+func TestDecodeLogin(t *testing.T) {
+  cases := []struct {
+    b    []byte
+    code imei.IMEI
+    svn  int
+    err  error
+  }{
+    {[]byte("490154203237518"), 490154203237518, imei.NoSoftwareVersion, nil},
+    {[]byte("4901542032375199"), 490154203237518, 99, nil},
+    {[]byte("490154203237519"), 0, imei.NoSoftwareVersion, imei.ErrChecksum},
+    {[]byte("49015420323751"), 0, imei.NoSoftwareVersion, imei.ErrImeiSize},
+    {nil, 0, imei.NoSoftwareVersion, imei.ErrImeiSize},
+  }
+  for _, c := range cases {
+    code, svn, err := imei.DecodeLogin(c.b, imei.AnyDigits)
+    if code != c.code || svn != c.svn || err != c.err {
+      t.Errorf("DecodeLogin(%q) = %v, %v, %v instead of %v, %v, %v", c.b, code, svn, err, c.code,
+          c.svn, c.err)
+    }
+  }
+
+  // no length may make it panic
+  for n := 0; n < 32; n++ {
+    imei.DecodeLogin(make([]byte, n), imei.AnyDigits)
+  }
+}
+
+func TestTryDecode(t *testing.T) {
+  if code, err := imei.TryDecode([]byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 8}); err != nil ||
+      code != 490154203237518 {
+    t.Errorf("Unexpected result %v, %v", code, err)
+  }
+  _, err := imei.TryDecodeEncoding([]byte("490154203237519"), imei.AnyDigits)
+  if err != imei.ErrChecksum {
+    t.Errorf("Expected ErrChecksum, got %v", err)
+  }
+
+  // no length may make it panic
+  for n := 0; n < 32; n++ {
+    if n == imei.IMEI_LENGTH {
+      continue
+    }
+    if _, err := imei.TryDecode(make([]byte, n)); err != imei.ErrImeiSize {
+      t.Errorf("TryDecode of %d bytes returned %v", n, err)
+    }
+  }
+
+  short := []byte("4901542032")
+  allocs := testing.AllocsPerRun(100, func() {
+    imei.TryDecodeEncoding(short, imei.AnyDigits)
+  })
+  if allocs != 0 {
+    t.Errorf("TryDecodeEncoding allocated %v times", allocs)
+  }
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+var (
+  ErrDenied        = errors.New("server: device on the denylist")
+  ErrNotAllowed    = errors.New("server: device not on the allowlist")
+  ErrBadAccessList = errors.New("server: invalid access list")
+)
+
+// AccessList is a set of devices, listed by IMEI or by TAC prefix.
+type AccessList struct {
+  imeis    map[imei.IMEI]struct{}
+  prefixes []string
+}
+
+// LoadAccessList reads the access list in the file at path (see ParseAccessList).
+func LoadAccessList(path string) (*AccessList, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  return ParseAccessList(data)
+}
+
+// ParseAccessList parses an access list: one entry per line, either an IMEI (15 digits, with a
+// valid check digit) or a TAC prefix (1 to 8 digits) matching every IMEI starting with it. Blank
+// lines are ignored, and so is everything following a '#'.
+//
+//   # greenhouse sensors
+//   35693803
+//   490154203237518   # test bench
+func ParseAccessList(data []byte) (*AccessList, error) {
+  list := &AccessList{imeis: make(map[imei.IMEI]struct{})}
+  lines := bufio.NewScanner(bytes.NewReader(data))
+  for number := 1; lines.Scan(); number++ {
+    entry := lines.Text()
+    if i := strings.IndexByte(entry, '#'); i >= 0 {
+      entry = entry[:i]
+    }
+    entry = strings.TrimSpace(entry)
+
+    switch {
+    case entry == "":
+    case len(entry) == imei.IMEI_LENGTH:
+      code, err := imei.Parse(entry)
+      if err != nil {
+        return nil, fmt.Errorf("%v: line %d: %v", ErrBadAccessList, number, err)
+      }
+      list.imeis[code] = struct{}{}
+    default:
+      if err := checkTACPrefix(entry); err != nil {
+        return nil, fmt.Errorf("%v: line %d: %v", ErrBadAccessList, number, err)
+      }
+      list.prefixes = append(list.prefixes, entry)
+    }
+  }
+  if err := lines.Err(); err != nil {
+    return nil, fmt.Errorf("%v: %v", ErrBadAccessList, err)
+  }
+  return list, nil
+}
+
+// Contains reports whether the device with IMEI code is on the list. It does not allocate.
+func (list *AccessList) Contains(code imei.IMEI) bool {
+  if _, ok := list.imeis[code]; ok {
+    return true
+  }
+  for _, prefix := range list.prefixes {
+    if hasTACPrefix(code, prefix) {
+      return true
+    }
+  }
+  return false
+}
+
+// Len returns the number of entries on the list.
+func (list *AccessList) Len() int {
+  return len(list.imeis) + len(list.prefixes)
+}
+
+// AccessControl decides which devices may log in, from an allowlist and a denylist file. Devices on
+// the denylist are rejected; if there is an allowlist, so are the devices not on it.
+//
+// The lists can be reloaded while the server runs (see Reload and Watch). Only later logins are
+// checked against the new lists: the devices already online stay online.
+type AccessControl struct {
+  allowPath string
+  denyPath  string
+
+  mu    sync.RWMutex
+  allow *AccessList // nil if there is no allowlist
+  deny  *AccessList // nil if there is no denylist
+}
+
+// fileVersion identifies the content of a list file, to detect changes.
+type fileVersion struct {
+  modTime int64 // in nanoseconds since the Unix epoch
+  size    int64
+}
+
+// NewAccessControl returns an AccessControl loading the allowlist at allowPath and the denylist at
+// denyPath. Either path may be empty, for no such list.
+func NewAccessControl(allowPath, denyPath string) (*AccessControl, error) {
+  ac := &AccessControl{allowPath: allowPath, denyPath: denyPath}
+  if err := ac.Reload(); err != nil {
+    return nil, err
+  }
+  return ac, nil
+}
+
+// Check returns nil if the device with IMEI code may log in, or the reason it may not: ErrDenied or
+// ErrNotAllowed. A nil *AccessControl lets every device in.
+func (ac *AccessControl) Check(code imei.IMEI) error {
+  if ac == nil {
+    return nil
+  }
+  ac.mu.RLock()
+  defer ac.mu.RUnlock()
+  if ac.deny != nil && ac.deny.Contains(code) {
+    return ErrDenied
+  }
+  if ac.allow != nil && !ac.allow.Contains(code) {
+    return ErrNotAllowed
+  }
+  return nil
+}
+
+// Reload reads both lists again. If either can't be loaded, Reload returns the error and keeps
+// using the lists it had.
+func (ac *AccessControl) Reload() error {
+  var lists [2]*AccessList
+  for i, path := range []string{ac.allowPath, ac.denyPath} {
+    if path == "" {
+      continue
+    }
+    var err error
+    if lists[i], err = LoadAccessList(path); err != nil {
+      return err
+    }
+  }
+
+  ac.mu.Lock()
+  ac.allow, ac.deny = lists[0], lists[1]
+  ac.mu.Unlock()
+  return nil
+}
+
+// stat returns the current version of both files (zero for a missing one, or no file).
+func (ac *AccessControl) stat() [2]fileVersion {
+  var versions [2]fileVersion
+  for i, path := range []string{ac.allowPath, ac.denyPath} {
+    if path == "" {
+      continue
+    }
+    if info, err := os.Stat(path); err == nil {
+      versions[i] = fileVersion{info.ModTime().UnixNano(), info.Size()}
+    }
+  }
+  return versions
+}
+
+// String summarizes the lists in use, for the logs.
+func (ac *AccessControl) String() string {
+  ac.mu.RLock()
+  defer ac.mu.RUnlock()
+  describe := func(list *AccessList) string {
+    if list == nil {
+      return "none"
+    }
+    return fmt.Sprintf("%d entries", list.Len())
+  }
+  return fmt.Sprintf("allowlist: %v, denylist: %v", describe(ac.allow), describe(ac.deny))
+}
+
+// Watch checks the files every interval until ctx is done, and reloads the lists when either
+// changes. It reports each reload, successful or not, to report (which may be nil). A file that
+// fails to load is not tried again until it changes once more.
+func (ac *AccessControl) Watch(ctx context.Context, interval time.Duration,
+    report func(err error)) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  seen := ac.stat()
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+    }
+    current := ac.stat()
+    if current == seen {
+      continue
+    }
+    seen = current
+    err := ac.Reload()
+    if report != nil {
+      report(err)
+    }
+  }
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+  "context"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// writeList writes an access list file named name in dir, and returns its path.
+func writeList(t *testing.T, dir string, name string, content string) string {
+  path := filepath.Join(dir, name)
+  if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+    t.Fatal(err)
+  }
+  return path
+}
+
+func TestParseAccessList(t *testing.T) {
+  list, err := ParseAccessList([]byte("# greenhouse sensors\n35693803\n\n" +
+      "  490154203237518   # test bench\n"))
+  if err != nil {
+    t.Fatalf("Unable to parse list: %v", err)
+  }
+  if list.Len() != 2 {
+    t.Errorf("Unexpected number of entries %d", list.Len())
+  }
+  for code, listed := range map[uint64]bool{
+    490154203237518: true,  // by IMEI
+    356938035643809: true,  // by TAC prefix
+    490154203237526: false, // same TAC as a listed IMEI
+    356938045643808: false,
+  } {
+    if list.Contains(imei.IMEI(code)) != listed {
+      t.Errorf("Contains(%d) = %v", code, !listed)
+    }
+  }
+
+  for _, bad := range []string{"490154203237519", "35693x03", "123456789", "4901542032375180"} {
+    if _, err := ParseAccessList([]byte("# comment\n" + bad)); err == nil ||
+        !strings.Contains(err.Error(), "line 2") {
+      t.Errorf("List %q: unexpected error %v", bad, err)
+    }
+  }
+}
+
+// The denylist must take precedence over the allowlist, and no allowlist must let every device in.
+func TestAccessControlCheck(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thermomatic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  allow := writeList(t, dir, "allow", "490154\n")
+  deny := writeList(t, dir, "deny", "490154203237518\n")
+
+  both, err := NewAccessControl(allow, deny)
+  if err != nil {
+    t.Fatalf("Unable to load lists: %v", err)
+  }
+  denyOnly, err := NewAccessControl("", deny)
+  if err != nil {
+    t.Fatalf("Unable to load lists: %v", err)
+  }
+  var none *AccessControl
+
+  cases := []struct {
+    ac   *AccessControl
+    code uint64
+    err  error
+  }{
+    {both, 490154203237518, ErrDenied},
+    {both, 490154203237526, nil},
+    {both, 356938035643809, ErrNotAllowed},
+    {denyOnly, 490154203237518, ErrDenied},
+    {denyOnly, 356938035643809, nil},
+    {none, 490154203237518, nil},
+  }
+  for _, c := range cases {
+    if err := c.ac.Check(imei.IMEI(c.code)); err != c.err {
+      t.Errorf("Check(%d) with %v = %v instead of %v", c.code, c.ac, err, c.err)
+    }
+  }
+
+  if _, err := NewAccessControl(filepath.Join(dir, "missing"), ""); err == nil {
+    t.Error("Missing list loaded")
+  }
+}
+
+// Reload must pick up the new lists, but keep the old ones if the new ones are invalid; Watch must
+// reload them when a file changes.
+func TestAccessControlReload(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thermomatic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  deny := writeList(t, dir, "deny", "356938\n")
+  ac, err := NewAccessControl("", deny)
+  if err != nil {
+    t.Fatalf("Unable to load lists: %v", err)
+  }
+
+  writeList(t, dir, "deny", "356938\n490154203237518\n")
+  if err := ac.Reload(); err != nil || ac.Check(490154203237518) != ErrDenied {
+    t.Errorf("New list not loaded: %v", err)
+  }
+  writeList(t, dir, "deny", "bogus\n")
+  if err := ac.Reload(); err == nil || ac.Check(490154203237518) != ErrDenied {
+    t.Errorf("Invalid list not rejected: %v", err)
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  reloads := make(chan error, 10)
+  go ac.Watch(ctx, 5 * time.Millisecond, func(err error) { reloads <- err })
+  time.Sleep(20 * time.Millisecond)
+  writeList(t, dir, "deny", "356938035643809\n")
+
+  // the file may be caught half-written, and reloaded once more when complete
+  for timeout := time.After(2 * time.Second); ; {
+    select {
+    case err := <-reloads:
+      if err == nil && ac.Check(490154203237518) == nil && ac.Check(356938035643809) == ErrDenied {
+        return
+      }
+    case <-timeout:
+      t.Fatal("Changed list not reloaded")
+    }
+  }
+}
+
+// The server must refuse the devices kept out by the lists, but not drop the devices already online
+// when the lists change.
+func TestServerAccessControl(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thermomatic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  deny := writeList(t, dir, "deny", "356938\n")
+  access, err := NewAccessControl("", deny)
+  if err != nil {
+    t.Fatalf("Unable to load lists: %v", err)
+  }
+
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0), Access: access})
+  defer srv.Close()
+
+  device, done := loginDevice(t, srv, 1)
+  defer device.Close()
+  waitOnline(t, srv, 1)
+
+  // denying the online device only affects its next login
+  writeList(t, dir, "deny", "490154203237518\n")
+  if err := access.Reload(); err != nil {
+    t.Fatalf("Unable to reload lists: %v", err)
+  }
+  if !isOpen(done) {
+    t.Fatal("Online device dropped by the reload")
+  }
+
+  again, againDone := loginDevice(t, srv, 2)
+  defer again.Close()
+  waitClosed(t, againDone)
+  waitForLog(t, logs, "conn 2: login as IMEI 490154203237518 refused: " + ErrDenied.Error())
+  if srv.Stats().LoginFailures.Denied != 1 {
+    t.Errorf("Refused login not counted: %+v", srv.Stats().LoginFailures)
+  }
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "time"
+)
+
+// acker acknowledges the Readings of a connection, in the mode the device asked for (none until it
+// asks). Readings are numbered once acknowledgements are first enabled.
+type acker struct {
+  c       *conn
+  timeout time.Duration
+
+  mode  client.AckMode
+  seq   uint32 // number of the last Reading received (0 before acknowledgements are enabled)
+  acked uint32 // number of the last Reading acknowledged cumulatively
+  buf   [client.ACK_LENGTH]byte
+}
+
+// setMode handles a MessageAckMode from the device, switching to the mode it asks for if valid,
+// and confirms the mode in use.
+func (a *acker) setMode(payload []byte) error {
+  if len(payload) >= client.ACK_MODE_LENGTH {
+    switch mode := client.AckMode(payload[0]); mode {
+    case client.AckNone, client.AckEach, client.AckCumulative:
+      a.mode = mode
+    }
+  }
+  return a.c.send(client.MessageAckMode, []byte{byte(a.mode)}, a.timeout)
+}
+
+// reading handles the outcome of the next Reading: it sends ack (numbered) right away if it is a
+// nack or every Reading is acknowledged, and otherwise leaves it to flush.
+func (a *acker) reading(ack client.Ack) error {
+  if a.mode == client.AckNone && a.seq == 0 {
+    return nil
+  }
+  a.seq++
+  if a.mode == client.AckNone ||
+      (a.mode == client.AckCumulative && ack.Code == client.AckAccepted) {
+    return nil
+  }
+  ack.Seq = a.seq
+  if a.mode == client.AckEach && ack.Code == client.AckAccepted {
+    a.acked = a.seq
+  }
+  return a.c.send(client.MessageAck, client.AppendAck(a.buf[:0], ack), a.timeout)
+}
+
+// flush acknowledges the Readings received and not acknowledged yet, in AckCumulative mode. The
+// connection calls it whenever it has processed everything the device sent.
+func (a *acker) flush() error {
+  if a.mode != client.AckCumulative || a.acked == a.seq {
+    return nil
+  }
+  a.acked = a.seq
+  ack := client.Ack{Seq: a.seq, Code: client.AckAccepted, Field: client.NoField}
+  return a.c.send(client.MessageAck, client.AppendAck(a.buf[:0], ack), a.timeout)
+}
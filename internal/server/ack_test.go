@@ -0,0 +1,99 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "net"
+  "testing"
+  "time"
+)
+
+// enableAcks asks for acknowledgements in mode on device, and returns the reader of the messages
+// the server sends.
+func enableAcks(t *testing.T, device net.Conn, mode client.AckMode) *client.MessageReader {
+  device.SetDeadline(time.Now().Add(2 * time.Second))
+  device.Write(client.AppendMessage(nil, client.MessageAckMode, []byte{byte(mode)}))
+  messages := client.NewMessageReader(device)
+  typ, payload, err := messages.Next()
+  if err != nil || typ != client.MessageAckMode || client.AckMode(payload[0]) != mode {
+    t.Fatalf("Acknowledgements not enabled: %v %x %v", typ, payload, err)
+  }
+  return messages
+}
+
+// nextAck returns the next acknowledgement the server sends.
+func nextAck(t *testing.T, messages *client.MessageReader) client.Ack {
+  typ, payload, err := messages.Next()
+  if err != nil || typ != client.MessageAck {
+    t.Fatalf("No acknowledgement: %v %v", typ, err)
+  }
+  ack, err := client.DecodeAck(payload)
+  if err != nil {
+    t.Fatalf("Invalid acknowledgement: %v", err)
+  }
+  return ack
+}
+
+// In AckEach mode, every Reading must be acknowledged on its own, with the reason it was rejected.
+func TestServerAckEach(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+  device, _, _ := loginV2(t, srv, client.PROTOCOL_V2)
+  defer device.Close()
+
+  // Readings sent before asking for acknowledgements are not numbered
+  device.Write(testReading.EncodeMessage())
+  messages := enableAcks(t, device, client.AckEach)
+
+  invalid := testReading
+  invalid.BatteryLevel = -5
+  want := []client.Ack{
+    {Seq: 1, Code: client.AckAccepted, Field: client.NoField},
+    {Seq: 2, Code: client.NackOutOfRange, Field: client.FieldBatteryLevel},
+    {Seq: 3, Code: client.NackMalformed, Field: client.NoField},
+  }
+  for i, message := range [][]byte{
+    testReading.EncodeMessage(),
+    invalid.EncodeMessage(),
+    client.AppendMessage(nil, client.MessageReading, []byte{1, 2, 3}),
+  } {
+    device.Write(message)
+    if ack := nextAck(t, messages); ack != want[i] {
+      t.Errorf("Reading %d: unexpected acknowledgement %+v", i + 1, ack)
+    }
+  }
+}
+
+// In AckCumulative mode, a burst of Readings must be acknowledged at once, after the nacks of the
+// rejected ones.
+func TestServerAckCumulative(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+  device, _, _ := loginV2(t, srv, client.PROTOCOL_V2)
+  defer device.Close()
+  messages := enableAcks(t, device, client.AckCumulative)
+
+  invalid := testReading
+  invalid.Temperature = 500
+  var burst []byte
+  for _, reading := range []client.Reading{testReading, invalid, testReading, testReading} {
+    burst = append(burst, reading.EncodeMessage()...)
+  }
+  device.Write(burst)
+
+  var u client.Unacked
+  for i := 0; i < 4; i++ {
+    u.Sent(nil)
+  }
+  ack := nextAck(t, messages)
+  if ack != (client.Ack{Seq: 2, Code: client.NackOutOfRange, Field: client.FieldTemperature}) {
+    t.Errorf("Unexpected nack %+v", ack)
+  }
+  u.Ack(ack)
+  ack = nextAck(t, messages)
+  if ack != (client.Ack{Seq: 4, Code: client.AckAccepted, Field: client.NoField}) {
+    t.Errorf("Unexpected cumulative acknowledgement %+v", ack)
+  }
+  if accepted, _, _ := u.Ack(ack); len(accepted) != 3 || u.Len() != 0 {
+    t.Errorf("Unexpected Readings accepted %+v", accepted)
+  }
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// adminHandler returns the HTTP handler serving the admin endpoints, mounted under /admin/:
+//
+//   GET /admin/devices         provisioning records of all registered devices
+//   GET /admin/devices/:imei   provisioning record of a device (see ProvisionedDevice)
+//   PUT /admin/devices/:imei   registers a device, or changes its state: {"state": "approved"}
+//   GET /admin/config/:imei    configuration changes of a device, oldest first (see ConfigChange)
+//   POST /admin/config/:imei   queues a configuration change (see client.Settings), pushed to the
+//                              device right away if it is online, or at its next login
+//   GET /admin/firmware        firmware images hosted (see FirmwareImage)
+//   GET /admin/firmware/:tac   rollout of the image for a model (see FirmwareRollout)
+//   PUT /admin/firmware/:tac   stages the rollout of the image for a model: {"rollout_percent": 25}
+//
+// Every request must carry the AdminToken as "Authorization: Bearer <token>". Without one, the
+// admin endpoints are not served at all.
+func (s *Server) adminHandler() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/admin/devices", s.handleProvisionedDevices)
+  mux.HandleFunc("/admin/devices/", s.handleProvisionedDevice)
+  mux.HandleFunc("/admin/config/", s.handleDeviceConfig)
+  mux.HandleFunc("/admin/firmware", s.handleFirmwareImages)
+  mux.HandleFunc("/admin/firmware/", s.handleFirmwareRollout)
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if !s.authorizedAdmin(req) {
+      w.Header().Set("WWW-Authenticate", `Bearer realm="thermomatic admin"`)
+      writeError(w, http.StatusUnauthorized, "admin token required")
+      return
+    }
+    mux.ServeHTTP(w, req)
+  })
+}
+
+// authorizedAdmin reports whether req carries the AdminToken (never if none is configured).
+func (s *Server) authorizedAdmin(req *http.Request) bool {
+  if s.opts.AdminToken == "" {
+    return false
+  }
+  token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+  return subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.AdminToken)) == 1
+}
+
+// handleProvisionedDevices serves GET /admin/devices.
+func (s *Server) handleProvisionedDevices(w http.ResponseWriter, req *http.Request) {
+  if !allowGet(w, req) || !s.provisioningEnabled(w) {
+    return
+  }
+  writeJSON(w, http.StatusOK, provisioningFile{Devices: s.opts.Provisioning.Devices()})
+}
+
+// handleProvisionedDevice serves GET and PUT /admin/devices/:imei. GET replies 404 Not Found if the
+// device is not registered. PUT replies 201 Created for a newly registered device, 400 Bad Request
+// for an invalid state and 409 Conflict for a state change not allowed.
+func (s *Server) handleProvisionedDevice(w http.ResponseWriter, req *http.Request) {
+  if !allowMethods(w, req, http.MethodGet, http.MethodHead, http.MethodPut) ||
+      !s.provisioningEnabled(w) {
+    return
+  }
+  code, ok := imeiFromPath(w, req.URL.Path, "/admin/devices/")
+  if !ok {
+    return
+  }
+
+  if req.Method != http.MethodPut {
+    device, registered := s.opts.Provisioning.Lookup(code)
+    if !registered {
+      writeError(w, http.StatusNotFound, ErrUnprovisioned.Error())
+      return
+    }
+    writeJSON(w, http.StatusOK, device)
+    return
+  }
+
+  var body struct {
+    State ProvisioningState `json:"state"`
+  }
+  if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  device, registered, err := s.opts.Provisioning.Set(code, body.State)
+  switch {
+  case err == ErrUnknownState:
+    writeError(w, http.StatusBadRequest, err.Error())
+  case err == ErrBadTransition:
+    writeError(w, http.StatusConflict, err.Error())
+  case err != nil:
+    s.log.Printf("Unable to save provisioning of IMEI %v: %v", code, err)
+    writeError(w, http.StatusInternalServerError, err.Error())
+  case registered:
+    s.log.Printf("IMEI %v: registered as %v", code, device.State)
+    writeJSON(w, http.StatusCreated, device)
+  default:
+    s.log.Printf("IMEI %v: provisioning state set to %v", code, device.State)
+    writeJSON(w, http.StatusOK, device)
+  }
+}
+
+// handleDeviceConfig serves GET and POST /admin/config/:imei. POST replies 202 Accepted with the
+// change queued, 400 Bad Request for invalid settings and 429 Too Many Requests if too many changes
+// are pending (see configQueue.queue).
+func (s *Server) handleDeviceConfig(w http.ResponseWriter, req *http.Request) {
+  if !allowMethods(w, req, http.MethodGet, http.MethodHead, http.MethodPost) {
+    return
+  }
+  code, ok := imeiFromPath(w, req.URL.Path, "/admin/config/")
+  if !ok {
+    return
+  }
+  if req.Method != http.MethodPost {
+    writeJSON(w, http.StatusOK, s.configs.list(code))
+    return
+  }
+
+  var settings client.Settings
+  if err := json.NewDecoder(req.Body).Decode(&settings); err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  if err := settings.Validate(); err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+  change, err := s.configs.queue(code, settings)
+  if err != nil {
+    writeError(w, http.StatusTooManyRequests, err.Error())
+    return
+  }
+  s.log.Printf("IMEI %v: configuration change %d queued", code, change.ID)
+
+  // push it right away if the device is online and able to take it
+  if c := s.registry.conn(code); c != nil && c.device().Protocol >= client.PROTOCOL_V2 {
+    if err := s.pushConfig(c, &change); err != nil {
+      s.log.Printf("conn %d: unable to send configuration change %d: %v", c.id, change.ID, err)
+    }
+  }
+  for _, queued := range s.configs.list(code) {
+    if queued.ID == change.ID {
+      change = queued
+    }
+  }
+  writeJSON(w, http.StatusAccepted, change)
+}
+
+// handleFirmwareImages serves GET /admin/firmware.
+func (s *Server) handleFirmwareImages(w http.ResponseWriter, req *http.Request) {
+  if !allowGet(w, req) || !s.firmwareEnabled(w) {
+    return
+  }
+  writeJSON(w, http.StatusOK, s.opts.Firmware.Images())
+}
+
+// handleFirmwareRollout serves GET and PUT /admin/firmware/:tac. Both reply 404 Not Found if no
+// image is hosted for the TAC; PUT replies 400 Bad Request for a percentage out of 0-100.
+func (s *Server) handleFirmwareRollout(w http.ResponseWriter, req *http.Request) {
+  if !allowMethods(w, req, http.MethodGet, http.MethodHead, http.MethodPut) ||
+      !s.firmwareEnabled(w) {
+    return
+  }
+  tac, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/admin/firmware/"), 10, 32)
+  if err != nil {
+    writeError(w, http.StatusBadRequest, "invalid TAC")
+    return
+  }
+
+  if req.Method != http.MethodPut {
+    rollout, err := s.opts.Firmware.Rollout(uint32(tac))
+    if err != nil {
+      writeError(w, http.StatusNotFound, err.Error())
+      return
+    }
+    writeJSON(w, http.StatusOK, rollout)
+    return
+  }
+
+  var body struct {
+    RolloutPercent *int `json:"rollout_percent"`
+  }
+  if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.RolloutPercent == nil {
+    writeError(w, http.StatusBadRequest, "rollout_percent required")
+    return
+  }
+  image, err := s.opts.Firmware.SetRolloutPercent(uint32(tac), *body.RolloutPercent)
+  switch {
+  case err == ErrUnknownFirmware:
+    writeError(w, http.StatusNotFound, err.Error())
+  case err != nil:
+    writeError(w, http.StatusBadRequest, err.Error())
+  default:
+    s.log.Printf("TAC %d: firmware v%d rolled out to %d%% of the devices", image.TAC, image.Version,
+        image.RolloutPercent)
+    writeJSON(w, http.StatusOK, image)
+  }
+}
+
+// firmwareEnabled replies 404 Not Found (returning false) if the server hosts no Firmware.
+func (s *Server) firmwareEnabled(w http.ResponseWriter) bool {
+  if s.opts.Firmware == nil {
+    writeError(w, http.StatusNotFound, "firmware distribution not enabled")
+    return false
+  }
+  return true
+}
+
+// provisioningEnabled replies 404 Not Found (returning false) if the server has no Provisioning.
+func (s *Server) provisioningEnabled(w http.ResponseWriter) bool {
+  if s.opts.Provisioning == nil {
+    writeError(w, http.StatusNotFound, "provisioning not enabled")
+    return false
+  }
+  return true
+}
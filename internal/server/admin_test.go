@@ -0,0 +1,102 @@
+package server
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+// admin performs a request against srv's admin endpoints, with token if not empty.
+// testAdminToken is the AdminToken of the servers under test.
+const testAdminToken = "s3cret"
+
+func admin(srv *Server, method string, path string, body string,
+    token string) *httptest.ResponseRecorder {
+  req := httptest.NewRequest(method, path, strings.NewReader(body))
+  if token != "" {
+    req.Header.Set("Authorization", "Bearer " + token)
+  }
+  recorder := httptest.NewRecorder()
+  srv.Handler().ServeHTTP(recorder, req)
+  return recorder
+}
+
+func TestAdminDevices(t *testing.T) {
+  p, err := NewProvisioning("", false)
+  if err != nil {
+    t.Fatalf("Unable to create provisioning: %v", err)
+  }
+  srv, _, _ := startServer(t, Options{Provisioning: p, AdminToken: testAdminToken})
+  defer srv.Close()
+
+  cases := []struct {
+    method string
+    path   string
+    body   string
+    token  string
+    status int
+  }{
+    {http.MethodGet, "/admin/devices", "", "", http.StatusUnauthorized},
+    {http.MethodGet, "/admin/devices", "", "wrong", http.StatusUnauthorized},
+    {http.MethodGet, "/admin/devices/490154203237518", "", testAdminToken, http.StatusNotFound},
+    {http.MethodPut, "/admin/devices/490154203237518", `{"state": "pending"}`, testAdminToken,
+        http.StatusCreated},
+    {http.MethodPut, "/admin/devices/490154203237518", `{"state": "approved"}`, testAdminToken,
+        http.StatusOK},
+    {http.MethodPut, "/admin/devices/490154203237518", `{"state": "bogus"}`, testAdminToken,
+        http.StatusBadRequest},
+    {http.MethodPut, "/admin/devices/490154203237519", `{"state": "approved"}`, testAdminToken,
+        http.StatusBadRequest},
+    {http.MethodPut, "/admin/devices/356938035643809", `{"state": "retired"}`, testAdminToken,
+        http.StatusCreated},
+    {http.MethodPut, "/admin/devices/356938035643809", `{"state": "approved"}`, testAdminToken,
+        http.StatusConflict},
+    {http.MethodDelete, "/admin/devices/356938035643809", "", testAdminToken,
+        http.StatusMethodNotAllowed},
+  }
+  for _, c := range cases {
+    if response := admin(srv, c.method, c.path, c.body, c.token); response.Code != c.status {
+      t.Errorf("%v %v %s: status %d instead of %d (%s)", c.method, c.path, c.body, response.Code,
+          c.status, response.Body.String())
+    }
+  }
+
+  response := admin(srv, http.MethodGet, "/admin/devices", "", testAdminToken)
+  var list struct {
+    Devices []ProvisionedDevice `json:"devices"`
+  }
+  if err := json.Unmarshal(response.Body.Bytes(), &list); err != nil {
+    t.Fatalf("Invalid JSON: %v", err)
+  }
+  if len(list.Devices) != 2 || list.Devices[1].IMEI != 490154203237518 ||
+      list.Devices[1].State != Approved {
+    t.Errorf("Unexpected devices %+v", list.Devices)
+  }
+}
+
+// Without provisioning, the admin device endpoints do not exist.
+func TestAdminDevicesDisabled(t *testing.T) {
+  srv, _, _ := startServer(t, Options{AdminToken: testAdminToken})
+  defer srv.Close()
+  if response := admin(srv, http.MethodGet, "/admin/devices", "", testAdminToken); response.Code !=
+      http.StatusNotFound {
+    t.Errorf("Unexpected status %d", response.Code)
+  }
+}
+
+// Without an admin token, no admin endpoint exists.
+func TestAdminWithoutToken(t *testing.T) {
+  p, err := NewProvisioning("", false)
+  if err != nil {
+    t.Fatalf("Unable to create provisioning: %v", err)
+  }
+  srv, _, _ := startServer(t, Options{Provisioning: p})
+  defer srv.Close()
+  for _, path := range []string{"/admin/devices", "/admin/config/490154203237518"} {
+    if response := admin(srv, http.MethodGet, path, "", ""); response.Code != http.StatusNotFound {
+      t.Errorf("%v: unexpected status %d", path, response.Code)
+    }
+  }
+}
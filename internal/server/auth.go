@@ -0,0 +1,141 @@
+package server
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/hmac"
+  "crypto/rand"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "strings"
+  "sync/atomic"
+  "time"
+)
+
+var (
+  ErrAuthFailed  = errors.New("server: device failed authentication")
+  ErrAuthTimeout = errors.New("server: authentication timeout")
+  ErrNoKey       = errors.New("server: no key for device")
+  ErrBadKeyFile  = errors.New("server: invalid key file")
+)
+
+const (
+  // Time a device has to answer the server's nonce after logging in.
+  DefaultAuthTimeout = time.Second
+
+  // Shortest secret key accepted for a device, in bytes.
+  MIN_KEY_LENGTH = 16
+)
+
+// KeyStore holds the secret keys devices authenticate with.
+type KeyStore interface {
+  // Key returns the secret key of the device with IMEI code, if it has one.
+  Key(code imei.IMEI) ([]byte, bool)
+}
+
+// KeyFile is a KeyStore loaded from a file (see ParseKeyFile).
+type KeyFile struct {
+  keys map[imei.IMEI][]byte
+}
+
+// LoadKeyFile reads the keys in the file at path (see ParseKeyFile).
+func LoadKeyFile(path string) (*KeyFile, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  return ParseKeyFile(data)
+}
+
+// ParseKeyFile parses a key file: one device per line, its IMEI (15 digits, with a valid check
+// digit) followed by its secret key in hexadecimal (at least MIN_KEY_LENGTH bytes). Blank lines
+// are ignored, and so is everything following a '#'.
+//
+//   # test bench
+//   490154203237518   000102030405060708090a0b0c0d0e0f
+func ParseKeyFile(data []byte) (*KeyFile, error) {
+  file := &KeyFile{keys: make(map[imei.IMEI][]byte)}
+  lines := bufio.NewScanner(bytes.NewReader(data))
+  for number := 1; lines.Scan(); number++ {
+    entry := lines.Text()
+    if i := strings.IndexByte(entry, '#'); i >= 0 {
+      entry = entry[:i]
+    }
+    fields := strings.Fields(entry)
+    if len(fields) == 0 {
+      continue
+    }
+    if len(fields) != 2 {
+      return nil, fmt.Errorf("%v: line %d: expected an IMEI and a key", ErrBadKeyFile, number)
+    }
+
+    code, err := imei.Parse(fields[0])
+    if err != nil {
+      return nil, fmt.Errorf("%v: line %d: %v", ErrBadKeyFile, number, err)
+    }
+    key, err := hex.DecodeString(fields[1])
+    if err != nil {
+      return nil, fmt.Errorf("%v: line %d: %v", ErrBadKeyFile, number, err)
+    }
+    if len(key) < MIN_KEY_LENGTH {
+      return nil, fmt.Errorf("%v: line %d: key shorter than %d bytes", ErrBadKeyFile, number,
+          MIN_KEY_LENGTH)
+    }
+    if _, dup := file.keys[code]; dup {
+      return nil, fmt.Errorf("%v: line %d: IMEI %v listed twice", ErrBadKeyFile, number, code)
+    }
+    file.keys[code] = key
+  }
+  if err := lines.Err(); err != nil {
+    return nil, fmt.Errorf("%v: %v", ErrBadKeyFile, err)
+  }
+  return file, nil
+}
+
+// Key returns the secret key of the device with IMEI code, if it is in the file.
+func (file *KeyFile) Key(code imei.IMEI) ([]byte, bool) {
+  key, ok := file.keys[code]
+  return key, ok
+}
+
+// Len returns the number of devices in the file.
+func (file *KeyFile) Len() int {
+  return len(file.keys)
+}
+
+// authenticate challenges the device on c, which logged in as IMEI code, to prove it holds the
+// device's secret key: it sends a random nonce, and expects its HMAC-SHA256 under the key back
+// within the AuthTimeout. It returns nil if the device answered correctly, or the reason it did
+// not: ErrNoKey, ErrAuthFailed, ErrAuthTimeout or the connection's failure.
+func (s *Server) authenticate(c *conn, frames *framer, code imei.IMEI) error {
+  key, ok := s.opts.Keys.Key(code)
+  if !ok {
+    return ErrNoKey
+  }
+
+  var nonce [client.NONCE_LENGTH]byte
+  if _, err := rand.Read(nonce[:]); err != nil {
+    return err
+  }
+  c.netConn.SetWriteDeadline(time.Now().Add(s.opts.AuthTimeout))
+  _, err := c.netConn.Write(nonce[:])
+  c.netConn.SetWriteDeadline(time.Time{})
+  if err != nil {
+    return s.readFailure(c, err, ErrAuthTimeout)
+  }
+
+  s.setReadDeadline(c, s.opts.AuthTimeout)
+  answer, err := frames.next(client.AUTH_RESPONSE_LENGTH)
+  if err != nil {
+    return s.readFailure(c, err, ErrAuthTimeout)
+  }
+  atomic.AddUint64(&s.counters.bytesRead, client.AUTH_RESPONSE_LENGTH)
+  if !hmac.Equal(answer, client.AuthResponse(key, nonce[:])) {
+    return ErrAuthFailed
+  }
+  return nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "log"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testKeys is a key file holding a key for client.ValidImei.
+const testKeys = "# test bench\n490154203237518 000102030405060708090a0b0c0d0e0f\n"
+
+func TestParseKeyFile(t *testing.T) {
+  keys, err := ParseKeyFile([]byte(testKeys))
+  if err != nil {
+    t.Fatalf("Unable to parse keys: %v", err)
+  }
+  if key, ok := keys.Key(490154203237518); !ok || len(key) != 16 || key[15] != 15 {
+    t.Errorf("Unexpected key %x", key)
+  }
+  if _, ok := keys.Key(356938035643809); ok {
+    t.Error("Key found for an unlisted device")
+  }
+
+  for _, bad := range []string{
+    "490154203237519 000102030405060708090a0b0c0d0e0f", // bad check digit
+    "490154203237518 000102030405060708090a0b0c0d0e",   // key too short
+    "490154203237518 000102030405060708090a0b0c0d0e0g", // not hex
+    "490154203237518",
+  } {
+    if _, err := ParseKeyFile([]byte("# comment\n" + bad)); err == nil ||
+        !strings.Contains(err.Error(), "line 2") {
+      t.Errorf("Keys %q: unexpected error %v", bad, err)
+    }
+  }
+  if _, err := ParseKeyFile([]byte(testKeys + testKeys)); err == nil ||
+      !strings.Contains(err.Error(), "listed twice") {
+    t.Errorf("Duplicate key: unexpected error %v", err)
+  }
+}
+
+// The server must let in the device answering its nonce with the right key, and drop the devices
+// answering wrongly, late or not having a key at all.
+func TestServerAuthentication(t *testing.T) {
+  keys, err := ParseKeyFile([]byte(testKeys))
+  if err != nil {
+    t.Fatalf("Unable to parse keys: %v", err)
+  }
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0), Keys: keys,
+      AuthTimeout: 50 * time.Millisecond})
+  defer srv.Close()
+  key, _ := keys.Key(490154203237518)
+
+  // right key
+  device, done := loginDevice(t, srv, 1)
+  defer device.Close()
+  if err := client.Authenticate(device, key); err != nil {
+    t.Fatalf("Unable to authenticate: %v", err)
+  }
+  waitOnline(t, srv, 1)
+  if !isOpen(done) {
+    t.Fatal("Authenticated device dropped")
+  }
+
+  // wrong key
+  impostor, impostorDone := loginDevice(t, srv, 2)
+  defer impostor.Close()
+  client.Authenticate(impostor, []byte("not the device's key"))
+  waitClosed(t, impostorDone)
+  waitForLog(t, logs, "conn 2: login as IMEI 490154203237518 refused: " + ErrAuthFailed.Error())
+
+  // no answer
+  silent, silentDone := loginDevice(t, srv, 3)
+  defer silent.Close()
+  waitClosed(t, silentDone)
+  waitForLog(t, logs, "conn 3: login as IMEI 490154203237518 refused: " + ErrAuthTimeout.Error())
+
+  if failures := srv.Stats().LoginFailures; failures.Auth != 2 {
+    t.Errorf("Unexpected login failures %+v", failures)
+  }
+
+  // no key
+  other, err := ParseKeyFile([]byte("356938035643809 000102030405060708090a0b0c0d0e0f\n"))
+  if err != nil {
+    t.Fatalf("Unable to parse keys: %v", err)
+  }
+  keyless, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0), Keys: other})
+  defer keyless.Close()
+  unknown, unknownDone := loginDevice(t, keyless, 4)
+  defer unknown.Close()
+  waitClosed(t, unknownDone)
+  waitForLog(t, logs, "conn 4: login as IMEI 490154203237518 refused: " + ErrNoKey.Error())
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+  "errors"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "sync"
+  "time"
+)
+
+var (
+  ErrUnknownChange      = errors.New("server: unknown configuration change")
+  ErrUnknownConfigState = errors.New("server: unknown configuration change state")
+  ErrTooManyChanges     = errors.New("server: too many configuration changes pending")
+)
+
+const (
+  // Number of confirmed configuration changes kept per device, for the admin API.
+  maxConfirmedChanges = 16
+
+  // Most configuration changes pending (not confirmed yet) per device.
+  maxPendingChanges = 16
+
+  // Most devices whose configuration changes are kept. The changes of devices that never log in
+  // stay pending: past this many devices, only those with no change pending are forgotten.
+  maxConfigDevices = 10000
+)
+
+// ConfigState is where a configuration change stands in its delivery to the device.
+type ConfigState int
+
+const (
+  // ConfigQueued changes wait for the device to be online, speaking protocol v2 or later.
+  ConfigQueued ConfigState = iota + 1
+
+  // ConfigSent changes wait for the device to confirm them. They are sent again at the device's
+  // next login if it does not (or if sending them failed).
+  ConfigSent
+
+  // ConfigApplied changes were applied by the device.
+  ConfigApplied
+
+  // ConfigRejected changes were refused by the device.
+  ConfigRejected
+)
+
+// String returns the name of the state.
+func (st ConfigState) String() string {
+  switch st {
+  case ConfigQueued:
+    return "queued"
+  case ConfigSent:
+    return "sent"
+  case ConfigApplied:
+    return "applied"
+  case ConfigRejected:
+    return "rejected"
+  }
+  return "unknown"
+}
+
+// ParseConfigState returns the state with the given name (as returned by ConfigState.String).
+func ParseConfigState(name string) (ConfigState, error) {
+  for _, st := range []ConfigState{ConfigQueued, ConfigSent, ConfigApplied, ConfigRejected} {
+    if st.String() == name {
+      return st, nil
+    }
+  }
+  return 0, ErrUnknownConfigState
+}
+
+// MarshalText returns the name of the state.
+func (st ConfigState) MarshalText() ([]byte, error) {
+  if st < ConfigQueued || st > ConfigRejected {
+    return nil, ErrUnknownConfigState
+  }
+  return []byte(st.String()), nil
+}
+
+// UnmarshalText sets the state to the one named text.
+func (st *ConfigState) UnmarshalText(text []byte) (err error) {
+  *st, err = ParseConfigState(string(text))
+  return err
+}
+
+// ConfigChange is a change of a device's settings, as served by the admin API.
+type ConfigChange struct {
+  // ID identifies the change, for the device's confirmation.
+  ID uint32 `json:"id"`
+
+  IMEI     imei.IMEI       `json:"imei"`
+  Settings client.Settings `json:"settings"`
+  State    ConfigState     `json:"state"`
+
+  // QueuedAt is when the change was queued, SentAt when it was last sent to the device and
+  // ConfirmedAt when the device confirmed it.
+  QueuedAt    time.Time  `json:"queued_at"`
+  SentAt      *time.Time `json:"sent_at,omitempty"`
+  ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+
+  sentOn uint64 // connection it was last sent on
+}
+
+// configQueue keeps the configuration changes of the devices, from the time they are queued until
+// the devices confirm them (and a few more, for the record). It is safe for concurrent use.
+//
+// The changes are kept in memory only: the changes not confirmed yet are lost on restart.
+type configQueue struct {
+  maxDevices int
+
+  mu      sync.Mutex
+  lastID  uint32
+  changes map[imei.IMEI][]*ConfigChange // oldest first
+}
+
+// newConfigQueue returns an empty configQueue.
+func newConfigQueue() *configQueue {
+  return &configQueue{maxDevices: maxConfigDevices, changes: make(map[imei.IMEI][]*ConfigChange)}
+}
+
+// queue queues the change of settings for the device with IMEI code, and returns it. It returns
+// ErrTooManyChanges if the device has maxPendingChanges pending already, or if the queue keeps the
+// changes of as many devices as it can, all with changes pending.
+func (q *configQueue) queue(code imei.IMEI, settings client.Settings) (ConfigChange, error) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  changes, tracked := q.changes[code]
+  if pending(changes) >= maxPendingChanges || (!tracked && !q.evict()) {
+    return ConfigChange{}, ErrTooManyChanges
+  }
+  q.lastID++
+  change := &ConfigChange{ID: q.lastID, IMEI: code, Settings: settings, State: ConfigQueued,
+      QueuedAt: time.Now()}
+  q.changes[code] = append(q.changes[code], change)
+  return *change, nil
+}
+
+// evict makes room for the changes of one more device, forgetting the confirmed changes of a
+// device with none pending if need be. It reports false if there is no room. The caller holds q.mu.
+func (q *configQueue) evict() bool {
+  if len(q.changes) < q.maxDevices {
+    return true
+  }
+  for code, changes := range q.changes {
+    if pending(changes) == 0 {
+      delete(q.changes, code)
+      return true
+    }
+  }
+  return false
+}
+
+// pending returns the number of changes not confirmed yet.
+func pending(changes []*ConfigChange) int {
+  n := 0
+  for _, change := range changes {
+    if change.ConfirmedAt == nil {
+      n++
+    }
+  }
+  return n
+}
+
+// unconfirmed returns the changes of the device with IMEI code not confirmed yet, oldest first.
+func (q *configQueue) unconfirmed(code imei.IMEI) []ConfigChange {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  var changes []ConfigChange
+  for _, change := range q.changes[code] {
+    if change.State == ConfigQueued || change.State == ConfigSent {
+      changes = append(changes, *change)
+    }
+  }
+  return changes
+}
+
+// claim records that change id of the device with IMEI code is sent on connection connID at the
+// given time. It reports false if the change was confirmed or sent on connID already: a change is
+// sent once per connection.
+func (q *configQueue) claim(code imei.IMEI, id uint32, connID uint64, at time.Time) bool {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  change := q.find(code, id)
+  if change == nil || change.ConfirmedAt != nil || change.sentOn == connID {
+    return false
+  }
+  change.State = ConfigSent
+  change.SentAt = &at
+  change.sentOn = connID
+  return true
+}
+
+// confirm records the device's confirmation of change id, with status, at the given time, and
+// returns the change. It returns ErrUnknownChange if the device has no such change.
+func (q *configQueue) confirm(code imei.IMEI, id uint32, status client.ConfigStatus,
+    at time.Time) (ConfigChange, error) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  change := q.find(code, id)
+  if change == nil {
+    return ConfigChange{}, ErrUnknownChange
+  }
+  if change.ConfirmedAt == nil {
+    change.State = ConfigApplied
+    if status != client.ConfigApplied {
+      change.State = ConfigRejected
+    }
+    change.ConfirmedAt = &at
+    q.prune(code)
+  }
+  return *change, nil
+}
+
+// list returns the changes of the device with IMEI code, oldest first.
+func (q *configQueue) list(code imei.IMEI) []ConfigChange {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  changes := make([]ConfigChange, 0, len(q.changes[code]))
+  for _, change := range q.changes[code] {
+    changes = append(changes, *change)
+  }
+  return changes
+}
+
+// find returns change id of the device with IMEI code, or nil. The caller holds q.mu.
+func (q *configQueue) find(code imei.IMEI, id uint32) *ConfigChange {
+  for _, change := range q.changes[code] {
+    if change.ID == id {
+      return change
+    }
+  }
+  return nil
+}
+
+// prune forgets the oldest confirmed changes of the device with IMEI code, past
+// maxConfirmedChanges. The caller holds q.mu.
+func (q *configQueue) prune(code imei.IMEI) {
+  changes := q.changes[code]
+  confirmed := 0
+  for _, change := range changes {
+    if change.ConfirmedAt != nil {
+      confirmed++
+    }
+  }
+  kept := changes[:0]
+  for _, change := range changes {
+    if change.ConfirmedAt != nil && confirmed > maxConfirmedChanges {
+      confirmed--
+      continue
+    }
+    kept = append(kept, change)
+  }
+  q.changes[code] = kept
+}
+
+// pushConfigs sends the device on c, logged in as IMEI code, its configuration changes not
+// confirmed yet: the queued ones, and those sent on an earlier connection but never confirmed.
+func (s *Server) pushConfigs(c *conn, code imei.IMEI) error {
+  for _, change := range s.configs.unconfirmed(code) {
+    if err := s.pushConfig(c, &change); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// pushConfig sends change to the device on c, unless it was sent on c already (the admin API and
+// the login may both push the same change). It is safe to call from any goroutine.
+func (s *Server) pushConfig(c *conn, change *ConfigChange) error {
+  if !s.configs.claim(change.IMEI, change.ID, c.id, time.Now()) {
+    return nil
+  }
+  payload := client.AppendConfig(nil, change.ID, &change.Settings)
+  if err := c.send(client.MessageConfig, payload, s.opts.ReadingTimeout); err != nil {
+    return err
+  }
+  s.log.Printf("conn %d: configuration change %d sent", c.id, change.ID)
+  return nil
+}
+
+// confirmConfig handles the confirmation of a configuration change, in payload, by the device on
+// c logged in as IMEI code.
+func (s *Server) confirmConfig(c *conn, code imei.IMEI, payload []byte) {
+  id, status, err := client.DecodeConfigAck(payload)
+  if err == nil {
+    _, err = s.configs.confirm(code, id, status, time.Now())
+  }
+  if err != nil {
+    s.log.Printf("conn %d: invalid configuration confirmation skipped: %v", c.id, err)
+    return
+  }
+  s.log.Printf("conn %d: configuration change %d %v", c.id, id, status)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+  "encoding/json"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "log"
+  "net/http"
+  "testing"
+  "time"
+)
+
+// configChanges returns the configuration changes of the device with IMEI code, from the admin API.
+func configChanges(t *testing.T, srv *Server, code string) []ConfigChange {
+  response := admin(srv, http.MethodGet, "/admin/config/" + code, "", testAdminToken)
+  if response.Code != http.StatusOK {
+    t.Fatalf("Unable to list configuration changes: status %d", response.Code)
+  }
+  var changes []ConfigChange
+  if err := json.Unmarshal(response.Body.Bytes(), &changes); err != nil {
+    t.Fatalf("Invalid configuration changes: %v", err)
+  }
+  return changes
+}
+
+// nextConfig returns the next configuration change the server sends.
+func nextConfig(t *testing.T, messages *client.MessageReader) (uint32, client.Settings) {
+  typ, payload, err := messages.Next()
+  if err != nil || typ != client.MessageConfig {
+    t.Fatalf("No configuration change: %v %v", typ, err)
+  }
+  id, settings, err := client.DecodeConfig(payload)
+  if err != nil {
+    t.Fatalf("Invalid configuration change: %v", err)
+  }
+  return id, settings
+}
+
+// waitConfigState waits for the only configuration change of client.ValidImei to reach state.
+func waitConfigState(t *testing.T, srv *Server, state ConfigState) {
+  var changes []ConfigChange
+  for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+    changes = configChanges(t, srv, "490154203237518")
+    if len(changes) == 1 && changes[0].State == state {
+      return
+    }
+  }
+  t.Fatalf("Configuration change not %v: %+v", state, changes)
+}
+
+func TestAdminConfigInvalid(t *testing.T) {
+  srv, _, _ := startServer(t, Options{AdminToken: testAdminToken})
+  defer srv.Close()
+
+  for _, body := range []string{
+    `{`,
+    `{}`,
+    `{"reporting_interval_ms": 0}`,
+    `{"reporting_interval_ms": 999}`,
+    `{"sensors": {"bogus": true}}`,
+    `{"ranges": {"Temperature": {"min": 10, "max": -10}}}`,
+  } {
+    response := admin(srv, http.MethodPost, "/admin/config/490154203237518", body,
+        testAdminToken)
+    if response.Code != http.StatusBadRequest {
+      t.Errorf("%s: status %d instead of %d", body, response.Code, http.StatusBadRequest)
+    }
+  }
+  if response := admin(srv, http.MethodPost, "/admin/config/490154203237519",
+      `{"reporting_interval_ms": 1000}`, testAdminToken); response.Code != http.StatusBadRequest {
+    t.Errorf("Invalid IMEI: status %d instead of %d", response.Code, http.StatusBadRequest)
+  }
+  if changes := configChanges(t, srv, "490154203237518"); len(changes) != 0 {
+    t.Errorf("Unexpected changes %+v", changes)
+  }
+}
+
+// The changes pending must be capped per device, and the devices tracked with them.
+func TestConfigQueueBounds(t *testing.T) {
+  q := newConfigQueue()
+  q.maxDevices = 2
+  interval := uint32(client.MIN_REPORTING_INTERVAL)
+  settings := client.Settings{ReportingInterval: &interval}
+
+  for i := 0; i < maxPendingChanges; i++ {
+    if _, err := q.queue(490154203237518, settings); err != nil {
+      t.Fatalf("Change %d: unexpected error %v", i + 1, err)
+    }
+  }
+  if _, err := q.queue(490154203237518, settings); err != ErrTooManyChanges {
+    t.Errorf("Change past the cap: unexpected error %v", err)
+  }
+
+  change, err := q.queue(356938035643809, settings)
+  if err != nil {
+    t.Fatalf("Unexpected error %v", err)
+  }
+  if _, err := q.queue(352099001761481, settings); err != ErrTooManyChanges {
+    t.Errorf("Device past the cap: unexpected error %v", err)
+  }
+  // a device with no change pending makes room
+  q.confirm(356938035643809, change.ID, client.ConfigApplied, time.Now())
+  if _, err := q.queue(352099001761481, settings); err != nil {
+    t.Errorf("Unexpected error %v", err)
+  }
+  if changes := q.list(356938035643809); len(changes) != 0 {
+    t.Errorf("Changes of an evicted device kept: %+v", changes)
+  }
+}
+
+// A change queued while the device is offline must be sent at its next login, until confirmed.
+func TestServerConfigQueued(t *testing.T) {
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{AdminToken: testAdminToken, Logger: log.New(logs, "", 0)})
+  defer srv.Close()
+
+  response := admin(srv, http.MethodPost, "/admin/config/490154203237518",
+      `{"reporting_interval_ms": 5000, "sensors": {"Altitude": false}}`, testAdminToken)
+  if response.Code != http.StatusAccepted {
+    t.Fatalf("Unable to queue change: status %d (%s)", response.Code, response.Body.String())
+  }
+  waitConfigState(t, srv, ConfigQueued)
+
+  // a version 1 device can't take it
+  device, _ := loginDevice(t, srv, 1)
+  waitOnline(t, srv, 1)
+  device.Close()
+  waitConfigState(t, srv, ConfigQueued)
+
+  // sent again at every login, until the device confirms it
+  for login := uint64(2); login <= 3; login++ {
+    device, done := loginDevice(t, srv, login)
+    device.SetDeadline(time.Now().Add(2 * time.Second))
+    if _, err := client.Negotiate(device, client.PROTOCOL_V2); err != nil {
+      t.Fatalf("Unable to negotiate protocol: %v", err)
+    }
+    messages := client.NewMessageReader(device)
+    id, settings := nextConfig(t, messages)
+    if id != 1 || settings.ReportingInterval == nil || *settings.ReportingInterval != 5000 ||
+        len(settings.Sensors) != 1 || settings.Sensors[client.FieldAltitude] {
+      t.Fatalf("Unexpected change %d %+v", id, settings)
+    }
+    waitConfigState(t, srv, ConfigSent)
+    if login == 3 {
+      device.Write(client.AppendMessage(nil, client.MessageConfigAck,
+          client.AppendConfigAck(nil, id, client.ConfigApplied)))
+      waitConfigState(t, srv, ConfigApplied)
+    }
+    device.Close()
+    <-done
+  }
+  waitForLog(t, logs, "configuration change 1 applied")
+
+  // nothing left to send
+  device, _, done := loginV2(t, srv, client.PROTOCOL_V2)
+  device.Write(testReading.EncodeMessage())
+  device.Close()
+  <-done
+  if changes := configChanges(t, srv, "490154203237518"); changes[0].ConfirmedAt == nil {
+    t.Errorf("Unexpected changes %+v", changes)
+  }
+}
+
+// A change queued while the device is online must be sent right away.
+func TestServerConfigOnline(t *testing.T) {
+  srv, _, _ := startServer(t, Options{AdminToken: testAdminToken})
+  defer srv.Close()
+  device, _, _ := loginV2(t, srv, client.PROTOCOL_V2)
+  defer device.Close()
+  waitOnline(t, srv, 1)
+  device.SetDeadline(time.Now().Add(2 * time.Second))
+  messages := client.NewMessageReader(device)
+
+  sent := make(chan uint32, 1)
+  go func() {
+    id, _ := nextConfig(t, messages)
+    sent <- id
+  }()
+  response := admin(srv, http.MethodPost, "/admin/config/490154203237518",
+      `{"ranges": {"Temperature": {"min": -20, "max": 60}}}`, testAdminToken)
+  if response.Code != http.StatusAccepted {
+    t.Fatalf("Unable to queue change: status %d (%s)", response.Code, response.Body.String())
+  }
+  var change ConfigChange
+  if err := json.Unmarshal(response.Body.Bytes(), &change); err != nil || change.ID != <-sent ||
+      change.State != ConfigSent {
+    t.Fatalf("Unexpected change %+v (%v)", change, err)
+  }
+
+  device.Write(client.AppendMessage(nil, client.MessageConfigAck,
+      client.AppendConfigAck(nil, change.ID, client.ConfigRejected)))
+  waitConfigState(t, srv, ConfigRejected)
+}
+
+// The simulator must honour the reporting interval pushed to it.
+func TestClientConfig(t *testing.T) {
+  logs := &syncBuffer{}
+  srv, address, _ := startServer(t, Options{AdminToken: testAdminToken,
+      Logger: log.New(logs, "", 0)})
+  defer srv.Close()
+
+  admin(srv, http.MethodPost, "/admin/config/490154203237518",
+      `{"reporting_interval_ms": 1000}`, testAdminToken)
+  start := time.Now()
+  cfg := client.Config{Address: address, Protocol: client.PROTOCOL_V2}
+  if result := cfg.Connect(client.ValidImei, 0, 3000, 2); result != "OK" {
+    t.Fatalf("Simulator failed: %v\n%s", result, logs.String())
+  }
+  if elapsed := time.Since(start); elapsed > 4 * time.Second {
+    t.Errorf("Reporting interval not applied: took %v", elapsed)
+  }
+  waitConfigState(t, srv, ConfigApplied)
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+  "container/list"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "hash/fnv"
+  "io/ioutil"
+  "path/filepath"
+  "sort"
+  "sync"
+  "time"
+)
+
+var (
+  ErrBadFirmware         = errors.New("server: invalid firmware manifest")
+  ErrUnknownFirmware     = errors.New("server: no firmware image for this model")
+  ErrBadRollout          = errors.New("server: rollout percentage out of 0-100")
+  ErrNotOffered          = errors.New("server: firmware image not offered to the device")
+  ErrUnknownRolloutState = errors.New("server: unknown rollout state")
+)
+
+// DefaultChunkSize is the size of the firmware chunks sent, unless the manifest says otherwise.
+const DefaultChunkSize = 1024
+
+// FirmwareImage is a firmware image hosted for a model of device, as served by the admin API.
+type FirmwareImage struct {
+  // TAC is the Type Allocation Code of the devices the image is for (see imei.IMEI.TAC).
+  TAC     uint32 `json:"tac"`
+  Version uint32 `json:"version"`
+
+  Size      int    `json:"size"`
+  SHA256    string `json:"sha256"`
+  ChunkSize int    `json:"chunk_size"`
+
+  // RolloutPercent is the share of the devices the image is offered to (see Firmware).
+  RolloutPercent int `json:"rollout_percent"`
+
+  data   []byte
+  digest [sha256.Size]byte
+}
+
+// RolloutState is where a device stands in the rollout of a firmware image.
+type RolloutState int
+
+const (
+  // RolloutOffered devices were offered the image, and have not asked for any of it yet.
+  RolloutOffered RolloutState = iota + 1
+
+  // RolloutDownloading devices are downloading the image. They resume where they stopped when
+  // offered the image again.
+  RolloutDownloading
+
+  // RolloutInstalled devices installed the image. They are not offered it again.
+  RolloutInstalled
+
+  // RolloutCorrupted devices received the image whole, but not matching its digest. They start
+  // over at their next login.
+  RolloutCorrupted
+
+  // RolloutDeclined devices did not take the image. They are not offered it again.
+  RolloutDeclined
+)
+
+// String returns the name of the state.
+func (st RolloutState) String() string {
+  switch st {
+  case RolloutOffered:
+    return "offered"
+  case RolloutDownloading:
+    return "downloading"
+  case RolloutInstalled:
+    return "installed"
+  case RolloutCorrupted:
+    return "corrupted"
+  case RolloutDeclined:
+    return "declined"
+  }
+  return "unknown"
+}
+
+// ParseRolloutState returns the state with the given name (as returned by RolloutState.String).
+func ParseRolloutState(name string) (RolloutState, error) {
+  for st := RolloutOffered; st <= RolloutDeclined; st++ {
+    if st.String() == name {
+      return st, nil
+    }
+  }
+  return 0, ErrUnknownRolloutState
+}
+
+// MarshalText returns the name of the state.
+func (st RolloutState) MarshalText() ([]byte, error) {
+  if st < RolloutOffered || st > RolloutDeclined {
+    return nil, ErrUnknownRolloutState
+  }
+  return []byte(st.String()), nil
+}
+
+// UnmarshalText sets the state to the one named text.
+func (st *RolloutState) UnmarshalText(text []byte) (err error) {
+  *st, err = ParseRolloutState(string(text))
+  return err
+}
+
+// DeviceRollout is where a device stands in the rollout of the image for its model, as served by
+// the admin API.
+type DeviceRollout struct {
+  IMEI    imei.IMEI    `json:"imei"`
+  Version uint32       `json:"version"`
+  State   RolloutState `json:"state"`
+
+  // Offset is how much of the image the device acknowledged receiving.
+  Offset int `json:"offset"`
+
+  UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FirmwareRollout is the rollout of a firmware image, as served by the admin API.
+type FirmwareRollout struct {
+  Image   FirmwareImage   `json:"image"`
+  Devices []DeviceRollout `json:"devices"`
+}
+
+// Firmware hosts the firmware images offered to the devices, one per model, and tracks their
+// rollout. It is safe for concurrent use.
+//
+// An image is offered to the devices of its model logging in over protocol v2 or later, in stages:
+// a device is in the first RolloutPercent percent if its bucket (a hash of its IMEI and of the
+// version, so that every version goes first to different devices) is below RolloutPercent. Raising
+// the percentage only adds devices.
+//
+// The rollout states are kept in memory only: after a restart, devices resume their downloads
+// (they keep track of what they received), and report again the versions they run. The same goes
+// for the devices whose state was forgotten to make room for others (see maxRollouts).
+type Firmware struct {
+  mu           sync.RWMutex
+  images       map[uint32]*FirmwareImage   // by TAC
+  rollouts     map[imei.IMEI]*list.Element // of rolloutOrder
+  rolloutOrder *list.List                  // of *DeviceRollout, least recently updated first
+  maxRollouts  int
+}
+
+// maxRollouts is the number of devices whose rollout state is kept: past it, the states least
+// recently updated are forgotten, so that IMEIs made up by the thousand with the TAC of an image
+// can't grow the rollouts without bound.
+const maxRollouts = 10000
+
+// firmwareManifest is the content of a firmware manifest file.
+type firmwareManifest struct {
+  Images []struct {
+    TAC     uint32 `json:"tac"`
+    Version uint32 `json:"version"`
+
+    // File is the path to the image, relative to the manifest.
+    File string `json:"file"`
+
+    ChunkSize      int `json:"chunk_size"`
+    RolloutPercent int `json:"rollout_percent"`
+  } `json:"images"`
+}
+
+// LoadFirmware returns the Firmware hosting the images listed in the manifest file at path, as in:
+//
+//   {"images": [
+//     {"tac": 49015420, "version": 3, "file": "thermo-3.bin", "rollout_percent": 10}
+//   ]}
+//
+// The chunk size defaults to DefaultChunkSize, and the rollout percentage to 0 (offered to no
+// device until raised through the admin API).
+func LoadFirmware(path string) (*Firmware, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var manifest firmwareManifest
+  if err := json.Unmarshal(data, &manifest); err != nil {
+    return nil, fmt.Errorf("%v: %v", ErrBadFirmware, err)
+  }
+
+  f := newFirmware()
+  for i, entry := range manifest.Images {
+    file := entry.File
+    if !filepath.IsAbs(file) {
+      file = filepath.Join(filepath.Dir(path), file)
+    }
+    if _, listed := f.images[entry.TAC]; listed {
+      return nil, fmt.Errorf("%v: image %d: TAC %d listed twice", ErrBadFirmware, i + 1, entry.TAC)
+    }
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+      return nil, fmt.Errorf("%v: image %d: %v", ErrBadFirmware, i + 1, err)
+    }
+    chunkSize := entry.ChunkSize
+    if chunkSize == 0 {
+      chunkSize = DefaultChunkSize
+    }
+    err = f.add(entry.TAC, entry.Version, data, chunkSize, entry.RolloutPercent)
+    if err != nil {
+      return nil, fmt.Errorf("%v: image %d: %v", ErrBadFirmware, i + 1, err)
+    }
+  }
+  return f, nil
+}
+
+// newFirmware returns a Firmware hosting no image.
+func newFirmware() *Firmware {
+  return &Firmware{
+    images:       make(map[uint32]*FirmwareImage),
+    rollouts:     make(map[imei.IMEI]*list.Element),
+    rolloutOrder: list.New(),
+    maxRollouts:  maxRollouts,
+  }
+}
+
+// add hosts image data, of version, for the devices with the given TAC, in place of the image
+// hosted for them so far (if any). It is sent in chunks of chunkSize, to rolloutPercent percent of
+// the devices.
+func (f *Firmware) add(tac uint32, version uint32, data []byte, chunkSize int,
+    rolloutPercent int) error {
+  switch {
+  case tac >= imei.TACLimit:
+    return fmt.Errorf("TAC %d longer than %d digits", tac, imei.TAC_LENGTH)
+  case version == 0:
+    return errors.New("version must be positive")
+  case len(data) == 0 || uint64(len(data)) > 1 << 32 - 1:
+    return errors.New("image empty or too large")
+  case chunkSize <= 0 || chunkSize > client.MAX_FIRMWARE_CHUNK:
+    return fmt.Errorf("chunk size out of 1-%d", client.MAX_FIRMWARE_CHUNK)
+  case rolloutPercent < 0 || rolloutPercent > 100:
+    return ErrBadRollout
+  }
+  image := &FirmwareImage{TAC: tac, Version: version, Size: len(data), ChunkSize: chunkSize,
+      RolloutPercent: rolloutPercent, data: data, digest: sha256.Sum256(data)}
+  image.SHA256 = hex.EncodeToString(image.digest[:])
+
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  f.images[tac] = image
+  return nil
+}
+
+// Images returns the images hosted, sorted by TAC.
+func (f *Firmware) Images() []FirmwareImage {
+  f.mu.RLock()
+  defer f.mu.RUnlock()
+  images := make([]FirmwareImage, 0, len(f.images))
+  for _, image := range f.images {
+    images = append(images, *image)
+  }
+  sort.Slice(images, func(i, j int) bool { return images[i].TAC < images[j].TAC })
+  return images
+}
+
+// Rollout returns the rollout of the image hosted for the devices with the given TAC, the devices
+// sorted by IMEI. It returns ErrUnknownFirmware if there is no such image.
+func (f *Firmware) Rollout(tac uint32) (FirmwareRollout, error) {
+  f.mu.RLock()
+  defer f.mu.RUnlock()
+  image, ok := f.images[tac]
+  if !ok {
+    return FirmwareRollout{}, ErrUnknownFirmware
+  }
+  rollout := FirmwareRollout{Image: *image, Devices: []DeviceRollout{}}
+  for element := f.rolloutOrder.Front(); element != nil; element = element.Next() {
+    device := element.Value.(*DeviceRollout)
+    if device.IMEI.TAC() == tac && device.Version == image.Version {
+      rollout.Devices = append(rollout.Devices, *device)
+    }
+  }
+  sort.Slice(rollout.Devices, func(i, j int) bool {
+    return rollout.Devices[i].IMEI < rollout.Devices[j].IMEI
+  })
+  return rollout, nil
+}
+
+// SetRolloutPercent offers the image hosted for the devices with the given TAC to percent percent
+// of them, from their next login. It returns the image, or ErrUnknownFirmware if there is none, or
+// ErrBadRollout.
+func (f *Firmware) SetRolloutPercent(tac uint32, percent int) (FirmwareImage, error) {
+  if percent < 0 || percent > 100 {
+    return FirmwareImage{}, ErrBadRollout
+  }
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  image, ok := f.images[tac]
+  if !ok {
+    return FirmwareImage{}, ErrUnknownFirmware
+  }
+  image.RolloutPercent = percent
+  return *image, nil
+}
+
+// Device returns where the device with IMEI code stands in the rollout of the latest image offered
+// to it, if any.
+func (f *Firmware) Device(code imei.IMEI) (DeviceRollout, bool) {
+  f.mu.RLock()
+  defer f.mu.RUnlock()
+  element, ok := f.rollouts[code]
+  if !ok {
+    return DeviceRollout{}, false
+  }
+  return *element.Value.(*DeviceRollout), true
+}
+
+// rollout returns the rollout state of the device with IMEI code, or nil, and marks it as the most
+// recently updated. The caller holds f.mu for writing.
+func (f *Firmware) rollout(code imei.IMEI) *DeviceRollout {
+  element, ok := f.rollouts[code]
+  if !ok {
+    return nil
+  }
+  f.rolloutOrder.MoveToBack(element)
+  return element.Value.(*DeviceRollout)
+}
+
+// track starts keeping the rollout state device, forgetting the least recently updated one if
+// there are too many. The caller holds f.mu for writing.
+func (f *Firmware) track(device *DeviceRollout) {
+  if element, ok := f.rollouts[device.IMEI]; ok {
+    element.Value = device
+    f.rolloutOrder.MoveToBack(element)
+    return
+  }
+  f.rollouts[device.IMEI] = f.rolloutOrder.PushBack(device)
+  if f.rolloutOrder.Len() > f.maxRollouts {
+    oldest := f.rolloutOrder.Remove(f.rolloutOrder.Front()).(*DeviceRollout)
+    delete(f.rollouts, oldest.IMEI)
+  }
+}
+
+// rolloutBucket returns the bucket of the device with IMEI code in the rollout of version, from 0
+// to 99.
+func rolloutBucket(code imei.IMEI, version uint32) int {
+  var b [12]byte
+  binary.BigEndian.PutUint64(b[0:8], uint64(code))
+  binary.BigEndian.PutUint32(b[8:12], version)
+  h := fnv.New32a()
+  h.Write(b[:])
+  return int(h.Sum32() % 100)
+}
+
+// offer returns the offer to make to the device with IMEI code, if any, and records it. The
+// devices that installed or declined the image are not offered it again. A nil *Firmware offers
+// nothing.
+func (f *Firmware) offer(code imei.IMEI) (client.FirmwareOffer, bool) {
+  if f == nil {
+    return client.FirmwareOffer{}, false
+  }
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  image, ok := f.images[code.TAC()]
+  if !ok || rolloutBucket(code, image.Version) >= image.RolloutPercent {
+    return client.FirmwareOffer{}, false
+  }
+  device := f.rollout(code)
+  if device == nil || device.Version != image.Version {
+    device = &DeviceRollout{IMEI: code, Version: image.Version, State: RolloutOffered}
+    f.track(device)
+  }
+  switch device.State {
+  case RolloutInstalled, RolloutDeclined:
+    return client.FirmwareOffer{}, false
+  case RolloutCorrupted:
+    device.State, device.Offset = RolloutOffered, 0
+  }
+  device.UpdatedAt = time.Now()
+  return client.FirmwareOffer{Version: image.Version, Size: uint32(image.Size),
+      ChunkSize: uint16(image.ChunkSize), Digest: image.digest}, true
+}
+
+// chunk returns the chunk at offset of image version, asked for by the device with IMEI code, and
+// records that the device received everything before offset. It returns ErrNotOffered if the
+// device was not offered that image (or offset is past its end).
+func (f *Firmware) chunk(code imei.IMEI, version uint32, offset uint32) ([]byte, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  image := f.images[code.TAC()]
+  device := f.rollout(code)
+  if image == nil || device == nil || device.Version != version || image.Version != version ||
+      int(offset) >= image.Size {
+    return nil, ErrNotOffered
+  }
+  device.State = RolloutDownloading
+  device.Offset = int(offset)
+  device.UpdatedAt = time.Now()
+  end := int(offset) + image.ChunkSize
+  if end > image.Size {
+    end = image.Size
+  }
+  return image.data[offset:end], nil
+}
+
+// report records the outcome of the update to image version reported by the device with IMEI
+// code, and returns where the device stands. It returns ErrNotOffered if the device was not
+// offered that image.
+func (f *Firmware) report(code imei.IMEI, version uint32, status client.FirmwareStatus) (
+    DeviceRollout, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  device := f.rollout(code)
+  if device == nil || device.Version != version {
+    return DeviceRollout{}, ErrNotOffered
+  }
+  switch status {
+  case client.FirmwareInstalled:
+    device.State = RolloutInstalled
+    if image := f.images[code.TAC()]; image != nil && image.Version == version {
+      device.Offset = image.Size
+    }
+  case client.FirmwareCorrupted:
+    device.State = RolloutCorrupted
+  default:
+    device.State = RolloutDeclined
+  }
+  device.UpdatedAt = time.Now()
+  return *device, nil
+}
+
+// offerFirmware offers the device on c, logged in as IMEI code, the firmware update it is eligible
+// for, if any.
+func (s *Server) offerFirmware(c *conn, code imei.IMEI) error {
+  offer, ok := s.opts.Firmware.offer(code)
+  if !ok {
+    return nil
+  }
+  if err := c.send(client.MessageFirmwareOffer, client.AppendFirmwareOffer(nil, offer),
+      s.opts.ReadingTimeout); err != nil {
+    return err
+  }
+  s.log.Printf("conn %d: firmware v%d offered", c.id, offer.Version)
+  return nil
+}
+
+// sendFirmwareChunk answers the request for a firmware chunk, in payload, from the device on c
+// logged in as IMEI code. Invalid requests are logged and skipped: only failing to send the chunk
+// is an error.
+func (s *Server) sendFirmwareChunk(c *conn, code imei.IMEI, payload []byte) error {
+  version, offset, err := client.DecodeFirmwareRequest(payload)
+  var data []byte
+  if err == nil && s.opts.Firmware != nil {
+    data, err = s.opts.Firmware.chunk(code, version, offset)
+  } else if err == nil {
+    err = ErrNotOffered
+  }
+  if err != nil {
+    s.log.Printf("conn %d: invalid firmware request skipped: %v", c.id, err)
+    return nil
+  }
+  return c.send(client.MessageFirmwareChunk, client.AppendFirmwareChunk(nil, version, offset,
+      data), s.opts.ReadingTimeout)
+}
+
+// reportFirmware handles the outcome of a firmware update, in payload, reported by the device on c
+// logged in as IMEI code.
+func (s *Server) reportFirmware(c *conn, code imei.IMEI, payload []byte) {
+  version, status, err := client.DecodeFirmwareStatus(payload)
+  if err == nil && s.opts.Firmware != nil {
+    _, err = s.opts.Firmware.report(code, version, status)
+  } else if err == nil {
+    err = ErrNotOffered
+  }
+  if err != nil {
+    s.log.Printf("conn %d: invalid firmware report skipped: %v", c.id, err)
+    return
+  }
+  s.log.Printf("conn %d: firmware v%d %v", c.id, version, status)
+}
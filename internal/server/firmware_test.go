@@ -0,0 +1,273 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "log"
+  "math/rand"
+  "net"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testFirmware returns a Firmware hosting image, version 3, for client.ValidImei's model, in 4-byte
+// chunks, rolled out to every device.
+func testFirmware(t *testing.T, image []byte) *Firmware {
+  f := newFirmware()
+  if err := f.add(49015420, 3, image, 4, 100); err != nil {
+    t.Fatalf("Unable to add image: %v", err)
+  }
+  return f
+}
+
+func TestLoadFirmware(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thermomatic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  ioutil.WriteFile(filepath.Join(dir, "thermo-3.bin"), []byte("firmware"), 0644)
+
+  cases := []struct {
+    manifest string
+    err      string
+  }{
+    {`{"images": [{"tac": 49015420, "version": 3, "file": "thermo-3.bin",
+        "rollout_percent": 10}]}`, ""},
+    {`{"images": [`, "server: invalid firmware manifest: unexpected end of JSON input"},
+    {`{"images": [{"tac": 49015420, "version": 3, "file": "thermo-4.bin"}]}`, "thermo-4.bin"},
+    {`{"images": [{"tac": 49015420, "file": "thermo-3.bin"}]}`,
+        "image 1: version must be positive"},
+    {`{"images": [{"tac": 49015420, "version": 3, "file": "thermo-3.bin", "chunk_size": 5000}]}`,
+        "chunk size out of"},
+    {`{"images": [{"tac": 49015420, "version": 3, "file": "thermo-3.bin",
+        "rollout_percent": 101}]}`, ErrBadRollout.Error()},
+    {`{"images": [{"tac": 49015420, "version": 3, "file": "thermo-3.bin"},
+        {"tac": 49015420, "version": 4, "file": "thermo-3.bin"}]}`,
+        "image 2: TAC 49015420 listed twice"},
+  }
+  path := filepath.Join(dir, "firmware.json")
+  for _, c := range cases {
+    ioutil.WriteFile(path, []byte(c.manifest), 0644)
+    f, err := LoadFirmware(path)
+    if c.err == "" {
+      images := []FirmwareImage(nil)
+      if err == nil {
+        images = f.Images()
+      }
+      if err != nil || len(images) != 1 || images[0].Size != 8 || images[0].RolloutPercent != 10 ||
+          images[0].ChunkSize != DefaultChunkSize || len(images[0].SHA256) != 64 {
+        t.Errorf("%s: unexpected images %+v (%v)", c.manifest, images, err)
+      }
+    } else if err == nil || !strings.Contains(err.Error(), c.err) {
+      t.Errorf("%s: unexpected error %v", c.manifest, err)
+    }
+  }
+}
+
+// Raising the rollout percentage must offer the image to more devices, never fewer.
+func TestFirmwareRolloutStages(t *testing.T) {
+  f := newFirmware()
+  f.add(49015420, 3, []byte("firmware"), 4, 0)
+  rng := rand.New(rand.NewSource(1))
+  devices := make([]imei.IMEI, 1000)
+  for i := range devices {
+    devices[i] = imei.RandomWithTAC(rng, 49015420)
+  }
+
+  offered := make(map[imei.IMEI]bool)
+  for _, percent := range []int{0, 30, 100} {
+    f.SetRolloutPercent(49015420, percent)
+    n := 0
+    for _, code := range devices {
+      if _, ok := f.offer(code); ok {
+        n++
+        offered[code] = true
+      } else if offered[code] {
+        t.Errorf("%d%%: IMEI %v no longer offered the image", percent, code)
+      }
+    }
+    if n < percent * 10 - 50 || n > percent * 10 + 50 {
+      t.Errorf("%d%%: image offered to %d device(s) out of 1000", percent, n)
+    }
+  }
+
+  // another model gets nothing
+  if _, ok := f.offer(imei.RandomWithTAC(rng, 35693803)); ok {
+    t.Errorf("Image offered to another model")
+  }
+}
+
+// Only the rollout states of the devices updated last must be kept, however many IMEIs log in.
+func TestFirmwareRolloutsBound(t *testing.T) {
+  f := newFirmware()
+  f.maxRollouts = 100
+  f.add(49015420, 3, []byte("firmware"), 4, 100)
+  rng := rand.New(rand.NewSource(1))
+  first := imei.RandomWithTAC(rng, 49015420)
+  f.offer(first)
+  for i := 0; i < 3 * f.maxRollouts; i++ {
+    f.offer(imei.RandomWithTAC(rng, 49015420))
+    f.report(first, 3, client.FirmwareDeclined) // keeps it the most recently updated
+  }
+
+  rollout, err := f.Rollout(49015420)
+  if err != nil || len(f.rollouts) != f.maxRollouts || f.rolloutOrder.Len() != f.maxRollouts ||
+      len(rollout.Devices) != f.maxRollouts {
+    t.Errorf("%d rollout state(s) kept, %d served (%v)", len(f.rollouts), len(rollout.Devices),
+        err)
+  }
+  if device, ok := f.Device(first); !ok || device.State != RolloutDeclined {
+    t.Errorf("Most recently updated device forgotten: %+v", device)
+  }
+}
+
+// loginFirmware logs in client.ValidImei on conn id, over protocol v2, and returns the device's end
+// of the connection with the reader of the messages the server sends.
+func loginFirmware(t *testing.T, srv *Server, id uint64) (net.Conn, *client.MessageReader,
+    chan struct{}) {
+  device, done := loginDevice(t, srv, id)
+  device.SetDeadline(time.Now().Add(2 * time.Second))
+  if _, err := client.Negotiate(device, client.PROTOCOL_V2); err != nil {
+    t.Fatalf("Unable to negotiate protocol: %v", err)
+  }
+  return device, client.NewMessageReader(device), done
+}
+
+// requestChunk asks for the firmware chunk at offset, and returns it.
+func requestChunk(t *testing.T, device net.Conn, messages *client.MessageReader,
+    offset uint32) []byte {
+  device.Write(client.AppendMessage(nil, client.MessageFirmwareRequest,
+      client.AppendFirmwareRequest(nil, 3, offset)))
+  typ, payload, err := messages.Next()
+  if err != nil || typ != client.MessageFirmwareChunk {
+    t.Fatalf("No firmware chunk: %v %v", typ, err)
+  }
+  version, at, data, err := client.DecodeFirmwareChunk(payload)
+  if err != nil || version != 3 || at != offset {
+    t.Fatalf("Invalid firmware chunk: v%d at %d (%v)", version, at, err)
+  }
+  return data
+}
+
+// An update interrupted must resume where the device stopped, and not be offered again once
+// installed.
+func TestServerFirmwareUpdate(t *testing.T) {
+  logs := &syncBuffer{}
+  image := []byte("0123456789")
+  srv, _, _ := startServer(t, Options{Firmware: testFirmware(t, image),
+      Logger: log.New(logs, "", 0)})
+  defer srv.Close()
+
+  var received []byte
+  for id := uint64(1); id <= 2; id++ {
+    device, messages, done := loginFirmware(t, srv, id)
+    typ, payload, err := messages.Next()
+    if err != nil || typ != client.MessageFirmwareOffer {
+      t.Fatalf("No firmware offer: %v %v", typ, err)
+    }
+    offer, err := client.DecodeFirmwareOffer(payload)
+    if err != nil || offer.Version != 3 || offer.Size != 10 || offer.ChunkSize != 4 {
+      t.Fatalf("Unexpected offer %+v (%v)", offer, err)
+    }
+
+    for len(received) < len(image) {
+      received = append(received, requestChunk(t, device, messages, uint32(len(received)))...)
+      if id == 1 && len(received) == 8 {
+        break
+      }
+    }
+    if id == 2 {
+      device.Write(client.AppendMessage(nil, client.MessageFirmwareStatus,
+          client.AppendFirmwareStatus(nil, 3, client.FirmwareInstalled)))
+    }
+    device.Close()
+    <-done
+
+    rollout, _ := srv.opts.Firmware.Device(490154203237518)
+    if id == 1 && (rollout.State != RolloutDownloading || rollout.Offset != 4) ||
+        id == 2 && (rollout.State != RolloutInstalled || rollout.Offset != 10) {
+      t.Errorf("Login %d: unexpected rollout %+v", id, rollout)
+    }
+  }
+  if string(received) != string(image) {
+    t.Errorf("Received image %q", received)
+  }
+
+  // not offered once installed
+  device, _, done := loginFirmware(t, srv, 3)
+  device.Write(testReading.EncodeMessage())
+  device.Close()
+  <-done
+  waitForLog(t, logs, "conn 2: firmware v3 installed")
+  if n := strings.Count(logs.String(), "firmware v3 offered"); n != 2 {
+    t.Errorf("Image offered %d time(s)", n)
+  }
+}
+
+func TestAdminFirmware(t *testing.T) {
+  srv, _, _ := startServer(t, Options{AdminToken: testAdminToken})
+  defer srv.Close()
+  response := admin(srv, http.MethodGet, "/admin/firmware", "", testAdminToken)
+  if response.Code != http.StatusNotFound {
+    t.Errorf("Firmware not enabled: status %d", response.Code)
+  }
+
+  srv, _, _ = startServer(t, Options{AdminToken: testAdminToken,
+      Firmware: testFirmware(t, []byte("firmware"))})
+  defer srv.Close()
+  cases := []struct {
+    method string
+    path   string
+    body   string
+    status int
+  }{
+    {http.MethodGet, "/admin/firmware", "", http.StatusOK},
+    {http.MethodGet, "/admin/firmware/49015420", "", http.StatusOK},
+    {http.MethodGet, "/admin/firmware/35693803", "", http.StatusNotFound},
+    {http.MethodGet, "/admin/firmware/bogus", "", http.StatusBadRequest},
+    {http.MethodPut, "/admin/firmware/49015420", `{"rollout_percent": 25}`, http.StatusOK},
+    {http.MethodPut, "/admin/firmware/49015420", `{"rollout_percent": 250}`, http.StatusBadRequest},
+    {http.MethodPut, "/admin/firmware/49015420", `{}`, http.StatusBadRequest},
+    {http.MethodPut, "/admin/firmware/35693803", `{"rollout_percent": 25}`, http.StatusNotFound},
+    {http.MethodDelete, "/admin/firmware/49015420", "", http.StatusMethodNotAllowed},
+  }
+  for _, c := range cases {
+    response := admin(srv, c.method, c.path, c.body, testAdminToken)
+    if response.Code != c.status {
+      t.Errorf("%v %v %s: status %d instead of %d (%s)", c.method, c.path, c.body, response.Code,
+          c.status, response.Body.String())
+    }
+  }
+  if images := srv.opts.Firmware.Images(); images[0].RolloutPercent != 25 {
+    t.Errorf("Rollout not staged: %+v", images)
+  }
+}
+
+// The simulator must download and install the update offered.
+func TestClientFirmware(t *testing.T) {
+  image := make([]byte, 5000)
+  rand.New(rand.NewSource(1)).Read(image)
+  srv, address, _ := startServer(t, Options{Firmware: testFirmware(t, image)})
+  defer srv.Close()
+
+  firmware := &client.Firmware{Version: 1}
+  cfg := client.Config{Address: address, Protocol: client.PROTOCOL_V2, Firmware: firmware}
+  if result := cfg.Connect(client.ValidImei, 0, 10, 2); result != "OK" {
+    t.Fatalf("Simulator failed: %v", result)
+  }
+  if firmware.Version != 3 {
+    t.Errorf("Update not installed: %+v", firmware)
+  }
+  for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+    if rollout, _ := srv.opts.Firmware.Device(490154203237518); rollout.State == RolloutInstalled {
+      return
+    }
+  }
+  t.Errorf("Update not reported")
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+  "bufio"
+  "errors"
+  "io"
+)
+
+var (
+  ErrShortFrame = errors.New("server: connection closed in the middle of a message")
+)
+
+// Size of the buffer sitting between a device connection and its framer. It holds many Readings,
+// so a device's stream is read with few system calls.
+const framerBufferSize = 4096
+
+// framer splits the byte stream of a device connection into fixed-size messages (frames).
+//
+// TCP does not preserve message boundaries: a frame may arrive split over several segments, and
+// several frames (e.g. the login and the first Reading) may arrive in a single one. The framer
+// buffers the stream and hands out exactly one frame at a time, whatever way it was cut up.
+type framer struct {
+  reader *bufio.Reader
+
+  // pending is the size of the frame last handed out, still to be discarded from reader.
+  pending int
+}
+
+// newFramer returns a framer reading from r.
+func newFramer(r io.Reader) *framer {
+  return &framer{reader: bufio.NewReaderSize(r, framerBufferSize)}
+}
+
+// next returns the next frame of exactly size bytes. The caller sets the connection's read deadline
+// beforehand, so it applies to the frame as a whole rather than to each read.
+//
+// The returned slice points into the framer's buffer: it is only valid until the next call to next.
+// next does not allocate.
+//
+// If the connection ends cleanly before the frame starts, next returns io.EOF. If it ends part-way
+// through the frame, next returns ErrShortFrame. Any other error (e.g. a timeout) is returned as is.
+func (f *framer) next(size int) ([]byte, error) {
+  // Release the previous frame now that the caller is done with it.
+  if f.pending > 0 {
+    f.reader.Discard(f.pending)
+    f.pending = 0
+  }
+
+  frame, err := f.reader.Peek(size)
+  if err != nil {
+    if err == io.EOF && len(frame) > 0 {
+      return nil, ErrShortFrame
+    }
+    return nil, err
+  }
+
+  f.pending = size
+  return frame, nil
+}
+
+// peek returns the next size bytes without consuming them, for messages whose length is only known
+// once they are decoded (i.e. the login). If the stream stops short of size bytes, peek returns
+// the bytes it got along with the error that stopped it (ErrShortFrame if the connection ended
+// part-way, io.EOF if it ended before the first byte). The caller then consumes the message found
+// at the start of the bytes with take.
+//
+// The returned slice points into the framer's buffer: it is only valid until the next call to next
+// or peek. peek does not allocate.
+func (f *framer) peek(size int) ([]byte, error) {
+  if f.pending > 0 {
+    f.reader.Discard(f.pending)
+    f.pending = 0
+  }
+
+  frame, err := f.reader.Peek(size)
+  if err == io.EOF && len(frame) > 0 {
+    err = ErrShortFrame
+  }
+  return frame, err
+}
+
+// buffered returns the bytes read ahead from the stream, up to max, without consuming them nor
+// reading any more. Like that of peek, the returned slice is only valid until the next call to
+// next or peek, and consumed with take.
+func (f *framer) buffered(max int) []byte {
+  if f.pending > 0 {
+    f.reader.Discard(f.pending)
+    f.pending = 0
+  }
+
+  size := f.reader.Buffered()
+  if size > max {
+    size = max
+  }
+  frame, _ := f.reader.Peek(size)
+  return frame
+}
+
+// unread returns the number of bytes read ahead from the stream and not handed out yet.
+func (f *framer) unread() int {
+  return f.reader.Buffered() - f.pending
+}
+
+// take consumes the first size bytes returned by peek as a frame, released by the next call to
+// next or peek.
+func (f *framer) take(size int) {
+  f.pending = size
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+  "bytes"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io"
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testReading is the Reading from the README's output format example.
+var testReading = client.Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41,
+    Longitude: 44.4, BatteryLevel: 0.25666}
+
+// testStream returns a login followed by count copies of testReading, as a device would send them.
+func testStream(count int) []byte {
+  stream := append([]byte{}, client.ValidImei...)
+  for i := 0; i < count; i++ {
+    stream = append(stream, testReading.Encode()...)
+  }
+  return stream
+}
+
+// checkFrames reads a login and count Readings from f and compares them with testStream(count).
+func checkFrames(t *testing.T, f *framer, count int) {
+  frame, err := f.next(imei.IMEI_LENGTH)
+  if err != nil {
+    t.Fatalf("Unable to read login frame: %v", err)
+  }
+  if !bytes.Equal(frame, client.ValidImei) {
+    t.Errorf("Unexpected login frame %v", frame)
+  }
+
+  encoded := testReading.Encode()
+  for i := 0; i < count; i++ {
+    frame, err := f.next(client.READING_LENGTH)
+    if err != nil {
+      t.Fatalf("Unable to read Reading frame #%d: %v", i, err)
+    }
+    if !bytes.Equal(frame, encoded) {
+      t.Errorf("Unexpected Reading frame #%d: %x", i, frame)
+    }
+  }
+}
+
+// Frames written one byte at a time must be reassembled.
+func TestFramerByteByByte(t *testing.T) {
+  device, server := net.Pipe()
+  defer server.Close()
+
+  go func() {
+    defer device.Close()
+    for _, b := range testStream(3) {
+      if _, err := device.Write([]byte{b}); err != nil {
+        return
+      }
+    }
+  }()
+
+  f := newFramer(server)
+  checkFrames(t, f, 3)
+  if _, err := f.next(client.READING_LENGTH); err != io.EOF {
+    t.Errorf("Expected io.EOF at end of stream, got %v", err)
+  }
+}
+
+// Several frames written at once (e.g. a login coalesced with Readings) must be split up.
+func TestFramerCoalesced(t *testing.T) {
+  device, server := net.Pipe()
+  defer server.Close()
+
+  go func() {
+    defer device.Close()
+    device.Write(testStream(5))
+  }()
+
+  f := newFramer(server)
+  checkFrames(t, f, 5)
+  if _, err := f.next(client.READING_LENGTH); err != io.EOF {
+    t.Errorf("Expected io.EOF at end of stream, got %v", err)
+  }
+}
+
+// Frames split at arbitrary points across writes must be reassembled.
+func TestFramerSplitChunks(t *testing.T) {
+  device, server := net.Pipe()
+  defer server.Close()
+
+  go func() {
+    defer device.Close()
+    stream := testStream(4)
+    for len(stream) > 0 {
+      chunk := 17
+      if chunk > len(stream) {
+        chunk = len(stream)
+      }
+      if _, err := device.Write(stream[:chunk]); err != nil {
+        return
+      }
+      stream = stream[chunk:]
+    }
+  }()
+
+  checkFrames(t, newFramer(server), 4)
+}
+
+// A connection closed part-way through a frame must be reported as ErrShortFrame.
+func TestFramerShortFrame(t *testing.T) {
+  device, server := net.Pipe()
+  defer server.Close()
+
+  go func() {
+    defer device.Close()
+    stream := testStream(1)
+    device.Write(stream[:len(stream)-1])
+  }()
+
+  f := newFramer(server)
+  if _, err := f.next(imei.IMEI_LENGTH); err != nil {
+    t.Fatalf("Unable to read login frame: %v", err)
+  }
+  if _, err := f.next(client.READING_LENGTH); err != ErrShortFrame {
+    t.Errorf("Expected ErrShortFrame, got %v", err)
+  }
+}
+
+// The read deadline must apply to the whole frame: a frame trickling in too slowly times out.
+func TestFramerDeadline(t *testing.T) {
+  device, server := net.Pipe()
+  defer server.Close()
+  defer device.Close()
+
+  go device.Write(client.ValidImei[:5])
+
+  server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+  _, err := newFramer(server).next(imei.IMEI_LENGTH)
+  if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+    t.Errorf("Expected a timeout, got %v", err)
+  }
+}
+
+// serveConn hands netConn to srv as if it had been accepted by a listener.
+func serveConn(t *testing.T, srv *Server, netConn net.Conn) chan struct{} {
+  c := &conn{id: 1, netConn: netConn}
+  if err := srv.trackConn(c); err != nil {
+    t.Fatalf("Unable to track connection: %v", err)
+  }
+  done := make(chan struct{})
+  go func() {
+    srv.handleConnection(c)
+    close(done)
+  }()
+  return done
+}
+
+// A login coalesced with the Readings that follow it must not lose or corrupt any of them.
+func TestServerCoalescedLogin(t *testing.T) {
+  records := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Output: records})
+  defer srv.Close()
+
+  device, server := net.Pipe()
+  done := serveConn(t, srv, server)
+
+  device.Write(testStream(3))
+  device.Close()
+  <-done
+
+  if got := strings.Count(records.String(), ",67.77,2.63555,33.41,44.4,0.25666\n"); got != 3 {
+    t.Errorf("Expected 3 records, got %d (output %q)", got, records.String())
+  }
+}
+
+func BenchmarkFramerNext(b *testing.B) {
+  b.ReportAllocs()
+  reading := testReading.Encode()
+  stream := bytes.Repeat(reading, 1024)
+  reader := bytes.NewReader(stream)
+  f := newFramer(reader)
+
+  for i := 0; i < b.N; i++ {
+    if _, err := f.next(client.READING_LENGTH); err != nil {
+      reader.Reset(stream)
+      f.pending = 0
+      f.reader.Reset(reader)
+    }
+  }
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+  "encoding/json"
+  "fmt"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "net"
+  "net/http"
+  "strings"
+  "time"
+)
+
+// Handler returns the HTTP handler serving the server's endpoints:
+//
+//   GET /stats            runtime and ingest statistics (see Stats)
+//   GET /readings/:imei   last Reading of an online device (see LastReading)
+//   GET /status/:imei     whether a device is online, and since when (see DeviceStatus)
+//   /admin/...            admin endpoints, only served with an AdminToken (see adminHandler)
+func (s *Server) Handler() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/stats", s.handleStats)
+  mux.HandleFunc("/readings/", s.handleReadings)
+  mux.HandleFunc("/status/", s.handleStatus)
+  if s.opts.AdminToken != "" {
+    mux.Handle("/admin/", s.adminHandler())
+  }
+  return mux
+}
+
+// LastReading is the JSON document served by the /readings/:imei endpoint.
+type LastReading struct {
+  // IMEI is the device's IMEI, as 15 decimal digits.
+  IMEI imei.IMEI `json:"imei"`
+
+  // ReceivedAt is when the Reading was received.
+  ReceivedAt time.Time `json:"received_at"`
+
+  // Timestamp is ReceivedAt in nanoseconds since the Unix epoch, as in the output records.
+  Timestamp int64 `json:"timestamp"`
+
+  client.Reading
+}
+
+// DeviceStatus is the JSON document served by the /status/:imei endpoint.
+//
+// For an online device it describes the current connection. For an offline device seen since the
+// server started it describes the last connection and why it was closed. The optional fields are
+// left out when unknown.
+type DeviceStatus struct {
+  // IMEI is the device's IMEI, as 15 decimal digits.
+  IMEI imei.IMEI `json:"imei"`
+
+  // Online reports whether the device is logged in.
+  Online bool `json:"online"`
+
+  // SoftwareVersion is the 2-digit software version number of the IMEISV the device logged in
+  // with (on its last connection), left out if it logged in with a plain IMEI.
+  SoftwareVersion string `json:"software_version,omitempty"`
+
+  // Protocol is the version of the wire protocol spoken on the (last) connection, left out until
+  // it is negotiated.
+  Protocol int `json:"protocol,omitempty"`
+
+  // ConnectedAt is when the (last) connection was established.
+  ConnectedAt *time.Time `json:"connected_at,omitempty"`
+
+  // RemoteAddr is the network address the device connects (or last connected) from.
+  RemoteAddr string `json:"remote_addr,omitempty"`
+
+  // Readings is the number of Readings received on the (last) connection.
+  Readings uint64 `json:"readings"`
+
+  // LastReadingAt is when the last valid Reading of the (last) connection was received.
+  LastReadingAt *time.Time `json:"last_reading_at,omitempty"`
+
+  // Provisioning is the device's provisioning state, left out if the server does not provision
+  // devices or the device is not registered.
+  Provisioning string `json:"provisioning,omitempty"`
+
+  // DisconnectedAt is when an offline device's last connection was closed.
+  DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
+
+  // DisconnectCause classifies why an offline device's last connection was closed: "timeout",
+  // "eof", "reset", "invalid data", "kicked", "shutdown" or "error".
+  DisconnectCause string `json:"disconnect_cause,omitempty"`
+
+  // DisconnectReason is the detailed reason an offline device's last connection was closed for.
+  DisconnectReason string `json:"disconnect_reason,omitempty"`
+}
+
+// serveHTTP serves the HTTP endpoints on link until the server is shut down.
+func (s *Server) serveHTTP(link net.Listener) {
+  httpServer := &http.Server{Handler: s.Handler(), ErrorLog: s.log}
+
+  s.mu.Lock()
+  if s.closing {
+    s.mu.Unlock()
+    link.Close()
+    return
+  }
+  s.httpServer = httpServer
+  s.mu.Unlock()
+
+  s.log.Printf("Serving HTTP on %v", link.Addr())
+  go func() {
+    if err := httpServer.Serve(link); err != http.ErrServerClosed {
+      s.log.Printf("HTTP server stopped: %v", err)
+    }
+  }()
+}
+
+// handleStats serves GET /stats.
+func (s *Server) handleStats(w http.ResponseWriter, req *http.Request) {
+  if !allowGet(w, req) {
+    return
+  }
+  writeJSON(w, http.StatusOK, s.Stats())
+}
+
+// handleReadings serves GET /readings/:imei. It replies 400 Bad Request if the IMEI is malformed,
+// and 404 Not Found if the device is offline or has not sent a valid Reading yet.
+func (s *Server) handleReadings(w http.ResponseWriter, req *http.Request) {
+  if !allowGet(w, req) {
+    return
+  }
+  code, ok := imeiFromPath(w, req.URL.Path, "/readings/")
+  if !ok {
+    return
+  }
+
+  device, online := s.registry.lookup(code)
+  if !online {
+    writeError(w, http.StatusNotFound, "device offline")
+    return
+  }
+  if device.LastReadingAt.IsZero() {
+    writeError(w, http.StatusNotFound, "no reading received yet")
+    return
+  }
+  writeJSON(w, http.StatusOK, LastReading{
+    IMEI:       code,
+    ReceivedAt: device.LastReadingAt,
+    Timestamp:  device.LastReadingAt.UnixNano(),
+    Reading:    device.LastReading,
+  })
+}
+
+// handleStatus serves GET /status/:imei. It replies 400 Bad Request if the IMEI is malformed.
+// Devices never seen since startup (or whose departure was forgotten) are simply reported offline.
+func (s *Server) handleStatus(w http.ResponseWriter, req *http.Request) {
+  if !allowGet(w, req) {
+    return
+  }
+  code, ok := imeiFromPath(w, req.URL.Path, "/status/")
+  if !ok {
+    return
+  }
+
+  status := DeviceStatus{IMEI: code}
+  if s.opts.Provisioning != nil {
+    if provisioned, registered := s.opts.Provisioning.Lookup(code); registered {
+      status.Provisioning = provisioned.State.String()
+    }
+  }
+  device, online := s.registry.lookup(code)
+  if online {
+    status.Online = true
+  } else {
+    departure, seen := s.registry.departure(code)
+    if !seen {
+      writeJSON(w, http.StatusOK, status)
+      return
+    }
+    device = departure.Device
+    status.DisconnectedAt = &departure.DisconnectedAt
+    status.DisconnectCause = disconnectCause(departure.Reason)
+    if departure.Reason != nil {
+      status.DisconnectReason = departure.Reason.Error()
+    }
+  }
+
+  if device.SoftwareVersion != imei.NoSoftwareVersion {
+    status.SoftwareVersion = fmt.Sprintf("%02d", device.SoftwareVersion)
+  }
+  status.Protocol = device.Protocol
+  status.ConnectedAt = &device.ConnectedAt
+  status.RemoteAddr = device.RemoteAddr
+  status.Readings = device.Readings
+  if !device.LastReadingAt.IsZero() {
+    status.LastReadingAt = &device.LastReadingAt
+  }
+  writeJSON(w, http.StatusOK, status)
+}
+
+// disconnectCause classifies the reason a connection was closed for.
+func disconnectCause(reason error) string {
+  switch reason {
+  case ErrReadingTimeout, ErrImeiTimeout, ErrWriteTimeout:
+    return "timeout"
+  case ErrDisconnected, ErrShortFrame:
+    // the device hung up, possibly part-way through a message
+    return "eof"
+  case ErrPeerReset:
+    return "reset"
+  case client.ErrBadHello, client.ErrMessageLength, client.ErrMessageChecksum, client.ErrBadBatch:
+    return "invalid data"
+  case ErrKicked:
+    return "kicked"
+  case ErrServerClosed:
+    return "shutdown"
+  }
+  return "error"
+}
+
+// imeiFromPath returns the IMEI code following prefix in path. If it is malformed, imeiFromPath
+// replies 400 Bad Request and returns false.
+func imeiFromPath(w http.ResponseWriter, path string, prefix string) (imei.IMEI, bool) {
+  code, err := imei.Parse(strings.TrimPrefix(path, prefix))
+  if err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return 0, false
+  }
+  return code, true
+}
+
+// allowGet replies 405 Method Not Allowed (returning false) unless req is a GET or HEAD request.
+func allowGet(w http.ResponseWriter, req *http.Request) bool {
+  return allowMethods(w, req, http.MethodGet, http.MethodHead)
+}
+
+// allowMethods replies 405 Method Not Allowed (returning false) unless req uses one of methods.
+func allowMethods(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+  for _, method := range methods {
+    if req.Method == method {
+      return true
+    }
+  }
+  w.Header().Set("Allow", strings.Join(methods, ", "))
+  writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+  return false
+}
+
+// writeJSON replies with status and v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(v)
+}
+
+// writeError replies with status and a JSON document carrying message.
+func writeError(w http.ResponseWriter, status int, message string) {
+  writeJSON(w, status, struct {
+    Error string `json:"error"`
+  }{message})
+}
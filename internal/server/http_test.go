@@ -0,0 +1,274 @@
+package server
+
+import (
+  "encoding/json"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "io"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// get performs a GET request for path against srv's HTTP handler.
+func get(srv *Server, path string) *httptest.ResponseRecorder {
+  recorder := httptest.NewRecorder()
+  srv.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+  return recorder
+}
+
+// /stats must report the ingest counters.
+func TestHTTPStats(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+
+  // one device sending a valid and an invalid Reading...
+  invalid := testReading
+  invalid.Temperature = 1000
+  device, done := loginDevice(t, srv, 1)
+  device.Write(testReading.Encode())
+  device.Write(invalid.Encode())
+  device.Close()
+  waitClosed(t, done)
+
+  // ...and one failing to log in
+  badImei := append([]byte{}, client.ValidImei...)
+  badImei[14] = 9
+  device, server := net.Pipe()
+  done = serveConn(t, srv, server)
+  device.Write(badImei)
+  device.Close()
+  waitClosed(t, done)
+
+  response := get(srv, "/stats")
+  if response.Code != http.StatusOK {
+    t.Fatalf("Unexpected status %d", response.Code)
+  }
+  var stats Stats
+  if err := json.Unmarshal(response.Body.Bytes(), &stats); err != nil {
+    t.Fatalf("Invalid JSON: %v", err)
+  }
+
+  if stats.Goroutines == 0 || stats.Memory.Sys == 0 || stats.UptimeSeconds <= 0 {
+    t.Errorf("Runtime statistics missing: %+v", stats)
+  }
+  if stats.Devices.LoggedIn != 1 || stats.Devices.Online != 0 || stats.Connections.Open != 0 {
+    t.Errorf("Unexpected device/connection statistics: %+v", stats)
+  }
+  if stats.BytesRead.Total != 2 * 15 + 2 * client.READING_LENGTH || stats.BytesRead.PerSecond <= 0 {
+    t.Errorf("Unexpected bytes read: %+v", stats.BytesRead)
+  }
+  if stats.Readings.Accepted != 1 || stats.Readings.Rejected != 1 ||
+      stats.Readings.RejectedByField["Temperature"] != 1 ||
+      stats.Readings.RejectedByField["Altitude"] != 0 {
+    t.Errorf("Unexpected readings: %+v", stats.Readings)
+  }
+  if stats.LoginFailures.Checksum != 1 || stats.LoginFailures.Other != 0 {
+    t.Errorf("Unexpected login failures: %+v", stats.LoginFailures)
+  }
+}
+
+// The byte rate must be measured over the window of samples, and reading it must not change it.
+func TestRateSampler(t *testing.T) {
+  var r rateSampler
+  start := time.Unix(1600000000, 0)
+  r.record(start, 0)
+  if rate := r.rate(start.Add(2 * time.Second), 100); rate != 50 {
+    t.Errorf("Rate since start = %v", rate)
+  }
+
+  // 1000 bytes a second for a while, then 100
+  total := uint64(0)
+  for i := 1; i <= 30; i++ {
+    if i <= 20 {
+      total += 1000
+    } else {
+      total += 100
+    }
+    r.record(start.Add(time.Duration(i) * rateInterval), total)
+    r.record(start.Add(time.Duration(i) * rateInterval + rateInterval / 10), total + 1) // dropped
+  }
+  now := start.Add(30 * rateInterval)
+  for i := 0; i < 2; i++ {
+    if rate := r.rate(now, total); rate != 100 {
+      t.Errorf("Rate over the window = %v", rate)
+    }
+  }
+}
+
+// Only GET (and HEAD) requests are allowed.
+func TestHTTPMethodNotAllowed(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+
+  recorder := httptest.NewRecorder()
+  srv.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/stats", nil))
+  if recorder.Code != http.StatusMethodNotAllowed {
+    t.Errorf("Unexpected status %d", recorder.Code)
+  }
+}
+
+// The HTTP endpoints must be served on their own listener, which Close shuts down.
+func TestHTTPListener(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  httpLink, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Unable to listen: %v", err)
+  }
+  srv.serveHTTP(httpLink)
+
+  response, err := http.Get("http://" + httpLink.Addr().String() + "/stats")
+  if err != nil {
+    t.Fatalf("Unable to GET /stats: %v", err)
+  }
+  response.Body.Close()
+  if response.StatusCode != http.StatusOK {
+    t.Errorf("Unexpected status %d", response.StatusCode)
+  }
+
+  srv.Close()
+  if _, err := http.Get("http://" + httpLink.Addr().String() + "/stats"); err == nil {
+    t.Errorf("HTTP endpoints still served after Close")
+  }
+}
+
+// /readings/:imei must return the last valid Reading of an online device.
+func TestHTTPReadings(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+
+  device, done := loginDevice(t, srv, 1)
+  waitOnline(t, srv, 1)
+
+  // online, but no Reading yet
+  if response := get(srv, "/readings/490154203237518"); response.Code != http.StatusNotFound {
+    t.Errorf("Unexpected status %d before the first Reading", response.Code)
+  }
+
+  invalid := testReading
+  invalid.Latitude = 100
+  device.Write(testReading.Encode())
+  device.Write(invalid.Encode())
+  time.Sleep(50 * time.Millisecond)
+
+  response := get(srv, "/readings/490154203237518")
+  if response.Code != http.StatusOK {
+    t.Fatalf("Unexpected status %d", response.Code)
+  }
+  var last LastReading
+  if err := json.Unmarshal(response.Body.Bytes(), &last); err != nil {
+    t.Fatalf("Invalid JSON: %v", err)
+  }
+  if last.IMEI != 490154203237518 || last.Reading != testReading || last.Timestamp == 0 ||
+      last.ReceivedAt.UnixNano() != last.Timestamp {
+    t.Errorf("Unexpected last reading %+v", last)
+  }
+
+  // offline once disconnected
+  device.Close()
+  waitClosed(t, done)
+  if response := get(srv, "/readings/490154203237518"); response.Code != http.StatusNotFound {
+    t.Errorf("Unexpected status %d for an offline device", response.Code)
+  }
+}
+
+// Malformed IMEIs must be rejected with 400, valid unknown ones with 404.
+func TestHTTPReadingsBadImei(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+
+  for _, path := range []string{"/readings/", "/readings/49015420323751", "/readings/49015420323751x",
+      "/readings/490154203237519", "/readings/4901542032375180"} {
+    if response := get(srv, path); response.Code != http.StatusBadRequest {
+      t.Errorf("Unexpected status %d for %s", response.Code, path)
+    }
+  }
+  if response := get(srv, "/readings/356938035643809"); response.Code != http.StatusNotFound {
+    t.Errorf("Unexpected status %d for an unknown device", response.Code)
+  }
+}
+
+// getStatus performs GET /status/:imei and decodes the reply.
+func getStatus(t *testing.T, srv *Server, code string) DeviceStatus {
+  response := get(srv, "/status/" + code)
+  if response.Code != http.StatusOK {
+    t.Fatalf("Unexpected status %d", response.Code)
+  }
+  var status DeviceStatus
+  if err := json.Unmarshal(response.Body.Bytes(), &status); err != nil {
+    t.Fatalf("Invalid JSON: %v", err)
+  }
+  return status
+}
+
+// /status/:imei must describe the current connection of an online device.
+func TestHTTPStatusOnline(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+
+  device, _ := loginDevice(t, srv, 1)
+  defer device.Close()
+  waitOnline(t, srv, 1)
+  device.Write(testReading.Encode())
+  device.Write(testReading.Encode())
+  time.Sleep(50 * time.Millisecond)
+
+  status := getStatus(t, srv, "490154203237518")
+  if !status.Online || status.ConnectedAt == nil || status.RemoteAddr == "" ||
+      status.Readings != 2 || status.LastReadingAt == nil {
+    t.Errorf("Unexpected status %+v", status)
+  }
+  if status.DisconnectedAt != nil || status.DisconnectCause != "" {
+    t.Errorf("Online device reported disconnected: %+v", status)
+  }
+}
+
+// /status/:imei must report when and why an offline device went offline.
+func TestHTTPStatusOffline(t *testing.T) {
+  srv, _, _ := startServer(t, Options{ReadingTimeout: 300 * time.Millisecond})
+  defer srv.Close()
+
+  // a device never seen is simply offline
+  status := getStatus(t, srv, "490154203237518")
+  if status.Online || status.ConnectedAt != nil || status.DisconnectCause != "" {
+    t.Errorf("Unexpected status for an unknown device %+v", status)
+  }
+
+  // a device kicked out by a newer login is still online, on the new connection
+  first, firstDone := loginDevice(t, srv, 1)
+  defer first.Close()
+  waitOnline(t, srv, 1)
+  second, secondDone := loginDevice(t, srv, 2)
+  defer second.Close()
+  waitClosed(t, firstDone)
+  if status := getStatus(t, srv, "490154203237518"); !status.Online {
+    t.Errorf("Device kicked by a newer login reported offline: %+v", status)
+  }
+
+  // once the newer connection times out, the device is offline
+  waitClosed(t, secondDone)
+  status = getStatus(t, srv, "490154203237518")
+  if status.Online || status.DisconnectedAt == nil || status.ConnectedAt == nil ||
+      status.DisconnectCause != "timeout" || status.DisconnectReason != ErrReadingTimeout.Error() {
+    t.Errorf("Unexpected status for an offline device %+v", status)
+  }
+}
+
+func TestDisconnectCause(t *testing.T) {
+  causes := map[error]string{
+    ErrReadingTimeout:  "timeout",
+    ErrDisconnected:    "eof",
+    ErrPeerReset:       "reset",
+    ErrShortFrame:      "eof",
+    client.ErrBadHello: "invalid data",
+    ErrKicked:          "kicked",
+    ErrServerClosed:    "shutdown",
+    io.ErrClosedPipe:   "error",
+  }
+  for reason, cause := range causes {
+    if got := disconnectCause(reason); got != cause {
+      t.Errorf("disconnectCause(%v) = %q instead of %q", reason, got, cause)
+    }
+  }
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "sync/atomic"
+  "time"
+)
+
+// negotiate settles the protocol version the device on c speaks. A device asking for a later
+// version starts with a hello, which negotiate answers with the version agreed on (the latest the
+// server speaks, if the device asks for a later one still). Any other device speaks version 1, and
+// what it sent is left in frames as the start of its first Reading. The version is recorded on c.
+func (s *Server) negotiate(c *conn, frames *framer) (version int, err error) {
+  s.setReadDeadline(c, s.opts.ReadingTimeout)
+  hello, err := frames.peek(client.HELLO_LENGTH)
+  if err != nil {
+    return 0, s.readFailure(c, err, ErrReadingTimeout)
+  }
+  if !client.IsHello(hello) {
+    c.setProtocol(client.PROTOCOL_V1)
+    return client.PROTOCOL_V1, nil
+  }
+  version, err = client.ParseHello(hello)
+  frames.take(client.HELLO_LENGTH)
+  atomic.AddUint64(&s.counters.bytesRead, client.HELLO_LENGTH)
+  if err != nil {
+    return 0, err
+  }
+  if version > client.LATEST_PROTOCOL {
+    version = client.LATEST_PROTOCOL
+  }
+
+  // the version is recorded with the hello on its way, so that messages sent from other goroutines
+  // (see conn.send) follow the hello, framed for the version
+  c.writeMu.Lock()
+  c.setProtocol(version)
+  c.netConn.SetWriteDeadline(time.Now().Add(s.opts.ReadingTimeout))
+  _, err = c.netConn.Write(client.AppendHello(nil, version))
+  c.netConn.SetWriteDeadline(time.Time{})
+  c.writeMu.Unlock()
+  if err != nil {
+    return 0, s.readFailure(c, err, ErrReadingTimeout)
+  }
+  return version, nil
+}
+
+// nextMessage returns the type and payload of the next message from frames, in protocol version.
+// Version 1 only has Readings, with no header. The payload points into the framer's buffer: it is
+// only valid until the next call. nextMessage does not allocate.
+//
+// A version 2 message that fails its checksum, or announces a payload too long, makes nextMessage
+// fail (with client.ErrMessageChecksum or client.ErrMessageLength): the stream can't be trusted to
+// be framed right past it.
+func (s *Server) nextMessage(frames *framer, version int) (client.MessageType, []byte, error) {
+  if version == client.PROTOCOL_V1 {
+    frame, err := frames.next(client.READING_LENGTH)
+    if err != nil {
+      return 0, nil, err
+    }
+    atomic.AddUint64(&s.counters.bytesRead, client.READING_LENGTH)
+    return client.MessageReading, frame, nil
+  }
+
+  header, err := frames.peek(client.HEADER_LENGTH)
+  if err != nil {
+    return 0, nil, err
+  }
+  h, err := client.DecodeHeader(header)
+  if err != nil {
+    return 0, nil, err
+  }
+  frame, err := frames.next(client.HEADER_LENGTH + h.Length)
+  if err != nil {
+    return 0, nil, err
+  }
+  atomic.AddUint64(&s.counters.bytesRead, uint64(len(frame)))
+  return client.DecodeMessage(frame)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+  "encoding/json"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "log"
+  "net"
+  "net/http"
+  "strings"
+  "testing"
+  "time"
+)
+
+// loginV2 logs in client.ValidImei on a new connection to srv, asking for protocol version, and
+// returns the device's end of the connection with the version the server agreed on.
+func loginV2(t *testing.T, srv *Server, version int) (net.Conn, int, chan struct{}) {
+  device, server := net.Pipe()
+  done := serveConn(t, srv, server)
+  if _, err := device.Write(client.ValidImei); err != nil {
+    t.Fatalf("Unable to log in: %v", err)
+  }
+  agreed, err := client.Negotiate(device, version)
+  if err != nil {
+    t.Fatalf("Unable to negotiate protocol: %v", err)
+  }
+  return device, agreed, done
+}
+
+// A version 2 device must get its Readings through, and its unknown messages skipped.
+func TestServerProtocolV2(t *testing.T) {
+  records := &syncBuffer{}
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Output: records, Logger: log.New(logs, "", 0)})
+  defer srv.Close()
+
+  device, version, done := loginV2(t, srv, client.PROTOCOL_V2)
+  if version != client.PROTOCOL_V2 {
+    t.Fatalf("Agreed on protocol v%d", version)
+  }
+  device.Write(testReading.EncodeMessage())
+  device.Write(client.AppendMessage(nil, 99, []byte("from the future")))
+  // a longer Reading, from a later hardware revision with a sensor the server does not know about
+  device.Write(client.AppendMessage(nil, client.MessageReading,
+      append(testReading.Encode(), 200, 2, 1, 2)))
+  device.Close()
+  <-done
+
+  if got := strings.Count(records.String(), ",67.77,2.63555,33.41,44.4,0.25666\n"); got != 2 {
+    t.Errorf("Expected 2 records, got %d (output %q)", got, records.String())
+  }
+  waitForLog(t, logs, "conn 1: speaking protocol v2")
+  waitForLog(t, logs, "conn 1: message of unknown type 99 skipped")
+  if status := getStatus(t, srv, "490154203237518"); status.Protocol != client.PROTOCOL_V2 {
+    t.Errorf("Unexpected status %+v", status)
+  }
+}
+
+// The Readings of a batch must be recorded in order, with the times the device took them, flagged
+// as backfilled, and acknowledged one by one (those from the future rejected), without replacing
+// the last Reading of the device. A malformed batch must drop the connection.
+func TestServerReadingBatch(t *testing.T) {
+  records := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Output: records, RecordFormat: RecordJSON})
+  defer srv.Close()
+  device, _, done := loginV2(t, srv, client.PROTOCOL_V2)
+  messages := enableAcks(t, device, client.AckEach)
+
+  live := testReading
+  live.Temperature = 20
+  invalid := testReading
+  invalid.BatteryLevel = -5
+  batch := client.AppendBatch(nil, []client.BatchEntry{
+    {Timestamp: 1257894000000000000, Reading: testReading.Encode()},
+    {Timestamp: 1257894060000000000, Reading: invalid.Encode()},
+    {Timestamp: 1257894120000000000, Reading: testReading.Encode()},
+    {Timestamp: time.Now().Add(time.Hour).UnixNano(), Reading: testReading.Encode()},
+  })
+  for _, exchange := range []struct {
+    message []byte
+    acks    []client.Ack
+  }{
+    {live.EncodeMessage(), []client.Ack{
+      {Seq: 1, Code: client.AckAccepted, Field: client.NoField},
+    }},
+    {client.AppendMessage(nil, client.MessageReadingBatch, batch), []client.Ack{
+      {Seq: 2, Code: client.AckAccepted, Field: client.NoField},
+      {Seq: 3, Code: client.NackOutOfRange, Field: client.FieldBatteryLevel},
+      {Seq: 4, Code: client.AckAccepted, Field: client.NoField},
+      {Seq: 5, Code: client.NackOutOfRange, Field: client.NoField},
+    }},
+  } {
+    device.Write(exchange.message)
+    for _, want := range exchange.acks {
+      if ack := nextAck(t, messages); ack != want {
+        t.Errorf("Reading %d: unexpected acknowledgement %+v", want.Seq, ack)
+      }
+    }
+  }
+  response := get(srv, "/readings/490154203237518")
+  var last LastReading
+  if response.Code != http.StatusOK || json.Unmarshal(response.Body.Bytes(), &last) != nil ||
+      last.Reading != live || last.Timestamp != last.ReceivedAt.UnixNano() {
+    t.Errorf("Unexpected last reading %q", response.Body.String())
+  }
+
+  // the truncated batch announces more Readings than it holds
+  device.Write(client.AppendMessage(nil, client.MessageReadingBatch, []byte{0xff, 0xff, 0}))
+  waitClosed(t, done)
+  if status := getStatus(t, srv, "490154203237518"); status.DisconnectCause != "invalid data" {
+    t.Errorf("Unexpected status %+v", status)
+  }
+
+  lines := strings.Split(strings.TrimSuffix(records.String(), "\n"), "\n")
+  if len(lines) != 3 {
+    t.Fatalf("Expected 3 records, got %q", records.String())
+  }
+  for i, taken := range []int64{0, 1257894000000000000, 1257894120000000000} {
+    var record struct {
+      Timestamp  int64
+      Backfilled bool
+    }
+    if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+      t.Fatalf("Invalid record %q: %v", lines[i], err)
+    }
+    if record.Backfilled != (taken != 0) || (taken != 0 && record.Timestamp != taken) {
+      t.Errorf("Unexpected record %q", lines[i])
+    }
+  }
+  stats := srv.Stats()
+  if stats.Readings.Accepted != 3 || stats.Readings.Backfilled != 2 ||
+      stats.Readings.Rejected != 2 {
+    t.Errorf("Unexpected stats %+v", stats.Readings)
+  }
+}
+
+// In the csv format, which can't flag backfilled Readings, every batch must log a warning.
+func TestServerReadingBatchCSV(t *testing.T) {
+  records := &syncBuffer{}
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Output: records, Logger: log.New(logs, "", 0)})
+  defer srv.Close()
+  device, _, done := loginV2(t, srv, client.PROTOCOL_V2)
+
+  batch := client.AppendBatch(nil, []client.BatchEntry{
+    {Timestamp: 1257894000000000000, Reading: testReading.Encode()},
+  })
+  device.Write(client.AppendMessage(nil, client.MessageReadingBatch, batch))
+  device.Close()
+  <-done
+
+  if records.String() != testRecord {
+    t.Errorf("Unexpected records %q", records.String())
+  }
+  waitForLog(t, logs, "conn 1: 1 backfilled Reading(s) recorded without a flag (record format csv)")
+}
+
+// A device asking for a version the server does not speak yet must settle on the latest it does.
+func TestServerProtocolLaterVersion(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+
+  device, version, _ := loginV2(t, srv, client.LATEST_PROTOCOL + 1)
+  defer device.Close()
+  if version != client.LATEST_PROTOCOL {
+    t.Errorf("Agreed on protocol v%d", version)
+  }
+}
+
+// A corrupted message must drop the connection, as nothing past it can be trusted.
+func TestServerProtocolCorruptMessage(t *testing.T) {
+  records := &syncBuffer{}
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Output: records, Logger: log.New(logs, "", 0)})
+  defer srv.Close()
+
+  device, _, done := loginV2(t, srv, client.PROTOCOL_V2)
+  defer device.Close()
+  message := testReading.EncodeMessage()
+  message[client.HEADER_LENGTH] ^= 1
+  device.Write(message)
+  waitClosed(t, done)
+
+  if records.String() != "" {
+    t.Errorf("Corrupted Reading recorded: %q", records.String())
+  }
+  waitForLog(t, logs, "conn 1: closed after 0 reading(s): " + client.ErrMessageChecksum.Error())
+  if status := getStatus(t, srv, "490154203237518"); status.DisconnectCause != "invalid data" {
+    t.Errorf("Unexpected status %+v", status)
+  }
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "sync"
+  "time"
+)
+
+var (
+  ErrUnprovisioned   = errors.New("server: device not provisioned")
+  ErrPending         = errors.New("server: device pending approval")
+  ErrSuspended       = errors.New("server: device suspended")
+  ErrRetired         = errors.New("server: device retired")
+  ErrUnknownState    = errors.New("server: unknown provisioning state")
+  ErrBadTransition   = errors.New("server: provisioning state change not allowed")
+  ErrBadProvisioning = errors.New("server: invalid provisioning file")
+)
+
+// ProvisioningState is where a device stands in the provisioning lifecycle. Only approved devices
+// may log in.
+//
+// A device is registered in any state (typically pending), and can then move between pending,
+// approved and suspended at will. Retiring a device is final.
+type ProvisioningState int
+
+const (
+  // Pending devices are known, but waiting for an operator to approve them.
+  Pending ProvisioningState = iota + 1
+
+  // Approved devices may log in.
+  Approved
+
+  // Suspended devices are refused until they are approved again.
+  Suspended
+
+  // Retired devices are refused for good.
+  Retired
+)
+
+// String returns the name of the state, as accepted by ParseProvisioningState.
+func (st ProvisioningState) String() string {
+  switch st {
+  case Pending:
+    return "pending"
+  case Approved:
+    return "approved"
+  case Suspended:
+    return "suspended"
+  case Retired:
+    return "retired"
+  }
+  return "unknown"
+}
+
+// ParseProvisioningState returns the state named name ("pending", "approved", "suspended" or
+// "retired").
+func ParseProvisioningState(name string) (ProvisioningState, error) {
+  for _, st := range []ProvisioningState{Pending, Approved, Suspended, Retired} {
+    if st.String() == name {
+      return st, nil
+    }
+  }
+  return 0, ErrUnknownState
+}
+
+// MarshalText returns the name of the state.
+func (st ProvisioningState) MarshalText() ([]byte, error) {
+  if st < Pending || st > Retired {
+    return nil, ErrUnknownState
+  }
+  return []byte(st.String()), nil
+}
+
+// UnmarshalText sets the state to the one named text.
+func (st *ProvisioningState) UnmarshalText(text []byte) (err error) {
+  *st, err = ParseProvisioningState(string(text))
+  return err
+}
+
+// loginError returns the reason a device in this state is refused at login, or nil if it is not.
+func (st ProvisioningState) loginError() error {
+  switch st {
+  case Approved:
+    return nil
+  case Pending:
+    return ErrPending
+  case Suspended:
+    return ErrSuspended
+  case Retired:
+    return ErrRetired
+  }
+  return ErrUnprovisioned
+}
+
+// ProvisionedDevice is the provisioning record of a device, as served by the admin API and saved in
+// the provisioning file.
+type ProvisionedDevice struct {
+  IMEI  imei.IMEI         `json:"imei"`
+  State ProvisioningState `json:"state"`
+
+  // RegisteredAt is when the device was registered, and UpdatedAt when its state last changed.
+  RegisteredAt time.Time `json:"registered_at"`
+  UpdatedAt    time.Time `json:"updated_at"`
+
+  // AutoRegistered reports whether the device was registered by logging in while unknown.
+  AutoRegistered bool `json:"auto_registered,omitempty"`
+}
+
+// Bounds of auto-registration.
+const (
+  // maxAutoPending is the number of auto-registered devices that may be pending approval at once:
+  // past it, unknown devices are refused without being registered, so that devices made up by the
+  // thousand can't grow the records (and the file) without bound.
+  maxAutoPending = 1000
+
+  // autoSaveDelay is how long auto-registrations wait to be saved, so that a burst of them is
+  // saved at once rather than each rewriting the file while holding up the others' logins.
+  autoSaveDelay = time.Second
+)
+
+// Provisioning keeps the provisioning records of the devices, and decides from them which devices
+// may log in. Every change is saved to its file, so the records survive restarts: state changes
+// right away, auto-registrations shortly after (or with the next state change, or Flush). It is
+// safe for concurrent use.
+//
+// State changes only affect later logins: suspending or retiring a device does not disconnect it.
+type Provisioning struct {
+  path         string
+  autoRegister bool
+
+  mu          sync.RWMutex
+  devices     map[imei.IMEI]ProvisionedDevice
+  autoPending int         // auto-registered devices still pending
+  dirty       bool        // records changed since last saved
+  saveTimer   *time.Timer // pending save of the auto-registrations, if any
+}
+
+// NewProvisioning returns a Provisioning saving its records to the file at path, and loading the
+// records already there, if any. An empty path keeps the records in memory only.
+//
+// If autoRegister is true, unknown devices logging in are registered as pending (and refused until
+// approved); otherwise they are just refused.
+func NewProvisioning(path string, autoRegister bool) (*Provisioning, error) {
+  p := &Provisioning{
+    path:         path,
+    autoRegister: autoRegister,
+    devices:      make(map[imei.IMEI]ProvisionedDevice),
+  }
+  if path == "" {
+    return p, nil
+  }
+
+  data, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return p, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  var file provisioningFile
+  if err := json.Unmarshal(data, &file); err != nil {
+    return nil, fmt.Errorf("%v: %v", ErrBadProvisioning, err)
+  }
+  for _, device := range file.Devices {
+    if device.State == 0 {
+      return nil, fmt.Errorf("%v: IMEI %v has no state", ErrBadProvisioning, device.IMEI)
+    }
+    p.devices[device.IMEI] = device
+    if device.autoPending() {
+      p.autoPending++
+    }
+  }
+  return p, nil
+}
+
+// autoPending reports whether the device was auto-registered, and is still pending approval.
+func (device ProvisionedDevice) autoPending() bool {
+  return device.AutoRegistered && device.State == Pending
+}
+
+// provisioningFile is the content of the provisioning file.
+type provisioningFile struct {
+  Devices []ProvisionedDevice `json:"devices"`
+}
+
+// Check returns nil if the device with IMEI code may log in, or the reason it may not:
+// ErrUnprovisioned, ErrPending, ErrSuspended or ErrRetired. An unknown device gets registered as
+// pending first (and saved in the background) if auto-registration is on, unless too many devices
+// are pending already: it is then just refused. A nil *Provisioning lets every device in.
+func (p *Provisioning) Check(code imei.IMEI) error {
+  if p == nil {
+    return nil
+  }
+  p.mu.RLock()
+  device, known := p.devices[code]
+  p.mu.RUnlock()
+  if known {
+    return device.State.loginError()
+  }
+  if !p.autoRegister {
+    return ErrUnprovisioned
+  }
+
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if device, known := p.devices[code]; known {
+    // registered in the meantime
+    return device.State.loginError()
+  }
+  if p.autoPending >= maxAutoPending {
+    return ErrUnprovisioned
+  }
+  now := time.Now()
+  p.devices[code] = ProvisionedDevice{IMEI: code, State: Pending, RegisteredAt: now, UpdatedAt: now,
+      AutoRegistered: true}
+  p.autoPending++
+  p.dirty = true
+  if p.path != "" && p.saveTimer == nil {
+    p.saveTimer = time.AfterFunc(autoSaveDelay, p.autoSave)
+  }
+  return ErrPending
+}
+
+// autoSave saves the auto-registrations, trying again later if it fails.
+func (p *Provisioning) autoSave() {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  p.saveTimer = nil
+  if p.dirty && p.save() != nil {
+    p.saveTimer = time.AfterFunc(autoSaveDelay, p.autoSave)
+  }
+}
+
+// Flush saves the auto-registrations not saved yet, if any. A nil *Provisioning has nothing to
+// save.
+func (p *Provisioning) Flush() error {
+  if p == nil {
+    return nil
+  }
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if p.saveTimer != nil {
+    p.saveTimer.Stop()
+    p.saveTimer = nil
+  }
+  if !p.dirty {
+    return nil
+  }
+  return p.save()
+}
+
+// Set registers the device with IMEI code in state, or moves it to state if it is registered
+// already, and saves the change. It returns the device's record, and whether the device was newly
+// registered.
+//
+// Set returns ErrBadTransition if a retired device would be brought back, and ErrUnknownState for
+// an invalid state. If the change can't be saved, Set returns the error and leaves the record as it
+// was.
+func (p *Provisioning) Set(code imei.IMEI, state ProvisioningState) (ProvisionedDevice, bool,
+    error) {
+  if state < Pending || state > Retired {
+    return ProvisionedDevice{}, false, ErrUnknownState
+  }
+
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  previous, known := p.devices[code]
+  if known && previous.State == Retired && state != Retired {
+    return previous, false, ErrBadTransition
+  }
+
+  device := previous
+  now := time.Now()
+  if !known {
+    device = ProvisionedDevice{IMEI: code, RegisteredAt: now}
+  }
+  if device.State != state {
+    device.State = state
+    device.UpdatedAt = now
+  }
+  p.devices[code] = device
+  if err := p.save(); err != nil {
+    if known {
+      p.devices[code] = previous
+    } else {
+      delete(p.devices, code)
+    }
+    return previous, false, err
+  }
+  if previous.autoPending() && !device.autoPending() {
+    p.autoPending--
+  }
+  return device, !known, nil
+}
+
+// Lookup returns the record of the device with IMEI code, if it is registered.
+func (p *Provisioning) Lookup(code imei.IMEI) (ProvisionedDevice, bool) {
+  p.mu.RLock()
+  defer p.mu.RUnlock()
+  device, ok := p.devices[code]
+  return device, ok
+}
+
+// Devices returns the records of all the registered devices, sorted by IMEI.
+func (p *Provisioning) Devices() []ProvisionedDevice {
+  p.mu.RLock()
+  defer p.mu.RUnlock()
+  return p.sorted()
+}
+
+// sorted returns the records sorted by IMEI. The caller holds p.mu.
+func (p *Provisioning) sorted() []ProvisionedDevice {
+  devices := make([]ProvisionedDevice, 0, len(p.devices))
+  for _, device := range p.devices {
+    devices = append(devices, device)
+  }
+  sort.Slice(devices, func(i, j int) bool { return devices[i].IMEI < devices[j].IMEI })
+  return devices
+}
+
+// save writes the records to the file, replacing it atomically so that a crash never leaves it
+// half-written. The caller holds p.mu for writing.
+func (p *Provisioning) save() error {
+  if p.path == "" {
+    return nil
+  }
+  if err := p.write(); err != nil {
+    return err
+  }
+  p.dirty = false
+  return nil
+}
+
+// write writes the records to a temporary file, and moves it over the file.
+func (p *Provisioning) write() error {
+  data, err := json.MarshalIndent(provisioningFile{Devices: p.sorted()}, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path) + ".tmp")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+  if _, err := tmp.Write(append(data, '\n')); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Sync(); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp.Name(), p.path)
+}
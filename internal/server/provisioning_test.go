@@ -0,0 +1,178 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// The lifecycle must be enforced at login, allow anything but bringing back a retired device, and
+// survive a restart.
+func TestProvisioningLifecycle(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thermomatic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "provisioning.json")
+
+  p, err := NewProvisioning(path, false)
+  if err != nil {
+    t.Fatalf("Unable to create provisioning: %v", err)
+  }
+  if err := p.Check(490154203237518); err != ErrUnprovisioned {
+    t.Errorf("Unknown device: expected ErrUnprovisioned, got %v", err)
+  }
+
+  steps := []struct {
+    state ProvisioningState
+    err   error // of the state change
+    login error
+  }{
+    {Pending, nil, ErrPending},
+    {Approved, nil, nil},
+    {Suspended, nil, ErrSuspended},
+    {Approved, nil, nil},
+    {Retired, nil, ErrRetired},
+    {Approved, ErrBadTransition, ErrRetired},
+    {ProvisioningState(42), ErrUnknownState, ErrRetired},
+  }
+  for i, step := range steps {
+    device, registered, err := p.Set(490154203237518, step.state)
+    if err != step.err || registered != (i == 0) {
+      t.Errorf("Set(%v): unexpected %v, %v", step.state, registered, err)
+    }
+    if err == nil && (device.State != step.state || device.RegisteredAt.IsZero()) {
+      t.Errorf("Set(%v): unexpected record %+v", step.state, device)
+    }
+    if err := p.Check(490154203237518); err != step.login {
+      t.Errorf("After Set(%v): login error %v instead of %v", step.state, err, step.login)
+    }
+  }
+
+  // the records survive a restart
+  p.Set(356938035643809, Approved)
+  restarted, err := NewProvisioning(path, false)
+  if err != nil {
+    t.Fatalf("Unable to reload provisioning: %v", err)
+  }
+  devices := restarted.Devices()
+  if len(devices) != 2 || devices[0].IMEI != 356938035643809 || devices[0].State != Approved ||
+      devices[1].State != Retired {
+    t.Errorf("Unexpected records after restart: %+v", devices)
+  }
+
+  ioutil.WriteFile(path, []byte(`{"devices": [{"imei": "490154203237518"}]}`), 0644)
+  if _, err := NewProvisioning(path, false); err == nil {
+    t.Error("Record without a state loaded")
+  }
+}
+
+// Unknown devices must be registered as pending, and still refused, with auto-registration.
+func TestProvisioningAutoRegister(t *testing.T) {
+  p, err := NewProvisioning("", true)
+  if err != nil {
+    t.Fatalf("Unable to create provisioning: %v", err)
+  }
+  for i := 0; i < 2; i++ {
+    if err := p.Check(490154203237518); err != ErrPending {
+      t.Errorf("Expected ErrPending, got %v", err)
+    }
+  }
+  device, ok := p.Lookup(490154203237518)
+  if !ok || device.State != Pending || !device.AutoRegistered {
+    t.Errorf("Device not registered as pending: %+v", device)
+  }
+  if err := (*Provisioning)(nil).Check(490154203237518); err != nil {
+    t.Errorf("No provisioning refused the device: %v", err)
+  }
+
+  // past the cap, unknown devices are refused without being registered, until some are approved
+  for code := imei.IMEI(100000000000000); len(p.Devices()) < maxAutoPending; code++ {
+    p.Check(code)
+  }
+  if err := p.Check(356938035643809); err != ErrUnprovisioned {
+    t.Errorf("Past the cap: expected ErrUnprovisioned, got %v", err)
+  }
+  if _, ok := p.Lookup(356938035643809); ok {
+    t.Errorf("Device registered past the cap")
+  }
+  p.Set(490154203237518, Approved)
+  if err := p.Check(356938035643809); err != ErrPending {
+    t.Errorf("Below the cap: expected ErrPending, got %v", err)
+  }
+}
+
+// Auto-registrations must be saved in the background, or by Flush.
+func TestProvisioningAutoSave(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thermomatic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "provisioning.json")
+
+  p, err := NewProvisioning(path, true)
+  if err != nil {
+    t.Fatalf("Unable to create provisioning: %v", err)
+  }
+  p.Check(490154203237518)
+  if _, err := os.Stat(path); !os.IsNotExist(err) {
+    t.Errorf("Auto-registration saved right away: %v", err)
+  }
+  if err := p.Flush(); err != nil {
+    t.Fatalf("Flush: %v", err)
+  }
+  restarted, err := NewProvisioning(path, true)
+  if err != nil {
+    t.Fatalf("Unable to reload provisioning: %v", err)
+  }
+  if device, ok := restarted.Lookup(490154203237518); !ok || !device.AutoRegistered {
+    t.Errorf("Auto-registration not saved: %+v", device)
+  }
+
+  restarted.Check(356938035643809)
+  deadline := time.Now().Add(5 * autoSaveDelay)
+  for {
+    reloaded, err := NewProvisioning(path, true)
+    if err != nil {
+      t.Fatalf("Unable to reload provisioning: %v", err)
+    }
+    if _, ok := reloaded.Lookup(356938035643809); ok {
+      break
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("Auto-registration not saved in the background")
+    }
+    time.Sleep(autoSaveDelay / 10)
+  }
+}
+
+// The server must only let approved devices in.
+func TestServerProvisioning(t *testing.T) {
+  p, err := NewProvisioning("", true)
+  if err != nil {
+    t.Fatalf("Unable to create provisioning: %v", err)
+  }
+  srv, _, _ := startServer(t, Options{Provisioning: p})
+  defer srv.Close()
+
+  device, done := loginDevice(t, srv, 1)
+  defer device.Close()
+  waitClosed(t, done)
+  if status := getStatus(t, srv, "490154203237518"); status.Provisioning != "pending" {
+    t.Errorf("Unexpected status %+v", status)
+  }
+
+  p.Set(490154203237518, Approved)
+  approved, _ := loginDevice(t, srv, 2)
+  defer approved.Close()
+  waitOnline(t, srv, 2)
+
+  if failures := srv.Stats().LoginFailures; failures.Unprovisioned != 1 {
+    t.Errorf("Unexpected login failures %+v", failures)
+  }
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+  "errors"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io"
+  "strconv"
+  "sync"
+)
+
+var (
+  ErrUnknownRecordFormat = errors.New("server: unknown record format")
+)
+
+// Initial capacity of a recordWriter's buffer. Records are usually under 140 bytes long (plus about
+// 30 per extra sensor), but not bounded by much: written without an exponent, a value as tiny as
+// 5e-324 (a valid latitude) takes over 320 bytes on its own. The buffer grows for such records, and
+// is reused at its new size.
+const recordBufferSize = 256
+
+// RecordFormat is the format of the Reading records written to the server's Output, one line per
+// Reading. In every format, timestamp is the time the Reading was received, in nanoseconds since
+// the Unix epoch, or for a backfilled Reading (sent after the fact, see client.MessageReadingBatch)
+// the time the device took it. Only the extended formats flag the backfilled Readings.
+type RecordFormat int
+
+const (
+  // RecordCSV is the original format, ignoring extra sensors (see client.Extras):
+  //
+  //   timestamp,imei,temperature,altitude,latitude,longitude,batteryLevel\n
+  //
+  // It does not flag backfilled Readings either, whose records can't be told apart from the others
+  // (the server logs a warning for every batch): store-and-forward devices need an extended format.
+  RecordCSV RecordFormat = iota
+
+  // RecordCSVExtended follows the columns of RecordCSV with whether the Reading was backfilled
+  // ("true" or "false"), then one column per registered extra sensor (see client.Sensors), in order
+  // of ID, left empty when the Reading has no value for it:
+  //
+  //   timestamp,imei,temperature,altitude,latitude,longitude,batteryLevel,backfilled,humidity,...\n
+  RecordCSVExtended
+
+  // RecordJSON writes a JSON object per line, with the extra sensors of the Reading as additional
+  // fields, named after them:
+  //
+  //   {"timestamp":1257894000000000000,"imei":"490154203237518","temperature":67.77,...,
+  //       "battery_level":0.25666,"backfilled":false,"humidity":45.5}
+  RecordJSON
+)
+
+// String returns the name of the format, as accepted by ParseRecordFormat.
+func (f RecordFormat) String() string {
+  switch f {
+  case RecordCSV:
+    return "csv"
+  case RecordCSVExtended:
+    return "csv-extended"
+  case RecordJSON:
+    return "json"
+  }
+  return "unknown"
+}
+
+// ParseRecordFormat returns the format named name ("csv", "csv-extended" or "json").
+func ParseRecordFormat(name string) (RecordFormat, error) {
+  for _, f := range []RecordFormat{RecordCSV, RecordCSVExtended, RecordJSON} {
+    if f.String() == name {
+      return f, nil
+    }
+  }
+  return 0, ErrUnknownRecordFormat
+}
+
+// recordWriter writes Reading records to the server's Output, in its RecordFormat. It is safe for
+// concurrent use; each record is written with a single Write call.
+type recordWriter struct {
+  format RecordFormat
+
+  mu  sync.Mutex
+  w   io.Writer
+  buf []byte
+}
+
+// newRecordWriter returns a recordWriter writing to w in format.
+func newRecordWriter(w io.Writer, format RecordFormat) *recordWriter {
+  return &recordWriter{format: format, w: w, buf: make([]byte, 0, recordBufferSize)}
+}
+
+// write formats the record for reading r, with the extra sensors x (nil for none), received (or
+// if backfilled, taken) at timestamp from the device with IMEI code, and writes it out. write does
+// not allocate: records are formatted into a buffer reused across calls.
+func (rw *recordWriter) write(timestamp int64, code imei.IMEI, r *client.Reading,
+    x *client.Extras, backfilled bool) error {
+  rw.mu.Lock()
+  defer rw.mu.Unlock()
+  switch rw.format {
+  case RecordCSVExtended:
+    rw.buf = appendExtendedRecord(rw.buf[:0], timestamp, code, r, x, backfilled)
+  case RecordJSON:
+    rw.buf = appendJSONRecord(rw.buf[:0], timestamp, code, r, x, backfilled)
+  default:
+    rw.buf = appendRecord(rw.buf[:0], timestamp, code, r)
+  }
+  _, err := rw.w.Write(rw.buf)
+  return err
+}
+
+// flush flushes the underlying writer if it buffers records (e.g. a *bufio.Writer).
+func (rw *recordWriter) flush() error {
+  flusher, ok := rw.w.(interface{ Flush() error })
+  if !ok {
+    return nil
+  }
+  rw.mu.Lock()
+  defer rw.mu.Unlock()
+  return flusher.Flush()
+}
+
+// appendRecord appends the record for reading r, received at timestamp from the device with IMEI
+// code, to dst and returns the extended buffer.
+//
+// The IMEI is written as 15 digits, leading zeros included. Floats are written in their shortest
+// decimal form that round-trips, without an exponent.
+func appendRecord(dst []byte, timestamp int64, code imei.IMEI, r *client.Reading) []byte {
+  return append(appendColumns(dst, timestamp, code, r), '\n')
+}
+
+// appendExtendedRecord is like appendRecord, but in the RecordCSVExtended format, with the extra
+// sensors x (nil for none).
+func appendExtendedRecord(dst []byte, timestamp int64, code imei.IMEI, r *client.Reading,
+    x *client.Extras, backfilled bool) []byte {
+  dst = append(appendColumns(dst, timestamp, code, r), ',')
+  dst = strconv.AppendBool(dst, backfilled)
+  for i := range client.Sensors {
+    dst = append(dst, ',')
+    if x == nil {
+      continue
+    }
+    if value, ok := x.Get(client.Sensors[i].ID); ok {
+      dst = strconv.AppendFloat(dst, value, 'f', -1, 64)
+    }
+  }
+  return append(dst, '\n')
+}
+
+// appendColumns appends the columns of the RecordCSV format, without the line feed, to dst.
+func appendColumns(dst []byte, timestamp int64, code imei.IMEI, r *client.Reading) []byte {
+  dst = strconv.AppendInt(dst, timestamp, 10)
+  dst = append(dst, ',')
+  dst, _ = code.AppendText(dst)
+  dst = append(dst, ',')
+  dst = strconv.AppendFloat(dst, r.Temperature, 'f', -1, 64)
+  dst = append(dst, ',')
+  dst = strconv.AppendFloat(dst, r.Altitude, 'f', -1, 64)
+  dst = append(dst, ',')
+  dst = strconv.AppendFloat(dst, r.Latitude, 'f', -1, 64)
+  dst = append(dst, ',')
+  dst = strconv.AppendFloat(dst, r.Longitude, 'f', -1, 64)
+  dst = append(dst, ',')
+  return strconv.AppendFloat(dst, r.BatteryLevel, 'f', -1, 64)
+}
+
+// appendJSONRecord is like appendRecord, but in the RecordJSON format, with the extra sensors x
+// (nil for none). Only registered sensors are written: their names need no escaping.
+func appendJSONRecord(dst []byte, timestamp int64, code imei.IMEI, r *client.Reading,
+    x *client.Extras, backfilled bool) []byte {
+  dst = append(dst, `{"timestamp":`...)
+  dst = strconv.AppendInt(dst, timestamp, 10)
+  dst = append(dst, `,"imei":"`...)
+  dst, _ = code.AppendText(dst)
+  dst = append(dst, `","temperature":`...)
+  dst = strconv.AppendFloat(dst, r.Temperature, 'f', -1, 64)
+  dst = append(dst, `,"altitude":`...)
+  dst = strconv.AppendFloat(dst, r.Altitude, 'f', -1, 64)
+  dst = append(dst, `,"latitude":`...)
+  dst = strconv.AppendFloat(dst, r.Latitude, 'f', -1, 64)
+  dst = append(dst, `,"longitude":`...)
+  dst = strconv.AppendFloat(dst, r.Longitude, 'f', -1, 64)
+  dst = append(dst, `,"battery_level":`...)
+  dst = strconv.AppendFloat(dst, r.BatteryLevel, 'f', -1, 64)
+  dst = append(dst, `,"backfilled":`...)
+  dst = strconv.AppendBool(dst, backfilled)
+  for i := 0; x != nil && i < x.Len(); i++ {
+    extra := x.At(i)
+    sensor := client.LookupSensor(extra.Sensor)
+    if sensor == nil {
+      continue
+    }
+    dst = append(dst, `,"`...)
+    dst = append(dst, sensor.Name...)
+    dst = append(dst, `":`...)
+    dst = strconv.AppendFloat(dst, extra.Value, 'f', -1, 64)
+  }
+  return append(dst, "}\n"...)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+  "encoding/json"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "io/ioutil"
+  "net"
+  "strings"
+  "testing"
+)
+
+// The record of the README's output format example.
+const testRecord = "1257894000000000000,490154203237518,67.77,2.63555,33.41,44.4,0.25666\n"
+
+// appendRecord must produce exactly the README's output format.
+func TestAppendRecord(t *testing.T) {
+  record := appendRecord(nil, 1257894000000000000, 490154203237518, &testReading)
+  if string(record) != testRecord {
+    t.Errorf("Unexpected record %q", record)
+  }
+
+  // extreme values must not be written with an exponent
+  extreme := client.Reading{Temperature: -300, Altitude: 20000, Latitude: 0.000001,
+      Longitude: -180, BatteryLevel: 100}
+  record = appendRecord(nil, 1, 490154203237518, &extreme)
+  if string(record) != "1,490154203237518,-300,20000,0.000001,-180,100\n" {
+    t.Errorf("Unexpected record %q", record)
+  }
+
+  // the IMEI keeps its leading zeros
+  record = appendRecord(nil, 1, 1234567, &testReading)
+  if !strings.HasPrefix(string(record), "1,000000001234567,") {
+    t.Errorf("Unexpected record %q", record)
+  }
+}
+
+// recordWriter must write one record per call, without allocating.
+func TestRecordWriter(t *testing.T) {
+  output := &syncBuffer{}
+  rw := newRecordWriter(output, RecordCSV)
+  if err := rw.write(1257894000000000000, 490154203237518, &testReading, nil, false); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if output.String() != testRecord {
+    t.Errorf("Unexpected output %q", output.String())
+  }
+
+  rw = newRecordWriter(ioutil.Discard, RecordCSV)
+  allocs := testing.AllocsPerRun(100, func() {
+    rw.write(1257894000000000000, 490154203237518, &testReading, nil, false)
+  })
+  if allocs != 0 {
+    t.Errorf("recordWriter.write allocated %v times", allocs)
+  }
+}
+
+// testExtras holds a value for the first and last registered sensors.
+func testExtras() *client.Extras {
+  var x client.Extras
+  x.Set(client.SensorLight, 1200)
+  x.Set(client.SensorHumidity, 45.5)
+  return &x
+}
+
+// The extended formats must write the extra sensors, and still the Readings without any.
+func TestAppendExtendedRecords(t *testing.T) {
+  record := appendExtendedRecord(nil, 1257894000000000000, 490154203237518, &testReading,
+      testExtras(), false)
+  if string(record) != strings.TrimSuffix(testRecord, "\n") + ",false,45.5,,1200\n" {
+    t.Errorf("Unexpected record %q", record)
+  }
+  record = appendExtendedRecord(nil, 1257894000000000000, 490154203237518, &testReading, nil,
+      true)
+  if string(record) != strings.TrimSuffix(testRecord, "\n") + ",true,,,\n" {
+    t.Errorf("Unexpected record %q", record)
+  }
+
+  record = appendJSONRecord(nil, 1257894000000000000, 490154203237518, &testReading, testExtras(),
+      true)
+  var fields map[string]interface{}
+  if err := json.Unmarshal(record, &fields); err != nil {
+    t.Fatalf("Invalid JSON record %q: %v", record, err)
+  }
+  want := map[string]interface{}{"timestamp": 1257894000000000000.0, "imei": "490154203237518",
+      "temperature": 67.77, "altitude": 2.63555, "latitude": 33.41, "longitude": 44.4,
+      "battery_level": 0.25666, "backfilled": true, "humidity": 45.5, "light": 1200.0}
+  if len(fields) != len(want) {
+    t.Errorf("Unexpected record %q", record)
+  }
+  for name, value := range want {
+    if fields[name] != value {
+      t.Errorf("Unexpected %s in record %q", name, record)
+    }
+  }
+}
+
+// recordWriter must not allocate in the extended formats either.
+func TestRecordWriterFormats(t *testing.T) {
+  x := testExtras()
+  for _, format := range []RecordFormat{RecordCSVExtended, RecordJSON} {
+    rw := newRecordWriter(ioutil.Discard, format)
+    allocs := testing.AllocsPerRun(100, func() {
+      rw.write(1257894000000000000, 490154203237518, &testReading, x, true)
+    })
+    if allocs != 0 {
+      t.Errorf("recordWriter.write allocated %v times in format %v", allocs, format)
+    }
+  }
+
+  for _, format := range []RecordFormat{RecordCSV, RecordCSVExtended, RecordJSON} {
+    if parsed, err := ParseRecordFormat(format.String()); err != nil || parsed != format {
+      t.Errorf("ParseRecordFormat(%q) = %v, %v", format, parsed, err)
+    }
+  }
+  if _, err := ParseRecordFormat("xml"); err != ErrUnknownRecordFormat {
+    t.Errorf("Unexpected error %v", err)
+  }
+}
+
+// The extra sensors of a Reading must reach the records, and one out of range reject the Reading.
+func TestServerExtraSensors(t *testing.T) {
+  records := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Output: records, RecordFormat: RecordCSVExtended})
+  defer srv.Close()
+  device, _, done := loginV2(t, srv, client.PROTOCOL_V2)
+  messages := enableAcks(t, device, client.AckEach)
+
+  invalid := client.Extras{}
+  invalid.Set(client.SensorHumidity, 140)
+  want := []client.Ack{
+    {Seq: 1, Code: client.AckAccepted, Field: client.NoField},
+    {Seq: 2, Code: client.NackOutOfRange, Field: client.NoField},
+    {Seq: 3, Code: client.NackMalformed, Field: client.NoField},
+  }
+  for i, payload := range [][]byte{
+    testExtras().Append(testReading.Encode()),
+    invalid.Append(testReading.Encode()),
+    append(testReading.Encode(), byte(client.SensorHumidity)),
+  } {
+    device.Write(client.AppendMessage(nil, client.MessageReading, payload))
+    if ack := nextAck(t, messages); ack != want[i] {
+      t.Errorf("Reading %d: unexpected acknowledgement %+v", i + 1, ack)
+    }
+  }
+  device.Close()
+  <-done
+
+  suffix := ",490154203237518,67.77,2.63555,33.41,44.4,0.25666,false,45.5,,1200\n"
+  if !strings.HasSuffix(records.String(), suffix) || strings.Count(records.String(), "\n") != 1 {
+    t.Errorf("Unexpected records %q", records.String())
+  }
+  if rejected := srv.Stats().Readings.RejectedByField["humidity"]; rejected != 1 {
+    t.Errorf("%d Readings rejected for humidity", rejected)
+  }
+}
+
+// Only Readings that decode successfully may produce a record.
+func TestServerDropsInvalidReadings(t *testing.T) {
+  records := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Output: records})
+  defer srv.Close()
+
+  invalid := testReading
+  invalid.BatteryLevel = -5
+
+  device, server := net.Pipe()
+  done := serveConn(t, srv, server)
+  device.Write(client.ValidImei)
+  device.Write(testReading.Encode())
+  device.Write(invalid.Encode())
+  device.Write(testReading.Encode())
+  device.Close()
+  <-done
+
+  lines := strings.Split(strings.TrimSuffix(records.String(), "\n"), "\n")
+  if len(lines) != 2 {
+    t.Fatalf("Expected 2 records, got %q", records.String())
+  }
+  for _, line := range lines {
+    if !strings.HasSuffix(line, ",490154203237518,67.77,2.63555,33.41,44.4,0.25666") {
+      t.Errorf("Unexpected record %q", line)
+    }
+  }
+}
+
+func BenchmarkRecordWriter(b *testing.B) {
+  b.ReportAllocs()
+  rw := newRecordWriter(ioutil.Discard, RecordCSV)
+  for i := 0; i < b.N; i++ {
+    rw.write(1257894000000000000, 490154203237518, &testReading, nil, false)
+  }
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+  "container/list"
+  "errors"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "log"
+  "sync"
+  "time"
+)
+
+var (
+  ErrDuplicateLogin = errors.New("server: device already logged in on another connection")
+  ErrKicked         = errors.New("server: replaced by a newer login of the same device")
+  ErrUnknownPolicy  = errors.New("server: unknown duplicate login policy")
+)
+
+// DuplicatePolicy decides what happens when a device logs in while it is already online.
+type DuplicatePolicy int
+
+const (
+  // KickOld closes the device's existing connection(s) in favour of the new one. This is the
+  // default: a device reconnecting after a network change should not have to wait for its stale
+  // connection to time out.
+  KickOld DuplicatePolicy = iota
+
+  // RejectNew keeps the existing connection and drops the new one.
+  RejectNew
+
+  // AllowBoth keeps every connection; their Readings are all output.
+  AllowBoth
+)
+
+// String returns the name of the policy, as accepted by ParseDuplicatePolicy.
+func (p DuplicatePolicy) String() string {
+  switch p {
+  case KickOld:
+    return "kick"
+  case RejectNew:
+    return "reject"
+  case AllowBoth:
+    return "allow"
+  }
+  return "unknown"
+}
+
+// ParseDuplicatePolicy returns the policy named name ("kick", "reject" or "allow").
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+  for _, p := range []DuplicatePolicy{KickOld, RejectNew, AllowBoth} {
+    if p.String() == name {
+      return p, nil
+    }
+  }
+  return KickOld, ErrUnknownPolicy
+}
+
+// Device describes an online device, as recorded by the registry.
+type Device struct {
+  // IMEI is the device's IMEI code, as returned by imei.Decode.
+  IMEI imei.IMEI
+
+  // SoftwareVersion is the software version number of the IMEISV the device logged in with, or
+  // imei.NoSoftwareVersion if it logged in with a plain IMEI.
+  SoftwareVersion int
+
+  // Protocol is the version of the wire protocol the device speaks (client.PROTOCOL_V1 or later),
+  // or 0 until it is negotiated, right after login.
+  Protocol int
+
+  // ConnID is the ID of the connection the device is logged in on.
+  ConnID uint64
+
+  // RemoteAddr is the network address the device connects from.
+  RemoteAddr string
+
+  // ConnectedAt is when the device connected.
+  ConnectedAt time.Time
+
+  // Readings is the number of Readings received on the connection (valid or not).
+  Readings uint64
+
+  // LastReadingAt is when the last valid Reading was received (zero if none was yet).
+  LastReadingAt time.Time
+
+  // LastReading is the last valid Reading received.
+  LastReading client.Reading
+}
+
+// Departure describes how a device that was online went offline.
+type Departure struct {
+  // Device describes the device as it was on its last connection.
+  Device
+
+  // DisconnectedAt is when the last connection was closed.
+  DisconnectedAt time.Time
+
+  // Reason is the reason the last connection was closed for.
+  Reason error
+}
+
+// maxDepartures is the number of devices the registry remembers the departure of: past it, the
+// departures least recently recorded are forgotten, so that devices seen once (or IMEIs made up by
+// the thousand) can't grow the registry without bound.
+const maxDepartures = 10000
+
+// registry keeps track of the devices that are online, keyed by IMEI code, and enforces the
+// duplicate login policy. It also remembers how the last maxDepartures devices to go offline since
+// startup went offline. It is safe for concurrent use.
+type registry struct {
+  policy DuplicatePolicy
+  log    *log.Logger
+
+  mu             sync.RWMutex
+  devices        map[imei.IMEI][]*conn
+  departures     map[imei.IMEI]*list.Element // of departureOrder
+  departureOrder *list.List                  // of Departure, least recent first
+  maxDepartures  int
+}
+
+// newRegistry returns an empty registry applying policy to duplicate logins.
+func newRegistry(policy DuplicatePolicy, logger *log.Logger) *registry {
+  return &registry{
+    policy:         policy,
+    log:            logger,
+    devices:        make(map[imei.IMEI][]*conn),
+    departures:     make(map[imei.IMEI]*list.Element),
+    departureOrder: list.New(),
+    maxDepartures:  maxDepartures,
+  }
+}
+
+// login records that c has logged in as the device with IMEI code. If the device is already online
+// the duplicate login policy applies: login either kicks the existing connections out or returns
+// ErrDuplicateLogin, in which case c is not registered.
+func (r *registry) login(c *conn, code imei.IMEI) error {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  existing := r.devices[code]
+  if len(existing) > 0 {
+    switch r.policy {
+    case RejectNew:
+      r.log.Printf("IMEI %v: login on conn %d rejected, already online on conn %d", code, c.id,
+          existing[0].id)
+      return ErrDuplicateLogin
+    case KickOld:
+      for _, old := range existing {
+        r.log.Printf("IMEI %v: conn %d kicked out by login on conn %d", code, old.id, c.id)
+        old.kick(ErrKicked)
+      }
+      existing = existing[:0]
+    case AllowBoth:
+      r.log.Printf("IMEI %v: logged in again on conn %d, %d other connection(s) kept", code, c.id,
+          len(existing))
+    }
+  }
+
+  c.login(code)
+  r.devices[code] = append(existing, c)
+  r.log.Printf("IMEI %v: online on conn %d from %v", code, c.id, c.netConn.RemoteAddr())
+  return nil
+}
+
+// logout removes c, closed for reason, from the registry. If c was the device's last connection,
+// the device goes offline and its departure is recorded.
+//
+// A connection kicked out by a newer login is no longer registered, but its departure is still
+// recorded unless the device is online again.
+func (r *registry) logout(c *conn, reason error) {
+  device := c.device()
+  departure := Departure{Device: device, DisconnectedAt: time.Now(), Reason: reason}
+
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  conns := r.devices[device.IMEI]
+  for i, other := range conns {
+    if other != c {
+      continue
+    }
+    conns = append(conns[:i], conns[i+1:]...)
+    if len(conns) > 0 {
+      r.devices[device.IMEI] = conns
+      r.log.Printf("IMEI %v: conn %d closed (%v), still online on conn %d", device.IMEI, c.id,
+          reason, conns[0].id)
+      return
+    }
+    delete(r.devices, device.IMEI)
+    break
+  }
+
+  if len(r.devices[device.IMEI]) == 0 {
+    r.depart(departure)
+    r.log.Printf("IMEI %v: offline (conn %d closed: %v)", device.IMEI, c.id, reason)
+  }
+}
+
+// depart records departure, forgetting the least recent one if there are too many. The caller holds
+// r.mu for writing.
+func (r *registry) depart(departure Departure) {
+  if element, ok := r.departures[departure.IMEI]; ok {
+    element.Value = departure
+    r.departureOrder.MoveToBack(element)
+    return
+  }
+  r.departures[departure.IMEI] = r.departureOrder.PushBack(departure)
+  if r.departureOrder.Len() > r.maxDepartures {
+    oldest := r.departureOrder.Remove(r.departureOrder.Front()).(Departure)
+    delete(r.departures, oldest.IMEI)
+  }
+}
+
+// lookup returns the device with IMEI code if it is online. If the device is logged in on several
+// connections, the most recent one is described.
+func (r *registry) lookup(code imei.IMEI) (Device, bool) {
+  c := r.conn(code)
+  if c == nil {
+    return Device{}, false
+  }
+  return c.device(), true
+}
+
+// conn returns the most recent connection the device with IMEI code is logged in on, or nil if it
+// is offline.
+func (r *registry) conn(code imei.IMEI) *conn {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  conns := r.devices[code]
+  if len(conns) == 0 {
+    return nil
+  }
+  return conns[len(conns)-1]
+}
+
+// departure returns how the device with IMEI code last went offline, if it has since startup and
+// its departure is still remembered.
+func (r *registry) departure(code imei.IMEI) (Departure, bool) {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  element, ok := r.departures[code]
+  if !ok {
+    return Departure{}, false
+  }
+  return element.Value.(Departure), true
+}
+
+// count returns the number of devices online.
+func (r *registry) count() int {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  return len(r.devices)
+}
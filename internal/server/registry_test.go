@@ -0,0 +1,191 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "log"
+  "net"
+  "testing"
+  "time"
+)
+
+// loginDevice connects a device to srv over a pipe and logs it in with client.ValidImei. It
+// returns the device end of the pipe and the channel closed once the server is done with it.
+func loginDevice(t *testing.T, srv *Server, id uint64) (net.Conn, chan struct{}) {
+  device, server := net.Pipe()
+  c := &conn{id: id, netConn: server, connectedAt: time.Now()}
+  if err := srv.trackConn(c); err != nil {
+    t.Fatalf("Unable to track connection: %v", err)
+  }
+  done := make(chan struct{})
+  go func() {
+    srv.handleConnection(c)
+    close(done)
+  }()
+  if _, err := device.Write(client.ValidImei); err != nil {
+    t.Fatalf("Unable to log in: %v", err)
+  }
+  return device, done
+}
+
+// waitOnline waits for the registry to record client.ValidImei as online on connection id.
+func waitOnline(t *testing.T, srv *Server, id uint64) {
+  for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+    if info, ok := srv.registry.lookup(490154203237518); ok && info.ConnID == id {
+      return
+    }
+    time.Sleep(5 * time.Millisecond)
+  }
+  t.Fatalf("Device not online on conn %d", id)
+}
+
+// waitClosed waits for the server to be done with a connection.
+func waitClosed(t *testing.T, done chan struct{}) {
+  select {
+  case <-done:
+  case <-time.After(2 * time.Second):
+    t.Fatal("Connection not closed")
+  }
+}
+
+// isOpen reports whether the server is still serving the connection behind done.
+func isOpen(done chan struct{}) bool {
+  select {
+  case <-done:
+    return false
+  case <-time.After(50 * time.Millisecond):
+    return true
+  }
+}
+
+// The registry must track the device while it is online and forget it once it disconnects.
+func TestRegistryOnlineOffline(t *testing.T) {
+  srv, _, _ := startServer(t, Options{})
+  defer srv.Close()
+
+  device, done := loginDevice(t, srv, 1)
+  device.Write(testReading.Encode())
+  time.Sleep(50 * time.Millisecond)
+
+  info, ok := srv.registry.lookup(490154203237518)
+  if !ok {
+    t.Fatal("Device not online")
+  }
+  if info.ConnID != 1 || info.ConnectedAt.IsZero() || info.RemoteAddr == "" {
+    t.Errorf("Unexpected device info %+v", info)
+  }
+  if info.LastReading != testReading || info.LastReadingAt.IsZero() {
+    t.Errorf("Last reading not recorded: %+v", info)
+  }
+
+  device.Close()
+  waitClosed(t, done)
+  if _, ok := srv.registry.lookup(490154203237518); ok {
+    t.Error("Device still online after disconnecting")
+  }
+}
+
+// The registry must only remember the departures of the devices that went offline last.
+func TestRegistryDeparturesBound(t *testing.T) {
+  r := newRegistry(KickOld, log.New(ioutil.Discard, "", 0))
+  r.maxDepartures = 2
+  depart := func(code imei.IMEI) {
+    device, server := net.Pipe()
+    defer device.Close()
+    c := &conn{id: uint64(code), netConn: server, connectedAt: time.Now()}
+    r.login(c, code)
+    r.logout(c, nil)
+  }
+
+  depart(490154203237518)
+  depart(356938035643809)
+  depart(490154203237518) // remembered again, as the most recent
+  depart(352099001761481)
+  for code, remembered := range map[imei.IMEI]bool{
+    490154203237518: true,
+    356938035643809: false,
+    352099001761481: true,
+  } {
+    if departure, ok := r.departure(code); ok != remembered || ok && departure.IMEI != code {
+      t.Errorf("IMEI %v: unexpected departure %+v, %v", code, departure, ok)
+    }
+  }
+}
+
+// KickOld must close the first connection in favour of the second.
+func TestRegistryKickOld(t *testing.T) {
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0), DuplicateLogin: KickOld})
+  defer srv.Close()
+
+  first, firstDone := loginDevice(t, srv, 1)
+  defer first.Close()
+  waitOnline(t, srv, 1)
+  second, secondDone := loginDevice(t, srv, 2)
+  defer second.Close()
+
+  waitClosed(t, firstDone)
+  waitForLog(t, logs, ErrKicked.Error())
+  if !isOpen(secondDone) {
+    t.Error("New connection closed")
+  }
+  if info, ok := srv.registry.lookup(490154203237518); !ok || info.ConnID != 2 {
+    t.Errorf("Registry does not point at the new connection: %+v", info)
+  }
+}
+
+// RejectNew must close the second connection and keep the first.
+func TestRegistryRejectNew(t *testing.T) {
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0), DuplicateLogin: RejectNew})
+  defer srv.Close()
+
+  first, firstDone := loginDevice(t, srv, 1)
+  defer first.Close()
+  waitOnline(t, srv, 1)
+  second, secondDone := loginDevice(t, srv, 2)
+  defer second.Close()
+
+  waitClosed(t, secondDone)
+  waitForLog(t, logs, ErrDuplicateLogin.Error())
+  if !isOpen(firstDone) {
+    t.Error("Existing connection closed")
+  }
+  if info, ok := srv.registry.lookup(490154203237518); !ok || info.ConnID != 1 {
+    t.Errorf("Registry does not point at the existing connection: %+v", info)
+  }
+}
+
+// AllowBoth must keep both connections, and the device online until both are gone.
+func TestRegistryAllowBoth(t *testing.T) {
+  srv, _, _ := startServer(t, Options{DuplicateLogin: AllowBoth})
+  defer srv.Close()
+
+  first, firstDone := loginDevice(t, srv, 1)
+  waitOnline(t, srv, 1)
+  second, secondDone := loginDevice(t, srv, 2)
+  defer second.Close()
+
+  if !isOpen(firstDone) || !isOpen(secondDone) {
+    t.Fatal("Connection closed")
+  }
+
+  first.Close()
+  waitClosed(t, firstDone)
+  if info, ok := srv.registry.lookup(490154203237518); !ok || info.ConnID != 2 {
+    t.Errorf("Device not online on its remaining connection: %+v", info)
+  }
+}
+
+func TestParseDuplicatePolicy(t *testing.T) {
+  for _, p := range []DuplicatePolicy{KickOld, RejectNew, AllowBoth} {
+    parsed, err := ParseDuplicatePolicy(p.String())
+    if err != nil || parsed != p {
+      t.Errorf("Unable to parse %q: got %v, %v", p.String(), parsed, err)
+    }
+  }
+  if _, err := ParseDuplicatePolicy("bogus"); err != ErrUnknownPolicy {
+    t.Errorf("Expected ErrUnknownPolicy, got %v", err)
+  }
+}
@@ -2,116 +2,889 @@
 package server
 
 import (
+  "context"
+  "crypto/tls"
   "errors"
-  "fmt"
   "github.com/MarcKriguer/thermomatic/internal/client"
   "github.com/MarcKriguer/thermomatic/internal/common"
   "github.com/MarcKriguer/thermomatic/internal/imei"
   "io"
+  "log"
   "net"
+  "net/http"
+  "os"
+  "runtime/debug"
   "strconv"
+  "sync"
+  "sync/atomic"
+  "syscall"
   "time"
 )
 
 var (
-  ErrImeiTimeout    = errors.New("server: imei login timeout")
-  ErrReadingTimeout = errors.New("server: data reading timeout")
+  ErrImeiTimeout        = errors.New("server: imei login timeout")
+  ErrReadingTimeout     = errors.New("server: data reading timeout")
+  ErrDisconnected       = errors.New("server: connection closed by device")
+  ErrPeerReset          = errors.New("server: connection reset by device")
+  ErrServerClosed       = errors.New("server: server closed")
+  ErrTooManyConnections = errors.New("server: too many connections")
+  ErrWriteTimeout       = errors.New("server: device not taking its messages")
+  ErrFutureReading      = errors.New("server: backfilled Reading timestamped in the future")
 )
 
-// This is the handler that is called when a client connects to the server.
-func handleConnection(conn net.Conn) {
-  common.LogOutput("Connection accepted.")
+const (
+  // Time a device has to send its IMEI after connecting.
+  DefaultLoginTimeout = time.Second
 
-  // In case of a panic, recover by closing the connection
-  defer func() {
-    recover()
-    conn.Close()
-    return
-  }()
+  // Longest a logged-in device may go without sending a Reading.
+  DefaultReadingTimeout = 2 * time.Second
 
-  // largest valid message is a Reading
-  buffer := make([]byte, client.READING_LENGTH)
+  // Furthest in the future a backfilled Reading may be timestamped, for the drift of device clocks.
+  DefaultMaxClockSkew = time.Minute
 
-  // client has only 1 second to login (send IMEU)
-  conn.SetReadDeadline(time.Now().Add(time.Second))
+  // Bounds of the delay between retries of a temporarily failing Accept.
+  minAcceptBackoff = 5 * time.Millisecond
+  maxAcceptBackoff = time.Second
+)
 
-  // read it in
-  bytesRead, err := conn.Read(buffer)
-  if err != nil {
-    common.LogError(err)
-    conn.Close()
-    return
-  }
+// Options configures a Server. Any field left at its zero value gets the default noted next to it.
+type Options struct {
+  // Address is the TCP address to listen on (default ":1337").
+  Address string
+
+  // TLS, if set, makes Run serve device connections over TLS (default nil, plain TCP). Devices
+  // presenting a client certificate (see LoadTLSConfig for requiring one) may only log in as the
+  // IMEI it is issued to.
+  TLS *tls.Config
+
+  // LoginTimeout is how long a device has to send its IMEI (default DefaultLoginTimeout).
+  LoginTimeout time.Duration
+
+  // ReadingTimeout is how long a device may go between Readings (default DefaultReadingTimeout).
+  ReadingTimeout time.Duration
+
+  // MaxConnections caps the number of concurrent device connections (default 0, unlimited).
+  MaxConnections int
+
+  // Output receives one record per Reading (default os.Stdout).
+  Output io.Writer
+
+  // RecordFormat is the format of the records (default RecordCSV).
+  RecordFormat RecordFormat
+
+  // MaxClockSkew is how far past the time it is received a backfilled Reading may be timestamped
+  // by the device (default DefaultMaxClockSkew). Readings timestamped later are rejected.
+  MaxClockSkew time.Duration
+
+  // LoginEncoding is how the digits of the IMEI in login messages may be encoded (default
+  // imei.AnyDigits: raw or ASCII).
+  LoginEncoding imei.Encoding
+
+  // LoginLengths are the accepted lengths of login messages: imei.IMEI_LENGTH for an IMEI and
+  // imei.IMEISV_LENGTH for an IMEISV (default imei.IMEI_LENGTH only). Other lengths are ignored.
+  //
+  // The stream does not delimit the login message, so when both are accepted the longest that
+  // arrived and decodes wins: an IMEI followed by a Reading whose first byte is itself a digit in
+  // the login encoding (e.g. a temperature of exactly 0 with raw digits) would be taken for an
+  // IMEISV, and an IMEISV sent in pieces whose first 15 digits pass the check digit for an IMEI.
+  // An IMEISV is only waited for if the first 15 bytes are not a valid IMEI. Only accept both if
+  // the fleet needs it.
+  LoginLengths []int
+
+  // Access decides which devices may log in (default nil, any device with a valid IMEI).
+  Access *AccessControl
+
+  // Provisioning decides from the devices' provisioning states which may log in (default nil, no
+  // provisioning: any device the access lists let in).
+  Provisioning *Provisioning
+
+  // Keys holds the secret keys devices prove their IMEI with after logging in (default nil, no
+  // authentication: the IMEI is taken at its word). Devices without a key are then refused.
+  Keys KeyStore
+
+  // AuthTimeout is how long a device has to answer the server's nonce (default
+  // DefaultAuthTimeout).
+  AuthTimeout time.Duration
+
+  // AdminToken is the bearer token the admin HTTP endpoints require (default "", none: the admin
+  // endpoints are not served).
+  AdminToken string
+
+  // DuplicateLogin decides what happens when an online device logs in again (default KickOld).
+  DuplicateLogin DuplicatePolicy
+
+  // Validation selects the profile each device's Readings are validated against (default nil,
+  // client.DefaultProfile for every device).
+  Validation *ValidationConfig
+
+  // Firmware hosts the firmware updates offered to the devices speaking protocol v2 or later
+  // (default nil, no updates).
+  Firmware *Firmware
+
+  // HTTPAddress is the TCP address Run serves the HTTP endpoints on (default "", no HTTP).
+  HTTPAddress string
+
+  // Logger receives diagnostic messages about the server and its connections (default stderr).
+  Logger *log.Logger
+}
+
+// Server accepts device connections and writes the Readings they send to its Output.
+//
+// A Server is created with New, started with Run (or Serve) and stopped with Shutdown or Close.
+type Server struct {
+  // Statistics updated atomically (kept first in the struct for 64-bit alignment).
+  counters counters
+
+  // lastConnID is incremented atomically to give every accepted connection its own ID.
+  lastConnID uint64
+
+  opts Options
+  log  *log.Logger
 
-  // If nothing read in, we've timed out, so display the error and close the connection.
-  if bytesRead == 0 {
-    common.LogError(ErrImeiTimeout)
-    conn.Close()
-    return
+  // records writes the Reading records to the Output.
+  records *recordWriter
+
+  // registry keeps track of the devices online.
+  registry *registry
+
+  // configs keeps the configuration changes pushed to the devices.
+  configs *configQueue
+
+  startedAt time.Time
+  bytesRate rateSampler
+
+  mu         sync.Mutex
+  listeners  map[net.Listener]struct{}
+  conns      map[*conn]struct{}
+  httpServer *http.Server
+  closing    bool
+  drainBy    time.Time // read deadline imposed on every connection once closing
+
+  // handlers tracks the running handleConnection goroutines.
+  handlers sync.WaitGroup
+}
+
+// Summary counts what a Server has done since it was created.
+type Summary struct {
+  // Connections is the number of connections accepted.
+  Connections uint64
+
+  // Devices is the number of devices that logged in successfully.
+  Devices uint64
+
+  // Readings is the number of Reading records written to the Output.
+  Readings uint64
+}
+
+// conn is a single device connection being served.
+type conn struct {
+  // readings counts the Readings received, updated atomically (kept first for 64-bit alignment).
+  readings uint64
+
+  id          uint64
+  netConn     net.Conn
+  connectedAt time.Time
+
+  // mu guards the fields below, which are shared with the registry.
+  mu            sync.Mutex
+  loggedIn      bool
+  imei          imei.IMEI // code of the device, set when it logs in
+  svn           int       // software version number of an IMEISV login, or imei.NoSoftwareVersion
+  protocol      int       // protocol version negotiated, or 0 until it is
+  kickReason    error
+  lastReadingAt time.Time
+  lastReading   client.Reading
+
+  // writeMu serializes the messages sent to the device, out being the buffer they are encoded in.
+  writeMu sync.Mutex
+  out     []byte
+}
+
+// login records that the device with IMEI code logged in on c.
+func (c *conn) login(code imei.IMEI) {
+  c.mu.Lock()
+  c.loggedIn = true
+  c.imei = code
+  c.mu.Unlock()
+}
+
+// identity describes the device on c for the logs: its IMEI, once it has logged in.
+func (c *conn) identity() string {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if !c.loggedIn {
+    return "device not logged in"
   }
+  return "IMEI " + c.imei.String()
+}
 
-  // validate the login attempt
-  imei, err := imei.Decode(buffer[0:imei.IMEI_LENGTH])
-  if err != nil {
-    common.LogError(err)
-    conn.Close()
-    return
+// setSoftwareVersion records the software version number the device on c logged in with.
+func (c *conn) setSoftwareVersion(svn int) {
+  c.mu.Lock()
+  c.svn = svn
+  c.mu.Unlock()
+}
+
+// setProtocol records the protocol version negotiated with the device on c.
+func (c *conn) setProtocol(version int) {
+  c.mu.Lock()
+  c.protocol = version
+  c.mu.Unlock()
+}
+
+// send writes a version 2 message of type t carrying payload to the device on c, giving the device
+// until timeout to take it. It is safe to call from any goroutine.
+func (c *conn) send(t client.MessageType, payload []byte, timeout time.Duration) error {
+  c.writeMu.Lock()
+  defer c.writeMu.Unlock()
+  c.out = client.AppendMessage(c.out[:0], t, payload)
+  c.netConn.SetWriteDeadline(time.Now().Add(timeout))
+  _, err := c.netConn.Write(c.out)
+  return err
+}
+
+// kick closes c from another goroutine, recording reason as the reason it was closed for.
+func (c *conn) kick(reason error) {
+  c.mu.Lock()
+  if c.kickReason == nil {
+    c.kickReason = reason
   }
+  c.mu.Unlock()
+  c.netConn.Close()
+}
 
-  // repeatedly read in next Reading (with a 1-second timeout) and just output it.
-  var reading client.Reading
+// kicked returns the reason c was kicked for, or nil if it was not.
+func (c *conn) kicked() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.kickReason
+}
 
-  for {
-    // Set the timeout for the data reading to 1 second
-    conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+// setLastReading records r, received at the given time, as the last valid Reading on c.
+func (c *conn) setLastReading(received time.Time, r *client.Reading) {
+  c.mu.Lock()
+  c.lastReadingAt = received
+  c.lastReading = *r
+  c.mu.Unlock()
+}
 
-    // read in next Reading
-    bytesRead, err := conn.Read(buffer)
+// device describes the device logged in on c.
+func (c *conn) device() Device {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return Device{
+    IMEI:            c.imei,
+    SoftwareVersion: c.svn,
+    Protocol:        c.protocol,
+    ConnID:          c.id,
+    RemoteAddr:      c.netConn.RemoteAddr().String(),
+    ConnectedAt:     c.connectedAt,
+    Readings:        atomic.LoadUint64(&c.readings),
+    LastReadingAt:   c.lastReadingAt,
+    LastReading:     c.lastReading,
+  }
+}
 
-    // Check the length, if it's 0 then we've timed out and need to close the connection.
-    if bytesRead == 0 {
-      common.LogError(ErrReadingTimeout)
-      conn.Close()
-      return
+// New returns a Server configured by opts. The server does not listen until Run or Serve is called.
+func New(opts Options) *Server {
+  if opts.Address == "" {
+    opts.Address = ":" + strconv.Itoa(common.DefaultTheromaticPort)
+  }
+  if opts.LoginTimeout <= 0 {
+    opts.LoginTimeout = DefaultLoginTimeout
+  }
+  if opts.ReadingTimeout <= 0 {
+    opts.ReadingTimeout = DefaultReadingTimeout
+  }
+  if opts.AuthTimeout <= 0 {
+    opts.AuthTimeout = DefaultAuthTimeout
+  }
+  if opts.MaxClockSkew <= 0 {
+    opts.MaxClockSkew = DefaultMaxClockSkew
+  }
+  if opts.LoginEncoding == 0 {
+    opts.LoginEncoding = imei.AnyDigits
+  }
+  opts.LoginLengths = loginLengths(opts.LoginLengths)
+  if opts.Output == nil {
+    opts.Output = os.Stdout
+  }
+  if opts.Logger == nil {
+    opts.Logger = log.New(os.Stderr, "Thermomatic: ", log.LstdFlags|log.Lmicroseconds)
+  }
+
+  s := &Server{
+    opts:      opts,
+    log:       opts.Logger,
+    records:   newRecordWriter(opts.Output, opts.RecordFormat),
+    registry:  newRegistry(opts.DuplicateLogin, opts.Logger),
+    configs:   newConfigQueue(),
+    startedAt: time.Now(),
+    listeners: make(map[net.Listener]struct{}),
+    conns:     make(map[*conn]struct{}),
+  }
+  s.bytesRate.record(s.startedAt, 0)
+  return s
+}
+
+// loginLengths returns the supported login message lengths among lengths, longest first, or just
+// imei.IMEI_LENGTH if there are none.
+func loginLengths(lengths []int) []int {
+  var supported []int
+  for _, length := range []int{imei.IMEISV_LENGTH, imei.IMEI_LENGTH} {
+    for _, l := range lengths {
+      if l == length {
+        supported = append(supported, length)
+        break
+      }
     }
+  }
+  if len(supported) == 0 {
+    return []int{imei.IMEI_LENGTH}
+  }
+  return supported
+}
+
+// Run listens on the configured Address (over TLS if configured) and serves device connections
+// until ctx is done or the server is shut down. If an HTTPAddress is configured, Run serves the
+// HTTP endpoints there too.
+//
+// Run returns ErrServerClosed after Shutdown or Close, ctx.Err() once ctx is done, or the error
+// that stopped the listener.
+func (s *Server) Run(ctx context.Context) error {
+  link, err := net.Listen("tcp", s.opts.Address)
+  if err != nil {
+    return err
+  }
+  if s.opts.TLS != nil {
+    link = tls.NewListener(link, s.opts.TLS)
+  }
+  if s.opts.HTTPAddress != "" {
+    httpLink, err := net.Listen("tcp", s.opts.HTTPAddress)
     if err != nil {
-      if err == io.EOF {
-        common.LogOutput("Connection closed by client!")
+      link.Close()
+      return err
+    }
+    s.serveHTTP(httpLink)
+  }
+  return s.Serve(ctx, link)
+}
+
+// Serve accepts device connections on link until ctx is done or the server is shut down. Serve
+// always closes link before returning.
+//
+// When ctx is done every device connection is closed immediately; use Shutdown to drain them.
+func (s *Server) Serve(ctx context.Context, link net.Listener) error {
+  if !s.trackListener(link) {
+    link.Close()
+    return ErrServerClosed
+  }
+  defer s.untrackListener(link)
+
+  s.log.Printf("Listening for devices on %v", link.Addr())
+
+  // Stop everything once ctx is done (unless Serve has already returned), sampling the byte count
+  // for the rate of Stats meanwhile.
+  stop := make(chan struct{})
+  defer close(stop)
+  go func() {
+    ticker := time.NewTicker(rateInterval)
+    defer ticker.Stop()
+    for {
+      select {
+      case <-ctx.Done():
+        s.Close()
+        return
+      case <-stop:
         return
+      case now := <-ticker.C:
+        s.bytesRate.record(now, atomic.LoadUint64(&s.counters.bytesRead))
+      }
+    }
+  }()
+
+  // Wait for client connections here. Handle new connections in their own goroutine.
+  var backoff time.Duration
+  for {
+    netConn, err := link.Accept()
+    if err != nil {
+      if s.isClosing() {
+        if ctx.Err() != nil {
+          return ctx.Err()
+        }
+        return ErrServerClosed
       }
+      if ne, ok := err.(net.Error); ok && ne.Temporary() {
+        if backoff == 0 {
+          backoff = minAcceptBackoff
+        } else if backoff *= 2; backoff > maxAcceptBackoff {
+          backoff = maxAcceptBackoff
+        }
+        s.log.Printf("Accept error: %v; retrying in %v", err, backoff)
+        time.Sleep(backoff)
+        continue
+      }
+      s.log.Printf("Accept error: %v; no longer listening on %v", err, link.Addr())
+      return err
+    }
+    backoff = 0
+
+    atomic.AddUint64(&s.counters.connections, 1)
+    c := &conn{id: atomic.AddUint64(&s.lastConnID, 1), netConn: netConn, connectedAt: time.Now()}
+    if err := s.trackConn(c); err != nil {
+      s.log.Printf("conn %d: rejected from %v: %v", c.id, netConn.RemoteAddr(), err)
+      netConn.Close()
+      continue
+    }
+    go s.handleConnection(c)
+  }
+}
+
+// Shutdown gracefully stops the server. It closes every listener so no new device can connect, lets
+// each connected device finish the message it is sending, closes its connection with reason
+// ErrServerClosed and waits for all connection handlers to return.
+//
+// Devices get until ctx's deadline (or no time at all if ctx has none) to complete the message in
+// flight. If ctx is done before every handler has returned, the remaining connections are closed
+// forcibly and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+  drainBy, ok := ctx.Deadline()
+  if !ok {
+    drainBy = time.Now()
+  }
+
+  s.mu.Lock()
+  if !s.closing {
+    s.log.Printf("Shutting down (draining %d connection(s))", len(s.conns))
+  }
+  s.closing = true
+  if s.drainBy.IsZero() || drainBy.Before(s.drainBy) {
+    s.drainBy = drainBy
+  }
+  for link := range s.listeners {
+    link.Close()
+  }
+  // Wake up the connections blocked waiting for data, so they notice the server is closing.
+  for c := range s.conns {
+    c.netConn.SetReadDeadline(s.drainBy)
+  }
+  httpServer := s.httpServer
+  s.mu.Unlock()
+
+  if httpServer != nil {
+    httpServer.Shutdown(ctx)
+  }
+
+  drained := make(chan struct{})
+  go func() {
+    s.handlers.Wait()
+    close(drained)
+  }()
+
+  select {
+  case <-drained:
+    return s.records.flush()
+  case <-ctx.Done():
+    s.closeConns()
+    <-drained
+    s.records.flush()
+    return ctx.Err()
+  }
+}
+
+// Summary returns the server's counters. It is safe to call at any time, including after Shutdown.
+func (s *Server) Summary() Summary {
+  return Summary{
+    Connections: atomic.LoadUint64(&s.counters.connections),
+    Devices:     atomic.LoadUint64(&s.counters.logins),
+    Readings:    atomic.LoadUint64(&s.counters.readingsAccepted),
+  }
+}
+
+// Device returns the device with IMEI code if it is online. If it is logged in on several
+// connections, the most recent one is described.
+func (s *Server) Device(code imei.IMEI) (Device, bool) {
+  return s.registry.lookup(code)
+}
+
+// Close immediately stops the server: it closes every listener and every device connection, then
+// waits for all connection handlers to return.
+func (s *Server) Close() error {
+  s.mu.Lock()
+  s.closing = true
+  s.drainBy = time.Now()
+  for link := range s.listeners {
+    link.Close()
+  }
+  httpServer := s.httpServer
+  s.mu.Unlock()
+
+  if httpServer != nil {
+    httpServer.Close()
+  }
+  s.closeConns()
+  s.handlers.Wait()
+  return s.records.flush()
+}
+
+// closeConns forcibly closes every tracked device connection.
+func (s *Server) closeConns() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for c := range s.conns {
+    c.netConn.Close()
+  }
+}
+
+// isClosing reports whether Shutdown or Close has been called.
+func (s *Server) isClosing() bool {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.closing
+}
+
+// trackListener registers link so Shutdown can close it. Returns false if the server is closing.
+func (s *Server) trackListener(link net.Listener) bool {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.closing {
+    return false
+  }
+  s.listeners[link] = struct{}{}
+  return true
+}
+
+// untrackListener closes link and forgets about it.
+func (s *Server) untrackListener(link net.Listener) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  link.Close()
+  delete(s.listeners, link)
+}
+
+// trackConn registers c and accounts for its handler. It fails if the server is closing or the
+// connection limit has been reached.
+func (s *Server) trackConn(c *conn) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.closing {
+    return ErrServerClosed
+  }
+  if s.opts.MaxConnections > 0 && len(s.conns) >= s.opts.MaxConnections {
+    return ErrTooManyConnections
+  }
+  s.conns[c] = struct{}{}
+  s.handlers.Add(1)
+  return nil
+}
+
+// untrackConn forgets about c once its handler is done.
+func (s *Server) untrackConn(c *conn) {
+  s.mu.Lock()
+  delete(s.conns, c)
+  s.mu.Unlock()
+  s.handlers.Done()
+}
+
+// setReadDeadline gives c until timeout from now to deliver its next message, or less if the
+// server is draining.
+func (s *Server) setReadDeadline(c *conn, timeout time.Duration) {
+  deadline := time.Now().Add(timeout)
+
+  // Hold the lock while setting the deadline so it cannot override the one set by Shutdown.
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.closing && s.drainBy.Before(deadline) {
+    deadline = s.drainBy
+  }
+  c.netConn.SetReadDeadline(deadline)
+}
+
+// This is the handler that is called when a client connects to the server. It logs the connection's
+// lifecycle and closes it, with the reason, when serve returns.
+func (s *Server) handleConnection(c *conn) {
+  defer s.untrackConn(c)
+
+  s.log.Printf("conn %d: accepted from %v", c.id, c.netConn.RemoteAddr())
+
+  // Decoding never panics on bad input, so a panic is a bug: log it with everything needed to track
+  // it down, and close the connection rather than bring down the whole server.
+  defer func() {
+    if r := recover(); r != nil {
+      s.log.Printf("conn %d: panic serving %v: %v\n%s", c.id, c.identity(), r, debug.Stack())
+      c.netConn.Close()
     }
+  }()
 
-    // Decode the Reading
-    reading.Decode(buffer[0:client.READING_LENGTH])
+  frames := newFramer(c.netConn)
+  readings, reason := s.serve(c, frames)
 
-    // Log the Reading's data
-    common.LogOutput("valid Reading read.\n" + fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v\n", imei,
-        time.Now().UnixNano(), reading.Temperature, reading.Altitude, reading.Latitude,
-        reading.Longitude, reading.BatteryLevel))
+  // Closing a socket with unread data resets the connection, so the device's next write fails
+  // straight away. Devices dropped for misbehaving get the same treatment for the data the framer
+  // read ahead, rather than a clean close just because it was buffered.
+  if tcp, ok := tcpConn(c.netConn); ok && reason != ErrDisconnected &&
+      reason != ErrServerClosed && frames.unread() > 0 {
+    tcp.SetLinger(0)
   }
+  c.netConn.Close()
+  s.log.Printf("conn %d: closed after %d reading(s): %v", c.id, readings, reason)
 }
 
-// This function is called to start the socket server on the given port.
-func StartServer(port int) {
-  common.LogOutput("Starting server on port " + strconv.Itoa(port))
+// serve logs in the device on c, negotiates the protocol version and then reads its Readings from
+// frames until something goes wrong. It returns the number of Readings read and the reason the
+// connection has to be closed.
+func (s *Server) serve(c *conn, frames *framer) (readings int, reason error) {
+  code, err := s.login(c, frames)
+  if err != nil {
+    s.counters.loginFailed(err)
+    return 0, err
+  }
+  defer func() {
+    s.registry.logout(c, reason)
+  }()
+  atomic.AddUint64(&s.counters.logins, 1)
 
-  // Set up the socket and start listening on it.
-  link, err := net.Listen("tcp", ":" + strconv.Itoa(port))
+  version, err := s.negotiate(c, frames)
   if err != nil {
-    common.LogError(err)
-    return
+    return 0, err
+  }
+  if version != client.PROTOCOL_V1 {
+    s.log.Printf("conn %d: speaking protocol v%d", c.id, version)
+    if err := s.pushConfigs(c, code); err != nil {
+      return 0, s.readFailure(c, err, ErrWriteTimeout)
+    }
+    if err := s.offerFirmware(c, code); err != nil {
+      return 0, s.readFailure(c, err, ErrWriteTimeout)
+    }
   }
 
-  // Make sure the socket is eventually closed.
-  defer link.Close()
+  // repeatedly read in next message (with a ReadingTimeout timeout) and output the valid Readings,
+  // acknowledging them if the device asks for it.
+  var reading client.Reading
+  var extras client.Extras
+  var batch client.Batch
+  profile := s.opts.Validation.ProfileFor(code)
+  if profile != &client.DefaultProfile {
+    s.log.Printf("conn %d: validating Readings with profile %q", c.id, profile.Name)
+  }
+  acks := acker{c: c, timeout: s.opts.ReadingTimeout}
 
-  // Wait for client connections here. Handle new connections in their own goroutine.
   for {
-    conn, err := link.Accept()
+    // Stop at a message boundary once the server is shutting down.
+    if s.isClosing() {
+      return readings, ErrServerClosed
+    }
+
+    s.setReadDeadline(c, s.opts.ReadingTimeout)
+
+    // read in next message
+    typ, frame, err := s.nextMessage(frames, version)
     if err != nil {
-      common.LogError(err)
-      return
+      return readings, s.readFailure(c, err, ErrReadingTimeout)
     }
-    go handleConnection(conn)
+
+    switch typ {
+    case client.MessageReading:
+      readings++
+      err = acks.reading(s.handleReading(c, code, frame, 0, profile, &reading, &extras))
+    case client.MessageReadingBatch:
+      var n int
+      n, err = s.handleBatch(c, code, frame, profile, &batch, &reading, &extras, &acks)
+      readings += n
+    case client.MessageAckMode:
+      err = acks.setMode(frame)
+      s.log.Printf("conn %d: acknowledging Readings: %v", c.id, acks.mode)
+    case client.MessageConfigAck:
+      s.confirmConfig(c, code, frame)
+    case client.MessageFirmwareRequest:
+      err = s.sendFirmwareChunk(c, code, frame)
+    case client.MessageFirmwareStatus:
+      s.reportFirmware(c, code, frame)
+    default:
+      s.log.Printf("conn %d: message of unknown %v skipped", c.id, typ)
+    }
+    if err == nil && frames.unread() == 0 {
+      err = acks.flush()
+    }
+    if err != nil {
+      return readings, s.readFailure(c, err, ErrWriteTimeout)
+    }
+  }
+}
+
+// handleReading decodes the Reading in frame, with its extra sensors (if any), received from the
+// device with IMEI code on c, and outputs its record if it is valid against profile. taken is the
+// time a backfilled Reading was taken, as given by the device, and 0 for a Reading sent as it is
+// taken. It returns the outcome, for the device's acknowledgement.
+func (s *Server) handleReading(c *conn, code imei.IMEI, frame []byte, taken int64,
+    profile *client.Profile, reading *client.Reading, extras *client.Extras) client.Ack {
+  received := time.Now()
+  atomic.AddUint64(&c.readings, 1)
+
+  // A backfilled Reading can't be from the future, the drift of the device's clock aside
+  if taken > received.Add(s.opts.MaxClockSkew).UnixNano() {
+    s.counters.readingRejected(ErrFutureReading)
+    s.log.Printf("conn %d: invalid Reading dropped: %v", c.id, ErrFutureReading)
+    return client.Ack{Code: client.NackOutOfRange, Field: client.NoField}
+  }
+
+  // Decode the Reading, dropping it if any field is out of range
+  if err := reading.TryDecodeExtended(frame, profile, extras); err != nil {
+    s.counters.readingRejected(err)
+    s.log.Printf("conn %d: invalid Reading dropped: %v", c.id, err)
+    switch err := err.(type) {
+    case *client.RangeError:
+      return client.Ack{Code: client.NackOutOfRange, Field: err.Field}
+    case *client.SensorRangeError:
+      return client.Ack{Code: client.NackOutOfRange, Field: client.NoField}
+    }
+    return client.Ack{Code: client.NackMalformed, Field: client.NoField}
+  }
+
+  // Output the Reading's record. A backfilled Reading is older than the last one received live.
+  timestamp := taken
+  if taken == 0 {
+    timestamp = received.UnixNano()
+    c.setLastReading(received, reading)
+  }
+  if err := s.records.write(timestamp, code, reading, extras, taken != 0); err != nil {
+    s.log.Printf("conn %d: unable to write record: %v", c.id, err)
+    return client.Ack{Code: client.NackNotRecorded, Field: client.NoField}
+  }
+  atomic.AddUint64(&s.counters.readingsAccepted, 1)
+  if taken != 0 {
+    atomic.AddUint64(&s.counters.readingsBackfilled, 1)
+  }
+  return client.Ack{Code: client.AckAccepted, Field: client.NoField}
+}
+
+// handleBatch handles the Readings of the MessageReadingBatch in frame, in order, as backfilled
+// Readings taken at the times the device gives, and hands their outcomes to acks. It returns the
+// number of Readings in the batch, or client.ErrBadBatch if it is malformed, which drops the
+// connection.
+func (s *Server) handleBatch(c *conn, code imei.IMEI, frame []byte, profile *client.Profile,
+    batch *client.Batch, reading *client.Reading, extras *client.Extras, acks *acker) (int, error) {
+  n, err := batch.Reset(frame)
+  if err != nil {
+    return 0, err
+  }
+  if s.opts.RecordFormat == RecordCSV {
+    s.log.Printf("conn %d: %d backfilled Reading(s) recorded without a flag (record format %v)",
+        c.id, n, RecordCSV)
+  }
+  for batch.Next() {
+    ack := s.handleReading(c, code, batch.Reading, batch.Timestamp, profile, reading, extras)
+    if err := acks.reading(ack); err != nil {
+      return n, err
+    }
+  }
+  return n, nil
+}
+
+// login reads the login message from the device on c, validates its IMEI and brings the device
+// online. It returns the device's IMEI code, or the reason the login failed.
+func (s *Server) login(c *conn, frames *framer) (code imei.IMEI, err error) {
+  // client has only LoginTimeout to login (send IMEI)
+  s.setReadDeadline(c, s.opts.LoginTimeout)
+
+  // read in the shortest login message accepted: a device sending it may be waiting for a reply
+  // (e.g. a challenge), so a longer one is only waited for if it is invalid
+  lengths := s.opts.LoginLengths
+  shortest := lengths[len(lengths)-1]
+  if frame, readErr := frames.peek(shortest); len(frame) < shortest {
+    // not even the shortest login message arrived
+    return 0, s.readFailure(c, readErr, ErrImeiTimeout)
+  }
+
+  // validate the login attempt, trying the longest message that arrived first
+  var svn int
+  consumed := 0
+  for i := len(lengths) - 1; i >= 0 && consumed == 0; i-- {
+    if frame, _ := frames.peek(lengths[i]); len(frame) < lengths[i] {
+      // the device sent no longer message in time
+      break
+    }
+    frame := frames.buffered(lengths[0])
+    for _, length := range lengths[:i+1] {
+      if len(frame) < length {
+        continue
+      }
+      decoded, version, decodeErr := imei.DecodeLogin(frame[:length], s.opts.LoginEncoding)
+      if decodeErr == nil {
+        code, svn, consumed = decoded, version, length
+        break
+      }
+      if length == shortest {
+        err = decodeErr
+      }
+    }
+  }
+  if consumed == 0 {
+    frames.take(shortest)
+    atomic.AddUint64(&s.counters.bytesRead, uint64(shortest))
+    return 0, err
+  }
+  frames.take(consumed)
+  atomic.AddUint64(&s.counters.bytesRead, uint64(consumed))
+
+  // turn away the devices the access lists keep out
+  if err := s.opts.Access.Check(code); err != nil {
+    s.log.Printf("conn %d: login as IMEI %v refused: %v", c.id, code, err)
+    return 0, err
+  }
+
+  // make the device prove its IMEI before letting it register or log in
+  if err := c.checkCertificate(code); err != nil {
+    s.log.Printf("conn %d: login as IMEI %v refused: %v", c.id, code, err)
+    return 0, err
+  }
+  if s.opts.Keys != nil {
+    if err := s.authenticate(c, frames, code); err != nil {
+      s.log.Printf("conn %d: login as IMEI %v refused: %v", c.id, code, err)
+      return 0, err
+    }
+  }
+  if err := s.opts.Provisioning.Check(code); err != nil {
+    s.log.Printf("conn %d: login as IMEI %v refused: %v", c.id, code, err)
+    return 0, err
+  }
+
+  c.setSoftwareVersion(svn)
+  if svn == imei.NoSoftwareVersion {
+    s.log.Printf("conn %d: logged in as IMEI %v", c.id, code)
+  } else {
+    s.log.Printf("conn %d: logged in as IMEI %v (IMEISV, software version %02d)", c.id, code, svn)
+  }
+
+  // bring the device online (subject to the duplicate login policy)
+  if err := s.registry.login(c, code); err != nil {
+    return 0, err
+  }
+  return code, nil
+}
+
+// readFailure returns the reason c has to be closed after failing to read a frame (or write a
+// message) with err. timeout is the reason to give if the device did not send (or take) it in
+// time.
+func (s *Server) readFailure(c *conn, err error, timeout error) error {
+  if reason := c.kicked(); reason != nil {
+    return reason
+  }
+  if ne, ok := err.(net.Error); ok && ne.Timeout() {
+    // Shutdown cuts the read deadline short: that is not the device's fault.
+    if s.isClosing() {
+      return ErrServerClosed
+    }
+    return timeout
+  }
+  if err == io.EOF {
+    return ErrDisconnected
+  }
+  if errors.Is(err, net.ErrClosed) && s.isClosing() {
+    return ErrServerClosed
+  }
+  if errors.Is(err, syscall.ECONNRESET) {
+    return ErrPeerReset
   }
+  return err
 }
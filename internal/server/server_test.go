@@ -0,0 +1,434 @@
+package server
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "crypto/tls"
+  "errors"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io"
+  "io/ioutil"
+  "log"
+  "net"
+  "strings"
+  "sync"
+  "syscall"
+  "testing"
+  "time"
+)
+
+// syncBuffer is a bytes.Buffer safe for use as a Server's Output or log destination.
+type syncBuffer struct {
+  mu  sync.Mutex
+  buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.buf.String()
+}
+
+// startServer starts a Server on a random loopback port (over TLS if opts.TLS is set). It returns
+// the server, its address and the channel that will receive Serve's result.
+func startServer(t *testing.T, opts Options) (*Server, string, chan error) {
+  link, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Unable to listen: %v", err)
+  }
+  if opts.Output == nil {
+    opts.Output = ioutil.Discard
+  }
+  if opts.Logger == nil {
+    opts.Logger = log.New(ioutil.Discard, "", 0)
+  }
+
+  if opts.TLS != nil {
+    link = tls.NewListener(link, opts.TLS)
+  }
+
+  srv := New(opts)
+  done := make(chan error, 1)
+  go func() {
+    done <- srv.Serve(context.Background(), link)
+  }()
+  return srv, link.Addr().String(), done
+}
+
+// waitResult waits for the result of Serve (or Run).
+func waitResult(t *testing.T, done chan error) error {
+  select {
+  case err := <-done:
+    return err
+  case <-time.After(5 * time.Second):
+    t.Fatal("Serve did not return")
+    return nil
+  }
+}
+
+// Shutdown must stop the listener, close connected devices and make Serve return ErrServerClosed.
+func TestServerShutdown(t *testing.T) {
+  logs := &syncBuffer{}
+  srv, addr, done := startServer(t, Options{Logger: log.New(logs, "", 0)})
+
+  device, err := net.Dial("tcp", addr)
+  if err != nil {
+    t.Fatalf("Unable to connect: %v", err)
+  }
+  defer device.Close()
+
+  // make sure the connection has been accepted before shutting down
+  time.Sleep(50 * time.Millisecond)
+
+  if err := srv.Shutdown(context.Background()); err != nil {
+    t.Errorf("Shutdown returned unexpected error: %v", err)
+  }
+  if err := waitResult(t, done); err != ErrServerClosed {
+    t.Errorf("Serve returned %v instead of ErrServerClosed", err)
+  }
+
+  // the device must see its connection closed
+  device.SetReadDeadline(time.Now().Add(time.Second))
+  if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+    t.Errorf("Device connection not closed by Shutdown (read returned %v)", err)
+  }
+  if !strings.Contains(logs.String(), ErrServerClosed.Error()) {
+    t.Errorf("Close reason not logged:\n%s", logs.String())
+  }
+
+  // and nobody can connect any more
+  if _, err := net.Dial("tcp", addr); err == nil {
+    t.Errorf("Able to connect after Shutdown")
+  }
+}
+
+// Cancelling the context passed to Serve must stop the server too.
+func TestServerContextCancel(t *testing.T) {
+  link, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Unable to listen: %v", err)
+  }
+  srv := New(Options{Output: ioutil.Discard, Logger: log.New(ioutil.Discard, "", 0)})
+
+  ctx, cancel := context.WithCancel(context.Background())
+  done := make(chan error, 1)
+  go func() {
+    done <- srv.Serve(ctx, link)
+  }()
+
+  cancel()
+  if err := waitResult(t, done); err != context.Canceled {
+    t.Errorf("Serve returned %v instead of context.Canceled", err)
+  }
+}
+
+// Connections beyond MaxConnections must be closed straight away.
+func TestServerMaxConnections(t *testing.T) {
+  srv, addr, done := startServer(t, Options{MaxConnections: 1})
+  defer func() {
+    srv.Close()
+    waitResult(t, done)
+  }()
+
+  first, err := net.Dial("tcp", addr)
+  if err != nil {
+    t.Fatalf("Unable to connect: %v", err)
+  }
+  defer first.Close()
+  time.Sleep(50 * time.Millisecond)
+
+  second, err := net.Dial("tcp", addr)
+  if err != nil {
+    t.Fatalf("Unable to connect: %v", err)
+  }
+  defer second.Close()
+
+  second.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+  if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+    t.Errorf("Connection over the limit not closed (read returned %v)", err)
+  }
+}
+
+// Shutdown must flush a buffered Output and the Summary must count what was done.
+func TestServerShutdownFlushesOutput(t *testing.T) {
+  records := &syncBuffer{}
+  output := bufio.NewWriter(records)
+  srv, addr, done := startServer(t, Options{Output: output})
+
+  device, err := net.Dial("tcp", addr)
+  if err != nil {
+    t.Fatalf("Unable to connect: %v", err)
+  }
+  defer device.Close()
+
+  reading := client.Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41,
+      Longitude: 44.4, BatteryLevel: 0.25666}
+  device.Write(client.ValidImei)
+  time.Sleep(50 * time.Millisecond)
+  device.Write(reading.Encode())
+  time.Sleep(50 * time.Millisecond)
+
+  if err := srv.Shutdown(context.Background()); err != nil {
+    t.Errorf("Shutdown returned unexpected error: %v", err)
+  }
+  waitResult(t, done)
+
+  if !strings.Contains(records.String(), "67.77,2.63555,33.41,44.4,0.25666\n") {
+    t.Errorf("Record not flushed on Shutdown (output %q)", records.String())
+  }
+  summary := srv.Summary()
+  if summary.Connections != 1 || summary.Devices != 1 || summary.Readings != 1 {
+    t.Errorf("Unexpected summary %+v", summary)
+  }
+}
+
+// waitForLog waits for the server's log to contain text.
+func waitForLog(t *testing.T, logs *syncBuffer, text string) {
+  for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+    if strings.Contains(logs.String(), text) {
+      return
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Errorf("%q not logged:\n%s", text, logs.String())
+}
+
+// A device that does not log in within LoginTimeout is dropped with ErrImeiTimeout.
+func TestServerLoginTimeout(t *testing.T) {
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0),
+      LoginTimeout: 50 * time.Millisecond})
+  defer srv.Close()
+
+  device, server := net.Pipe()
+  defer device.Close()
+  <-serveConn(t, srv, server)
+  waitForLog(t, logs, ErrImeiTimeout.Error())
+}
+
+// The reading timeout is distinct from the login one: a device is only dropped with
+// ErrReadingTimeout once ReadingTimeout has passed without a Reading.
+func TestServerReadingTimeout(t *testing.T) {
+  logs := &syncBuffer{}
+  records := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0), Output: records,
+      LoginTimeout: 50 * time.Millisecond, ReadingTimeout: 300 * time.Millisecond})
+  defer srv.Close()
+
+  device, server := net.Pipe()
+  defer device.Close()
+  done := serveConn(t, srv, server)
+
+  // Readings sent further apart than LoginTimeout (but within ReadingTimeout) are fine.
+  device.Write(client.ValidImei)
+  for i := 0; i < 2; i++ {
+    time.Sleep(100 * time.Millisecond)
+    if _, err := device.Write(testReading.Encode()); err != nil {
+      t.Fatalf("Device dropped before ReadingTimeout: %v", err)
+    }
+  }
+
+  <-done
+  waitForLog(t, logs, ErrReadingTimeout.Error())
+  if strings.Count(records.String(), "\n") != 2 {
+    t.Errorf("Expected 2 records, got %q", records.String())
+  }
+}
+
+// A device closing its connection is logged as such, not as a timeout.
+func TestServerDeviceDisconnects(t *testing.T) {
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0)})
+  defer srv.Close()
+
+  device, server := net.Pipe()
+  done := serveConn(t, srv, server)
+  device.Write(client.ValidImei)
+  device.Close()
+  <-done
+  waitForLog(t, logs, ErrDisconnected.Error())
+}
+
+// A device dropped for misbehaving gets a reset if it sent data the server left unread, and a
+// clean close otherwise.
+func TestServerResetsUnreadData(t *testing.T) {
+  srv, address, _ := startServer(t, Options{})
+  defer srv.Close()
+
+  invalid := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 9}
+  for _, unread := range []bool{false, true} {
+    device, err := net.Dial("tcp", address)
+    if err != nil {
+      t.Fatalf("Unable to connect: %v", err)
+    }
+    login := invalid
+    if unread {
+      login = append(append([]byte{}, invalid...), testReading.Encode()...)
+    }
+    device.Write(login)
+    device.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, err = device.Read(make([]byte, 1))
+    device.Close()
+    if reset := errors.Is(err, syscall.ECONNRESET); reset != unread || !reset && err != io.EOF {
+      t.Errorf("Unread data %v: unexpected %v", unread, err)
+    }
+  }
+}
+
+// Devices may send their IMEI in ASCII or raw digits, unless LoginEncoding restricts it.
+func TestServerLoginEncoding(t *testing.T) {
+  cases := []struct {
+    encoding imei.Encoding
+    login    []byte
+    ok       bool
+  }{
+    {0, client.ValidImei, true},
+    {0, client.ValidAsciiImei, true},
+    {imei.ASCIIDigits, client.ValidAsciiImei, true},
+    {imei.ASCIIDigits, client.ValidImei, false},
+    {imei.RawDigits, client.ValidAsciiImei, false},
+  }
+
+  for _, c := range cases {
+    records := &syncBuffer{}
+    srv, _, _ := startServer(t, Options{Output: records, LoginEncoding: c.encoding})
+
+    device, server := net.Pipe()
+    done := serveConn(t, srv, server)
+    go func() {
+      device.Write(c.login)
+      device.Write(testReading.Encode())
+      device.Close()
+    }()
+    <-done
+    srv.Close()
+
+    if ok := strings.Contains(records.String(), ",490154203237518,"); ok != c.ok {
+      t.Errorf("Login %q with encoding %v: accepted %v instead of %v", c.login, c.encoding, ok,
+          c.ok)
+    }
+  }
+}
+
+// Devices may log in with an IMEISV, mapped onto their IMEI, if LoginLengths accepts it. Logins of
+// the wrong length must be rejected without losing track of the Readings that follow.
+func TestServerLoginLengths(t *testing.T) {
+  imeisv := []byte("4901542032375107")
+  rawImeisv := []byte{4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 0, 7}
+  both := []int{imei.IMEI_LENGTH, imei.IMEISV_LENGTH}
+
+  cases := []struct {
+    lengths []int
+    login   []byte
+    svn     int // imei.NoSoftwareVersion for a plain IMEI, -2 if the login must be rejected
+  }{
+    {nil, client.ValidAsciiImei, imei.NoSoftwareVersion},
+    {nil, imeisv, -2},
+    {[]int{imei.IMEISV_LENGTH}, imeisv, 7},
+    {[]int{imei.IMEISV_LENGTH}, client.ValidAsciiImei, -2},
+    {[]int{imei.IMEISV_LENGTH}, imeisv[:10], -2},
+    {both, client.ValidAsciiImei, imei.NoSoftwareVersion},
+    {both, client.ValidImei, imei.NoSoftwareVersion},
+    {both, imeisv, 7},
+    {both, rawImeisv, 7},
+    {[]int{42}, client.ValidImei, imei.NoSoftwareVersion},
+  }
+
+  for _, c := range cases {
+    records := &syncBuffer{}
+    srv, _, _ := startServer(t, Options{Output: records, LoginLengths: c.lengths})
+
+    device, server := net.Pipe()
+    done := serveConn(t, srv, server)
+    go func() {
+      device.Write(c.login)
+      device.Write(testReading.Encode())
+      device.Close()
+    }()
+    <-done
+    srv.Close()
+
+    // the Reading following an accepted login must be framed right
+    accepted := strings.HasSuffix(records.String(), testRecord[strings.Index(testRecord, ","):])
+    if accepted != (c.svn != -2) {
+      t.Errorf("Login %q with lengths %v: accepted %v", c.login, c.lengths, accepted)
+      continue
+    }
+    if departure, ok := srv.registry.departure(490154203237518); accepted &&
+        (!ok || departure.SoftwareVersion != c.svn) {
+      t.Errorf("Login %q with lengths %v: unexpected device %+v", c.login, c.lengths, departure)
+    }
+  }
+}
+
+// With both login lengths accepted, an IMEI must be taken as soon as it arrives, without waiting
+// for a 16th byte that may never come, and an IMEISV sent in pieces must still be waited for.
+func TestServerLoginLengthsNoWait(t *testing.T) {
+  srv, _, _ := startServer(t, Options{LoginTimeout: 5 * time.Second,
+      LoginLengths: []int{imei.IMEI_LENGTH, imei.IMEISV_LENGTH}})
+  defer srv.Close()
+
+  device, server := net.Pipe()
+  defer device.Close()
+  done := serveConn(t, srv, server)
+  device.Write(client.ValidAsciiImei)
+  waitOnline(t, srv, 1)
+  device.Close()
+  waitClosed(t, done)
+
+  device, server = net.Pipe()
+  defer device.Close()
+  serveConn(t, srv, server)
+  imeisv := []byte("4901542032375107")
+  device.Write(imeisv[:imei.IMEI_LENGTH])
+  time.Sleep(50 * time.Millisecond)
+  device.Write(imeisv[imei.IMEI_LENGTH:])
+  waitOnline(t, srv, 1)
+  if device, _ := srv.registry.lookup(490154203237518); device.SoftwareVersion != 7 {
+    t.Errorf("IMEISV sent in pieces: unexpected device %+v", device)
+  }
+}
+
+// panickyConn is a connection whose reads panic once the device has logged in.
+type panickyConn struct {
+  net.Conn
+  reads int
+}
+
+func (c *panickyConn) Read(b []byte) (int, error) {
+  if c.reads++; c.reads > 1 {
+    panic("boom")
+  }
+  return copy(b, client.ValidAsciiImei), nil
+}
+
+// A panic serving a connection must be logged with the connection, the device and a stack trace,
+// and only close that connection.
+func TestServerLogsPanic(t *testing.T) {
+  logs := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Logger: log.New(logs, "", 0)})
+  defer srv.Close()
+
+  _, server := net.Pipe()
+  done := serveConn(t, srv, &panickyConn{Conn: server})
+  waitClosed(t, done)
+
+  waitForLog(t, logs, "conn 1: panic serving IMEI 490154203237518: boom")
+  if !strings.Contains(logs.String(), "goroutine ") {
+    t.Errorf("No stack trace logged: %s", logs.String())
+  }
+  if _, ok := srv.registry.lookup(490154203237518); ok {
+    t.Error("Device still online after the panic")
+  }
+  if open := srv.Stats().Connections.Open; open != 0 {
+    t.Errorf("%d connection(s) still tracked", open)
+  }
+}
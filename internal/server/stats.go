@@ -0,0 +1,241 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "runtime"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Reasons a login fails for, as counted by the stats.
+const (
+  loginFailureChecksum = iota
+  loginFailureInvalid
+  loginFailureTimeout
+  loginFailureDuplicate
+  loginFailureDenied
+  loginFailureUnprovisioned
+  loginFailureAuth
+  loginFailureOther
+  loginFailureReasons // number of reasons
+)
+
+// counters are the server's ingest statistics. They are updated atomically, without locks, by the
+// connection handlers.
+type counters struct {
+  connections        uint64
+  logins             uint64
+  bytesRead          uint64
+  readingsAccepted   uint64
+  readingsRejected   uint64
+  readingsBackfilled uint64
+  loginFailures      [loginFailureReasons]uint64
+
+  // rejectedFields counts the rejected Readings by invalid field, and rejectedSensors by invalid
+  // extra sensor (indexed by client.SensorID).
+  rejectedFields  [client.NumFields]uint64
+  rejectedSensors [256]uint64
+}
+
+// readingRejected counts a Reading rejected by Reading.Decode with err, classified by field.
+func (c *counters) readingRejected(err error) {
+  atomic.AddUint64(&c.readingsRejected, 1)
+  switch err := err.(type) {
+  case *client.RangeError:
+    atomic.AddUint64(&c.rejectedFields[err.Field], 1)
+  case *client.SensorRangeError:
+    atomic.AddUint64(&c.rejectedSensors[err.Sensor], 1)
+  }
+}
+
+// loginFailed counts a failed login, classified by reason. Logins interrupted by the server shutting
+// down are not counted.
+func (c *counters) loginFailed(reason error) {
+  if reason == ErrServerClosed {
+    return
+  }
+  index := loginFailureOther
+  switch reason {
+  case imei.ErrChecksum:
+    index = loginFailureChecksum
+  case imei.ErrInvalid:
+    index = loginFailureInvalid
+  case ErrImeiTimeout:
+    index = loginFailureTimeout
+  case ErrDuplicateLogin:
+    index = loginFailureDuplicate
+  case ErrDenied, ErrNotAllowed:
+    index = loginFailureDenied
+  case ErrUnprovisioned, ErrPending, ErrSuspended, ErrRetired:
+    index = loginFailureUnprovisioned
+  case ErrAuthFailed, ErrAuthTimeout, ErrNoKey, ErrCertMismatch:
+    index = loginFailureAuth
+  }
+  atomic.AddUint64(&c.loginFailures[index], 1)
+}
+
+// Stats is the JSON document served by the /stats endpoint.
+type Stats struct {
+  StartedAt     time.Time `json:"started_at"`
+  UptimeSeconds float64   `json:"uptime_seconds"`
+  Goroutines    int       `json:"goroutines"`
+
+  Memory struct {
+    Alloc       uint64 `json:"alloc_bytes"`
+    TotalAlloc  uint64 `json:"total_alloc_bytes"`
+    Sys         uint64 `json:"sys_bytes"`
+    HeapObjects uint64 `json:"heap_objects"`
+    NumGC       uint32 `json:"num_gc"`
+  } `json:"memory"`
+
+  Connections struct {
+    Open     int    `json:"open"`
+    Accepted uint64 `json:"accepted"`
+  } `json:"connections"`
+
+  Devices struct {
+    Online   int    `json:"online"`
+    LoggedIn uint64 `json:"logged_in"`
+  } `json:"devices"`
+
+  // BytesRead.PerSecond is measured over the last 10 seconds.
+  BytesRead struct {
+    Total     uint64  `json:"total"`
+    PerSecond float64 `json:"per_second"`
+  } `json:"bytes_read"`
+
+  Readings struct {
+    Accepted uint64 `json:"accepted"`
+    Rejected uint64 `json:"rejected"`
+
+    // Backfilled counts the accepted Readings that were backfilled: sent after the fact, in a
+    // batch, with the time the device took them.
+    Backfilled uint64 `json:"backfilled"`
+
+    // RejectedByField counts the rejected Readings by the (first) field out of range, extra sensors
+    // included.
+    RejectedByField map[string]uint64 `json:"rejected_by_field"`
+  } `json:"readings"`
+
+  LoginFailures struct {
+    Checksum  uint64 `json:"checksum"`
+    Invalid   uint64 `json:"invalid"`
+    Timeout   uint64 `json:"timeout"`
+    Duplicate uint64 `json:"duplicate"`
+    Denied    uint64 `json:"denied"`
+
+    // Unprovisioned counts the devices refused for their provisioning state (or lack of one).
+    Unprovisioned uint64 `json:"unprovisioned"`
+
+    // Auth counts the devices that failed to prove their IMEI, by key or by client certificate.
+    Auth  uint64 `json:"auth"`
+    Other uint64 `json:"other"`
+  } `json:"login_failures"`
+}
+
+// The rates of Stats are measured over the last rateWindow, from samples of the running totals
+// taken every rateInterval.
+const (
+  rateWindow   = 10 * time.Second
+  rateInterval = time.Second
+)
+
+// rateSampler turns the running total of bytes read into a rate, measured over the last rateWindow
+// (or since the server started, at first) from samples recorded while the server is serving.
+// Measuring the rate does not record anything: every client gets the same rate at the same time.
+type rateSampler struct {
+  mu      sync.Mutex
+  samples [int(rateWindow / rateInterval) + 1]rateSample // ring, the latest at next-1
+  next    int
+  count   int
+}
+
+// rateSample is the running total as of a point in time.
+type rateSample struct {
+  at    time.Time
+  total uint64
+}
+
+// record records total as of now, evicting the oldest sample once the window is full. A sample
+// taken less than half a rateInterval after the latest one (e.g. by another Serve) is dropped.
+func (r *rateSampler) record(now time.Time, total uint64) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  latest := r.samples[(r.next + len(r.samples) - 1) % len(r.samples)]
+  if r.count > 0 && now.Sub(latest.at) < rateInterval / 2 {
+    return
+  }
+  r.samples[r.next] = rateSample{at: now, total: total}
+  r.next = (r.next + 1) % len(r.samples)
+  if r.count < len(r.samples) {
+    r.count++
+  }
+}
+
+// rate returns the rate per second from the oldest sample to total as of now.
+func (r *rateSampler) rate(now time.Time, total uint64) float64 {
+  r.mu.Lock()
+  oldest := r.samples[(r.next + len(r.samples) - r.count) % len(r.samples)]
+  r.mu.Unlock()
+  elapsed := now.Sub(oldest.at).Seconds()
+  if elapsed <= 0 || total < oldest.total {
+    return 0
+  }
+  return float64(total - oldest.total) / elapsed
+}
+
+// Stats returns a snapshot of the server's runtime and ingest statistics.
+func (s *Server) Stats() Stats {
+  var stats Stats
+  now := time.Now()
+
+  stats.StartedAt = s.startedAt
+  stats.UptimeSeconds = now.Sub(s.startedAt).Seconds()
+  stats.Goroutines = runtime.NumGoroutine()
+
+  var mem runtime.MemStats
+  runtime.ReadMemStats(&mem)
+  stats.Memory.Alloc = mem.Alloc
+  stats.Memory.TotalAlloc = mem.TotalAlloc
+  stats.Memory.Sys = mem.Sys
+  stats.Memory.HeapObjects = mem.HeapObjects
+  stats.Memory.NumGC = mem.NumGC
+
+  s.mu.Lock()
+  stats.Connections.Open = len(s.conns)
+  s.mu.Unlock()
+  stats.Connections.Accepted = atomic.LoadUint64(&s.counters.connections)
+
+  stats.Devices.Online = s.registry.count()
+  stats.Devices.LoggedIn = atomic.LoadUint64(&s.counters.logins)
+
+  stats.BytesRead.Total = atomic.LoadUint64(&s.counters.bytesRead)
+  stats.BytesRead.PerSecond = s.bytesRate.rate(now, stats.BytesRead.Total)
+
+  stats.Readings.Accepted = atomic.LoadUint64(&s.counters.readingsAccepted)
+  stats.Readings.Rejected = atomic.LoadUint64(&s.counters.readingsRejected)
+  stats.Readings.Backfilled = atomic.LoadUint64(&s.counters.readingsBackfilled)
+  stats.Readings.RejectedByField = make(map[string]uint64,
+      int(client.NumFields) + len(client.Sensors))
+  for field := client.Field(0); field < client.NumFields; field++ {
+    stats.Readings.RejectedByField[field.String()] =
+        atomic.LoadUint64(&s.counters.rejectedFields[field])
+  }
+  for _, sensor := range client.Sensors {
+    stats.Readings.RejectedByField[sensor.Name] =
+        atomic.LoadUint64(&s.counters.rejectedSensors[sensor.ID])
+  }
+
+  failures := &s.counters.loginFailures
+  stats.LoginFailures.Checksum = atomic.LoadUint64(&failures[loginFailureChecksum])
+  stats.LoginFailures.Invalid = atomic.LoadUint64(&failures[loginFailureInvalid])
+  stats.LoginFailures.Timeout = atomic.LoadUint64(&failures[loginFailureTimeout])
+  stats.LoginFailures.Duplicate = atomic.LoadUint64(&failures[loginFailureDuplicate])
+  stats.LoginFailures.Denied = atomic.LoadUint64(&failures[loginFailureDenied])
+  stats.LoginFailures.Unprovisioned = atomic.LoadUint64(&failures[loginFailureUnprovisioned])
+  stats.LoginFailures.Auth = atomic.LoadUint64(&failures[loginFailureAuth])
+  stats.LoginFailures.Other = atomic.LoadUint64(&failures[loginFailureOther])
+  return stats
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "fmt"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "net"
+)
+
+var (
+  ErrCertMismatch = errors.New("server: client certificate not issued to device")
+)
+
+// LoadTLSConfig returns the TLS configuration for device connections, with the server certificate
+// and key in the PEM files at certPath and keyPath. If clientCAPath is not empty, it is a PEM file
+// of the CAs issuing device certificates, and every device must present a certificate from one of
+// them (mutual TLS).
+func LoadTLSConfig(certPath, keyPath, clientCAPath string) (*tls.Config, error) {
+  cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+  if err != nil {
+    return nil, err
+  }
+  config := &tls.Config{
+    Certificates: []tls.Certificate{cert},
+    MinVersion:   tls.VersionTLS12,
+  }
+  if clientCAPath == "" {
+    return config, nil
+  }
+
+  pem, err := ioutil.ReadFile(clientCAPath)
+  if err != nil {
+    return nil, err
+  }
+  config.ClientCAs = x509.NewCertPool()
+  if !config.ClientCAs.AppendCertsFromPEM(pem) {
+    return nil, fmt.Errorf("no certificate found in %v", clientCAPath)
+  }
+  config.ClientAuth = tls.RequireAndVerifyClientCert
+  return config, nil
+}
+
+// checkCertificate returns nil if the device on c may log in as IMEI code as far as TLS is
+// concerned: it did not present a client certificate, or the certificate is issued to the IMEI.
+// Otherwise it returns ErrCertMismatch.
+func (c *conn) checkCertificate(code imei.IMEI) error {
+  tlsConn, ok := c.netConn.(*tls.Conn)
+  if !ok {
+    return nil
+  }
+  certs := tlsConn.ConnectionState().PeerCertificates
+  if len(certs) == 0 || certificateNames(certs[0], code) {
+    return nil
+  }
+  return ErrCertMismatch
+}
+
+// certificateNames reports whether cert names the device with IMEI code (as 15 digits), either in
+// its subject (common name or serial number) or in a subject alternative name (DNS name, or URI
+// "urn:imei:" followed by the IMEI, as in RFC 7254).
+func certificateNames(cert *x509.Certificate, code imei.IMEI) bool {
+  name := code.String()
+  if cert.Subject.CommonName == name || cert.Subject.SerialNumber == name {
+    return true
+  }
+  for _, dnsName := range cert.DNSNames {
+    if dnsName == name {
+      return true
+    }
+  }
+  for _, uri := range cert.URIs {
+    if uri.String() == "urn:imei:" + name {
+      return true
+    }
+  }
+  return false
+}
+
+// tcpConn returns the TCP connection underneath netConn, if any.
+func tcpConn(netConn net.Conn) (*net.TCPConn, bool) {
+  if tlsConn, ok := netConn.(*tls.Conn); ok {
+    netConn = tlsConn.NetConn()
+  }
+  tcp, ok := netConn.(*net.TCPConn)
+  return tcp, ok
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "log"
+  "math/big"
+  "net"
+  "net/url"
+  "testing"
+  "time"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+  cert *x509.Certificate
+  key  *ecdsa.PrivateKey
+}
+
+// newTestCA returns a new self-signed CA.
+func newTestCA(t *testing.T) *testCA {
+  ca := &testCA{}
+  ca.cert, ca.key = ca.issue(t, &x509.Certificate{
+    Subject:               pkix.Name{CommonName: "thermomatic test CA"},
+    IsCA:                  true,
+    BasicConstraintsValid: true,
+    KeyUsage:              x509.KeyUsageCertSign,
+  })
+  return ca
+}
+
+// issue signs a certificate from template (self-signed if ca has no certificate yet), and returns
+// it with its key.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate,
+    *ecdsa.PrivateKey) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  template.SerialNumber = big.NewInt(time.Now().UnixNano())
+  template.NotBefore = time.Now().Add(-time.Hour)
+  template.NotAfter = time.Now().Add(time.Hour)
+  parent, parentKey := ca.cert, ca.key
+  if parent == nil {
+    parent, parentKey = template, key
+  }
+  der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cert, err := x509.ParseCertificate(der)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return cert, key
+}
+
+// pool returns a pool holding the CA's certificate.
+func (ca *testCA) pool() *x509.CertPool {
+  pool := x509.NewCertPool()
+  pool.AddCert(ca.cert)
+  return pool
+}
+
+// tlsCertificate issues a certificate from template, ready for a tls.Config.
+func (ca *testCA) tlsCertificate(t *testing.T, template *x509.Certificate) tls.Certificate {
+  cert, key := ca.issue(t, template)
+  return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+// deviceCertificate returns a client certificate for the device named commonName.
+func (ca *testCA) deviceCertificate(t *testing.T, commonName string) tls.Certificate {
+  return ca.tlsCertificate(t, &x509.Certificate{
+    Subject:     pkix.Name{CommonName: commonName},
+    KeyUsage:    x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+  })
+}
+
+func TestCertificateNames(t *testing.T) {
+  urn, _ := url.Parse("urn:imei:490154203237518")
+  other, _ := url.Parse("urn:imei:356938035643809")
+  cases := []struct {
+    cert  x509.Certificate
+    names bool
+  }{
+    {x509.Certificate{Subject: pkix.Name{CommonName: "490154203237518"}}, true},
+    {x509.Certificate{Subject: pkix.Name{SerialNumber: "490154203237518"}}, true},
+    {x509.Certificate{DNSNames: []string{"sensor.example", "490154203237518"}}, true},
+    {x509.Certificate{URIs: []*url.URL{other, urn}}, true},
+    {x509.Certificate{Subject: pkix.Name{CommonName: "356938035643809"}}, false},
+    {x509.Certificate{Subject: pkix.Name{CommonName: "49015420323751"}}, false},
+    {x509.Certificate{URIs: []*url.URL{other}}, false},
+  }
+  for i, c := range cases {
+    if certificateNames(&c.cert, 490154203237518) != c.names {
+      t.Errorf("Case %d: certificateNames = %v", i, !c.names)
+    }
+  }
+}
+
+// Over mutual TLS, a device must be let in with a certificate issued to its IMEI, and refused with
+// one issued to another device.
+func TestServerTLS(t *testing.T) {
+  ca := newTestCA(t)
+  serverCert := ca.tlsCertificate(t, &x509.Certificate{
+    Subject:     pkix.Name{CommonName: "thermomatic"},
+    IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+    KeyUsage:    x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+  })
+  logs := &syncBuffer{}
+  srv, addr, _ := startServer(t, Options{Logger: log.New(logs, "", 0), TLS: &tls.Config{
+    Certificates: []tls.Certificate{serverCert},
+    ClientCAs:    ca.pool(),
+    ClientAuth:   tls.RequireAndVerifyClientCert,
+  }})
+  defer srv.Close()
+
+  device := client.Config{Address: addr, TLS: &tls.Config{
+    RootCAs:      ca.pool(),
+    Certificates: []tls.Certificate{ca.deviceCertificate(t, "490154203237518")},
+  }}
+  if result := device.Connect(client.ValidImei, 0, 0, 3); result != "OK" {
+    t.Fatalf("Unable to send Readings over TLS: %v", result)
+  }
+  waitForLog(t, logs, "conn 1: closed after 3 reading(s)")
+
+  impostor := client.Config{Address: addr, TLS: &tls.Config{
+    RootCAs:      ca.pool(),
+    Certificates: []tls.Certificate{ca.deviceCertificate(t, "356938035643809")},
+  }}
+  impostor.Connect(client.ValidImei, 0, 0, 0)
+  waitForLog(t, logs, "conn 2: login as IMEI 490154203237518 refused: " + ErrCertMismatch.Error())
+  if failures := srv.Stats().LoginFailures; failures.Auth != 1 {
+    t.Errorf("Unexpected login failures %+v", failures)
+  }
+}
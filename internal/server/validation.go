@@ -0,0 +1,252 @@
+package server
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
+  "io/ioutil"
+  "strconv"
+)
+
+var (
+  ErrBadValidationConfig = errors.New("server: invalid validation config")
+)
+
+// ValidationConfig selects the validation profile Readings are checked against, per device.
+//
+// Rules are tried in order, and the profile of the first matching one applies; devices no rule
+// matches get the Default profile.
+type ValidationConfig struct {
+  // Default is the profile of the devices no rule matches (client.DefaultProfile if nil).
+  Default *client.Profile
+
+  // Rules map sets of devices to profiles.
+  Rules []ProfileRule
+}
+
+// ProfileRule maps a set of devices, given either as a TAC prefix or as a range of IMEI codes, to
+// a validation profile.
+type ProfileRule struct {
+  // TACPrefix, if set, matches the IMEIs starting with these digits (at most the 8 TAC digits).
+  TACPrefix string
+
+  // From and To are the (inclusive) bounds of the IMEI codes matched when TACPrefix isn't set.
+  From imei.IMEI
+  To   imei.IMEI
+
+  // Profile applies to the matched devices.
+  Profile *client.Profile
+}
+
+// matches reports whether the rule applies to the device with IMEI code.
+func (rule *ProfileRule) matches(code imei.IMEI) bool {
+  if rule.TACPrefix == "" {
+    return code >= rule.From && code <= rule.To
+  }
+  return hasTACPrefix(code, rule.TACPrefix)
+}
+
+// hasTACPrefix reports whether IMEI code starts with the digits of prefix (see checkTACPrefix).
+func hasTACPrefix(code imei.IMEI, prefix string) bool {
+  // compare the prefix with the leading digits of the 15-digit code, without formatting it
+  var value, divisor uint64 = 0, 1
+  for i := 0; i < len(prefix); i++ {
+    value = value * 10 + uint64(prefix[i] - '0')
+  }
+  for i := len(prefix); i < imei.IMEI_LENGTH; i++ {
+    divisor *= 10
+  }
+  return uint64(code) / divisor == value
+}
+
+// ProfileFor returns the profile Readings from the device with IMEI code are validated against.
+// ProfileFor does not allocate. A nil *ValidationConfig yields client.DefaultProfile.
+func (vc *ValidationConfig) ProfileFor(code imei.IMEI) *client.Profile {
+  if vc == nil {
+    return &client.DefaultProfile
+  }
+  for i := range vc.Rules {
+    if vc.Rules[i].matches(code) {
+      return vc.Rules[i].Profile
+    }
+  }
+  if vc.Default != nil {
+    return vc.Default
+  }
+  return &client.DefaultProfile
+}
+
+// LoadValidationConfig reads the JSON validation config in the file at path (see
+// ParseValidationConfig).
+func LoadValidationConfig(path string) (*ValidationConfig, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  return ParseValidationConfig(data)
+}
+
+// ParseValidationConfig parses a JSON validation config such as:
+//
+//   {
+//     "profiles": {
+//       "greenhouse": {
+//         "Temperature": {"min": -10, "max": 60},
+//         "Altitude":    {"min": -100, "max": 3000},
+//         "humidity":    {"min": 20, "max": 95}
+//       }
+//     },
+//     "default": "default",
+//     "rules": [
+//       {"tac": "35693803", "profile": "greenhouse"},
+//       {"from": "490154200000000", "to": "490154299999999", "profile": "greenhouse"},
+//       {"imei": "490154203237518", "profile": "default"}
+//     ]
+//   }
+//
+// Profiles are keyed by name. A profile only lists the fields (and extra sensors, by name) it
+// restricts; the bounds it leaves out are those of client.DefaultProfile, which is always available
+// as "default". Bounds are inclusive unless "min_exclusive" or "max_exclusive" is true. A rule
+// matches devices by TAC prefix ("tac"), by range of IMEIs ("from" and "to", inclusive) or by
+// single IMEI ("imei").
+func ParseValidationConfig(data []byte) (*ValidationConfig, error) {
+  var raw struct {
+    Profiles map[string]map[string]rangeConfig `json:"profiles"`
+    Default  string                            `json:"default"`
+    Rules    []struct {
+      TAC     string `json:"tac"`
+      From    string `json:"from"`
+      To      string `json:"to"`
+      IMEI    string `json:"imei"`
+      Profile string `json:"profile"`
+    } `json:"rules"`
+  }
+  if err := json.Unmarshal(data, &raw); err != nil {
+    return nil, fmt.Errorf("%v: %v", ErrBadValidationConfig, err)
+  }
+
+  profiles := map[string]*client.Profile{client.DefaultProfile.Name: &client.DefaultProfile}
+  for name, fields := range raw.Profiles {
+    profile := &client.Profile{Name: name, Ranges: client.DefaultProfile.Ranges}
+    for fieldName, bounds := range fields {
+      if id, err := client.ParseSensor(fieldName); err == nil {
+        if profile.Sensors == nil {
+          profile.Sensors = make(map[client.SensorID]client.Range)
+        }
+        rg, _ := profile.SensorRange(id)
+        bounds.apply(&rg)
+        if rg.Min > rg.Max {
+          return nil, fmt.Errorf("%v: profile %q: empty %v range %v", ErrBadValidationConfig, name,
+              id, rg)
+        }
+        profile.Sensors[id] = rg
+        continue
+      }
+      field, err := client.ParseField(fieldName)
+      if err != nil {
+        return nil, fmt.Errorf("%v: profile %q: %v %q", ErrBadValidationConfig, name, err,
+            fieldName)
+      }
+      bounds.apply(&profile.Ranges[field])
+      if profile.Ranges[field].Min > profile.Ranges[field].Max {
+        return nil, fmt.Errorf("%v: profile %q: empty %v range %v", ErrBadValidationConfig, name,
+            field, profile.Ranges[field])
+      }
+    }
+    profiles[name] = profile
+  }
+
+  lookup := func(name string) (*client.Profile, error) {
+    if profile, ok := profiles[name]; ok {
+      return profile, nil
+    }
+    return nil, fmt.Errorf("%v: unknown profile %q", ErrBadValidationConfig, name)
+  }
+
+  vc := &ValidationConfig{}
+  if raw.Default != "" {
+    profile, err := lookup(raw.Default)
+    if err != nil {
+      return nil, err
+    }
+    vc.Default = profile
+  }
+
+  for i, r := range raw.Rules {
+    profile, err := lookup(r.Profile)
+    if err != nil {
+      return nil, err
+    }
+    rule := ProfileRule{Profile: profile}
+    switch {
+    case r.TAC != "":
+      rule.TACPrefix = r.TAC
+      err = checkTACPrefix(r.TAC)
+    case r.IMEI != "":
+      rule.From, err = imei.Parse(r.IMEI)
+      rule.To = rule.From
+    case r.From != "" && r.To != "":
+      // range bounds need not be valid IMEIs themselves
+      if rule.From, err = parseImeiBound(r.From); err == nil {
+        rule.To, err = parseImeiBound(r.To)
+      }
+    default:
+      err = errors.New("rule needs a tac, an imei, or a from and to")
+    }
+    if err != nil {
+      return nil, fmt.Errorf("%v: rule #%d: %v", ErrBadValidationConfig, i, err)
+    }
+    vc.Rules = append(vc.Rules, rule)
+  }
+  return vc, nil
+}
+
+// checkTACPrefix makes sure digits is a usable TAC prefix: 1 to 8 decimal digits.
+func checkTACPrefix(digits string) error {
+  if len(digits) == 0 || len(digits) > imei.TAC_LENGTH {
+    return fmt.Errorf("TAC prefix %q must be 1 to %d digits long", digits, imei.TAC_LENGTH)
+  }
+  for i := 0; i < len(digits); i++ {
+    if digits[i] < '0' || digits[i] > '9' {
+      return fmt.Errorf("TAC prefix %q: %v", digits, imei.ErrInvalid)
+    }
+  }
+  return nil
+}
+
+// parseImeiBound parses a bound of an IMEI range: 15 decimal digits, with no checksum requirement.
+func parseImeiBound(digits string) (imei.IMEI, error) {
+  if len(digits) != imei.IMEI_LENGTH {
+    return 0, imei.ErrImeiSize
+  }
+  code, err := strconv.ParseUint(digits, 10, 64)
+  return imei.IMEI(code), err
+}
+
+// rangeConfig is a range in a JSON validation config. Bounds left out keep their previous value.
+type rangeConfig struct {
+  Min          *float64 `json:"min"`
+  Max          *float64 `json:"max"`
+  MinExclusive *bool    `json:"min_exclusive"`
+  MaxExclusive *bool    `json:"max_exclusive"`
+}
+
+// apply overrides the bounds of rg set in the config.
+func (rc rangeConfig) apply(rg *client.Range) {
+  if rc.Min != nil {
+    rg.Min = *rc.Min
+    rg.MinExclusive = false
+  }
+  if rc.Max != nil {
+    rg.Max = *rc.Max
+    rg.MaxExclusive = false
+  }
+  if rc.MinExclusive != nil {
+    rg.MinExclusive = *rc.MinExclusive
+  }
+  if rc.MaxExclusive != nil {
+    rg.MaxExclusive = *rc.MaxExclusive
+  }
+}
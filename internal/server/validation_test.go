@@ -0,0 +1,143 @@
+package server
+
+import (
+  "github.com/MarcKriguer/thermomatic/internal/client"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+const testValidationConfig = `{
+  "profiles": {
+    "greenhouse": {
+      "Temperature":  {"min": -10, "max": 60},
+      "BatteryLevel": {"min": 5, "min_exclusive": true},
+      "humidity":     {"min": 20}
+    },
+    "arctic": {
+      "Temperature": {"min": -80, "max": 10, "max_exclusive": true}
+    }
+  },
+  "rules": [
+    {"imei": "490154203237518", "profile": "default"},
+    {"tac": "490154", "profile": "greenhouse"},
+    {"from": "356938035643800", "to": "356938035643899", "profile": "arctic"}
+  ]
+}`
+
+// The config must be parsed into profiles inheriting the default ranges, matched by rule order.
+func TestParseValidationConfig(t *testing.T) {
+  vc, err := ParseValidationConfig([]byte(testValidationConfig))
+  if err != nil {
+    t.Fatalf("Unable to parse config: %v", err)
+  }
+
+  // a single IMEI rule takes precedence over the TAC rule after it
+  if profile := vc.ProfileFor(490154203237518); profile != &client.DefaultProfile {
+    t.Errorf("Unexpected profile %q for the single IMEI rule", profile.Name)
+  }
+
+  greenhouse := vc.ProfileFor(490154203237526)
+  if greenhouse.Name != "greenhouse" {
+    t.Fatalf("Unexpected profile %q for the TAC rule", greenhouse.Name)
+  }
+  if greenhouse.Ranges[client.FieldTemperature] != (client.Range{Min: -10, Max: 60}) {
+    t.Errorf("Unexpected Temperature range %v", greenhouse.Ranges[client.FieldTemperature])
+  }
+  if greenhouse.Ranges[client.FieldBatteryLevel] != (client.Range{Min: 5, Max: 100,
+      MinExclusive: true}) {
+    t.Errorf("Unexpected BatteryLevel range %v", greenhouse.Ranges[client.FieldBatteryLevel])
+  }
+  if greenhouse.Ranges[client.FieldAltitude] !=
+      client.DefaultProfile.Ranges[client.FieldAltitude] {
+    t.Errorf("Altitude range not inherited: %v", greenhouse.Ranges[client.FieldAltitude])
+  }
+  humidity, _ := greenhouse.SensorRange(client.SensorHumidity)
+  if humidity != (client.Range{Min: 20, Max: 100}) {
+    t.Errorf("Unexpected humidity range %v", humidity)
+  }
+  if rg, _ := greenhouse.SensorRange(client.SensorLight); rg != client.Sensors[2].Range {
+    t.Errorf("Light range not inherited: %v", rg)
+  }
+
+  if profile := vc.ProfileFor(356938035643809); profile.Name != "arctic" {
+    t.Errorf("Unexpected profile %q for the IMEI range rule", profile.Name)
+  }
+  if profile := vc.ProfileFor(356938035643900); profile != &client.DefaultProfile {
+    t.Errorf("Unexpected profile %q outside every rule", profile.Name)
+  }
+
+  var none *ValidationConfig
+  if none.ProfileFor(490154203237518) != &client.DefaultProfile {
+    t.Errorf("A nil config must yield the default profile")
+  }
+}
+
+// Invalid configs must be rejected with ErrBadValidationConfig.
+func TestParseValidationConfigErrors(t *testing.T) {
+  for _, config := range []string{
+    `{"profiles": {"p": {"Humidity": {"max": 1}}}}`,
+    `{"profiles": {"p": {"Temperature": {"min": 10, "max": 1}}}}`,
+    `{"profiles": {"p": {"humidity": {"min": 120}}}}`,
+    `{"rules": [{"tac": "490154", "profile": "missing"}]}`,
+    `{"rules": [{"tac": "4901542032", "profile": "default"}]}`,
+    `{"rules": [{"tac": "49O1", "profile": "default"}]}`,
+    `{"rules": [{"imei": "490154203237519", "profile": "default"}]}`,
+    `{"rules": [{"from": "490154203237518", "profile": "default"}]}`,
+    `{"default": "missing"}`,
+    `not json`,
+  } {
+    _, err := ParseValidationConfig([]byte(config))
+    if err == nil || !strings.HasPrefix(err.Error(), ErrBadValidationConfig.Error()) {
+      t.Errorf("Config %s: unexpected error %v", config, err)
+    }
+  }
+}
+
+func TestLoadValidationConfig(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thermomatic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "validation.json")
+  ioutil.WriteFile(path, []byte(testValidationConfig), 0644)
+
+  vc, err := LoadValidationConfig(path)
+  if err != nil || len(vc.Rules) != 3 {
+    t.Errorf("Unable to load config: %v", err)
+  }
+}
+
+// The server must validate each device's Readings against its profile.
+func TestServerValidationProfile(t *testing.T) {
+  vc, err := ParseValidationConfig([]byte(`{
+    "profiles": {"greenhouse": {"Temperature": {"min": -10, "max": 60}}},
+    "rules": [{"tac": "490154", "profile": "greenhouse"}]
+  }`))
+  if err != nil {
+    t.Fatalf("Unable to parse config: %v", err)
+  }
+  records := &syncBuffer{}
+  srv, _, _ := startServer(t, Options{Output: records, Validation: vc})
+  defer srv.Close()
+
+  // 67.77 degrees is fine by the README, but not in a greenhouse
+  cool := testReading
+  cool.Temperature = 21.5
+  device, done := loginDevice(t, srv, 1)
+  device.Write(testReading.Encode())
+  device.Write(cool.Encode())
+  device.Close()
+  waitClosed(t, done)
+
+  if !strings.HasSuffix(records.String(), ",490154203237518,21.5,2.63555,33.41,44.4,0.25666\n") ||
+      strings.Count(records.String(), "\n") != 1 {
+    t.Errorf("Unexpected records %q", records.String())
+  }
+  if srv.Stats().Readings.RejectedByField["Temperature"] != 1 {
+    t.Errorf("Rejection not counted")
+  }
+}
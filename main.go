@@ -1,11 +1,342 @@
 package main
 
 import (
+  "bytes"
+  "context"
+  "flag"
+  "fmt"
   "github.com/MarcKriguer/thermomatic/internal/common"
+  "github.com/MarcKriguer/thermomatic/internal/imei"
   "github.com/MarcKriguer/thermomatic/internal/server"
+  "io/ioutil"
+  "log"
+  "os"
+  "os/signal"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+// Exit status codes.
+const (
+  // The server was shut down cleanly (by a signal).
+  exitOK = 0
+
+  // The server could not start or stopped on its own because of an error.
+  exitServerError = 1
+
+  // Devices were still connected when the grace period ran out, so their connections were cut.
+  exitGraceExpired = 2
 )
 
 func main() {
-  common.LogOutput("Starting thermomatic service.")
-  server.StartServer(common.DefaultTheromaticPort)
+  os.Exit(run())
+}
+
+// run starts the server and blocks until it stops, returning the process's exit status.
+func run() int {
+  opts := server.Options{}
+  grace := 5 * time.Second
+  validationPath := ""
+  allowlistPath, denylistPath := "", ""
+  accessPoll := 5 * time.Second
+  provisioningPath, autoRegister, adminTokenPath := "", false, ""
+  keysPath, firmwarePath := "", ""
+  tlsCertPath, tlsKeyPath, tlsClientCAPath := "", "", ""
+
+  flag.StringVar(&opts.Address, "listen", ":" + strconv.Itoa(common.DefaultTheromaticPort),
+      "TCP address devices connect to")
+  flag.StringVar(&tlsCertPath, "tls-cert", "",
+      "PEM file of the server certificate; devices then connect over TLS (with -tls-key)")
+  flag.StringVar(&tlsKeyPath, "tls-key", "", "PEM file of the server certificate's private key")
+  flag.StringVar(&tlsClientCAPath, "tls-client-ca", "",
+      "PEM file of the CAs issuing device certificates; devices must then present a certificate " +
+      "naming their IMEI (with -tls-cert)")
+  flag.DurationVar(&opts.LoginTimeout, "login-timeout", server.DefaultLoginTimeout,
+      "time a device has to send its IMEI")
+  flag.DurationVar(&opts.ReadingTimeout, "reading-timeout", server.DefaultReadingTimeout,
+      "longest time a device may go without sending a Reading")
+  flag.IntVar(&opts.MaxConnections, "max-connections", 0,
+      "maximum number of concurrent device connections (0 means unlimited)")
+  flag.StringVar(&opts.HTTPAddress, "http", "",
+      "TCP address to serve the HTTP endpoints (/stats, /readings/:imei, /status/:imei) on; " +
+      "empty to disable them")
+  flag.Var(recordFormatFlag{&opts.RecordFormat}, "record-format",
+      "format of the Reading records written to stdout: csv (the original columns, the default, " +
+      "not flagging backfilled Readings), csv-extended (followed by the backfilled flag and a " +
+      "column per extra sensor) or json (one object per line)")
+  flag.Var(encodingFlag{&opts.LoginEncoding}, "imei-encoding",
+      "how devices encode the IMEI digits in their login: raw (0-9), ascii ('0'-'9') or any " +
+      "(either, the default)")
+  flag.Var(lengthsFlag{&opts.LoginLengths}, "login-lengths",
+      "comma-separated lengths of the login messages accepted: 15 (IMEI, the default) and/or 16 " +
+      "(IMEISV)")
+  flag.Var(duplicatePolicyFlag{&opts.DuplicateLogin}, "duplicate-login",
+      "what to do when an online device logs in again: kick (the old connection, the default), " +
+      "reject (the new one) or allow (both)")
+  flag.StringVar(&validationPath, "validation", "",
+      "JSON file mapping devices to validation profiles; empty to validate every device against " +
+      "the README ranges")
+  flag.StringVar(&allowlistPath, "allowlist", "",
+      "file listing the IMEIs and TAC prefixes of the only devices allowed to log in; empty to " +
+      "allow every device")
+  flag.StringVar(&denylistPath, "denylist", "",
+      "file listing the IMEIs and TAC prefixes of devices refused at login")
+  flag.DurationVar(&accessPoll, "access-poll", accessPoll,
+      "how often to check the allowlist and denylist files for changes (0 to only reload them " +
+      "on SIGHUP)")
+  flag.StringVar(&provisioningPath, "provisioning", "",
+      "file keeping the provisioning state of the devices; only approved devices may log in if " +
+      "set (empty to disable provisioning)")
+  flag.BoolVar(&autoRegister, "auto-register", false,
+      "register unknown devices as pending when they first log in (with -provisioning)")
+  flag.StringVar(&keysPath, "keys", "",
+      "file listing the IMEI and hex secret key of each device; devices must then answer an " +
+      "HMAC-SHA256 challenge after logging in (empty to trust the IMEI)")
+  flag.DurationVar(&opts.AuthTimeout, "auth-timeout", server.DefaultAuthTimeout,
+      "time a device has to answer the authentication challenge (with -keys)")
+  flag.StringVar(&firmwarePath, "firmware", "",
+      "JSON manifest of the firmware images offered to the devices, by TAC (empty for no " +
+      "updates; rollouts are staged through the /admin/firmware/ HTTP endpoints)")
+  flag.StringVar(&adminTokenPath, "admin-token-file", "",
+      "file holding the bearer token required by the /admin/ HTTP endpoints (empty to disable " +
+      "them)")
+  flag.DurationVar(&grace, "grace", grace,
+      "time connected devices are given to finish their current message on shutdown")
+  flag.Parse()
+
+  logger := log.New(os.Stderr, "Thermomatic: ", log.LstdFlags|log.Lmicroseconds)
+  opts.Logger = logger
+  opts.Output = os.Stdout
+
+  if tlsCertPath != "" || tlsKeyPath != "" || tlsClientCAPath != "" {
+    if tlsCertPath == "" || tlsKeyPath == "" {
+      logger.Print("Both -tls-cert and -tls-key are required for TLS.")
+      return exitServerError
+    }
+    config, err := server.LoadTLSConfig(tlsCertPath, tlsKeyPath, tlsClientCAPath)
+    if err != nil {
+      logger.Printf("Unable to load TLS configuration: %v", err)
+      return exitServerError
+    }
+    opts.TLS = config
+  }
+
+  if validationPath != "" {
+    validation, err := server.LoadValidationConfig(validationPath)
+    if err != nil {
+      logger.Printf("Unable to load validation config: %v", err)
+      return exitServerError
+    }
+    opts.Validation = validation
+  }
+
+  if allowlistPath != "" || denylistPath != "" {
+    access, err := server.NewAccessControl(allowlistPath, denylistPath)
+    if err != nil {
+      logger.Printf("Unable to load access lists: %v", err)
+      return exitServerError
+    }
+    opts.Access = access
+    logger.Printf("Access lists loaded (%v).", access)
+
+    // Reload the lists on SIGHUP, and whenever the files change.
+    reportReload := func(err error) {
+      if err != nil {
+        logger.Printf("Unable to reload access lists, keeping the previous ones: %v", err)
+        return
+      }
+      logger.Printf("Access lists reloaded (%v).", access)
+    }
+    hangups := make(chan os.Signal, 1)
+    signal.Notify(hangups, syscall.SIGHUP)
+    defer signal.Stop(hangups)
+    go func() {
+      for range hangups {
+        reportReload(access.Reload())
+      }
+    }()
+    if accessPoll > 0 {
+      ctx, cancel := context.WithCancel(context.Background())
+      defer cancel()
+      go access.Watch(ctx, accessPoll, reportReload)
+    }
+  }
+
+  if provisioningPath != "" {
+    provisioning, err := server.NewProvisioning(provisioningPath, autoRegister)
+    if err != nil {
+      logger.Printf("Unable to load provisioning: %v", err)
+      return exitServerError
+    }
+    opts.Provisioning = provisioning
+    logger.Printf("Provisioning loaded (%d device(s)).", len(provisioning.Devices()))
+  }
+  if keysPath != "" {
+    keys, err := server.LoadKeyFile(keysPath)
+    if err != nil {
+      logger.Printf("Unable to load device keys: %v", err)
+      return exitServerError
+    }
+    opts.Keys = keys
+    logger.Printf("Device keys loaded (%d device(s)).", keys.Len())
+  }
+  if firmwarePath != "" {
+    firmware, err := server.LoadFirmware(firmwarePath)
+    if err != nil {
+      logger.Printf("Unable to load firmware: %v", err)
+      return exitServerError
+    }
+    opts.Firmware = firmware
+    logger.Printf("Firmware loaded (%d image(s)).", len(firmware.Images()))
+  }
+  if adminTokenPath != "" {
+    token, err := ioutil.ReadFile(adminTokenPath)
+    if err != nil {
+      logger.Printf("Unable to read admin token: %v", err)
+      return exitServerError
+    }
+    opts.AdminToken = string(bytes.TrimSpace(token))
+    if opts.AdminToken == "" {
+      logger.Printf("Admin token file %v is empty.", adminTokenPath)
+      return exitServerError
+    }
+  } else if opts.HTTPAddress != "" {
+    logger.Print("No admin token: the /admin/ HTTP endpoints are disabled.")
+  }
+
+  logger.Print("Starting thermomatic service.")
+  srv := server.New(opts)
+
+  // Run the server until it fails or a signal asks us to stop.
+  signals := make(chan os.Signal, 2)
+  signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+  defer signal.Stop(signals)
+
+  done := make(chan error, 1)
+  go func() {
+    done <- srv.Run(context.Background())
+  }()
+
+  status := exitOK
+  select {
+  case err := <-done:
+    logger.Printf("Server stopped: %v", err)
+    status = exitServerError
+
+  case sig := <-signals:
+    logger.Printf("Received %v, shutting down (grace period %v).", sig, grace)
+    ctx, cancel := context.WithTimeout(context.Background(), grace)
+
+    // A second signal cuts the grace period short.
+    go func() {
+      select {
+      case sig := <-signals:
+        logger.Printf("Received %v again, closing all connections now.", sig)
+        cancel()
+      case <-ctx.Done():
+      }
+    }()
+
+    if err := srv.Shutdown(ctx); err != nil {
+      logger.Printf("Shutdown incomplete: %v", err)
+      status = exitGraceExpired
+    }
+    cancel()
+    <-done
+  }
+  if err := opts.Provisioning.Flush(); err != nil {
+    logger.Printf("Unable to save provisioning: %v", err)
+  }
+
+  summary := srv.Summary()
+  logger.Printf("Shutdown summary: %d connection(s), %d device(s) logged in, %d reading(s) emitted.",
+      summary.Connections, summary.Devices, summary.Readings)
+  return status
+}
+
+// duplicatePolicyFlag is a flag.Value setting a server.DuplicatePolicy by name.
+type duplicatePolicyFlag struct {
+  policy *server.DuplicatePolicy
+}
+
+func (f duplicatePolicyFlag) String() string {
+  if f.policy == nil {
+    return server.KickOld.String()
+  }
+  return f.policy.String()
+}
+
+func (f duplicatePolicyFlag) Set(name string) (err error) {
+  *f.policy, err = server.ParseDuplicatePolicy(name)
+  return err
+}
+
+// recordFormatFlag is a flag.Value setting a server.RecordFormat by name.
+type recordFormatFlag struct {
+  format *server.RecordFormat
+}
+
+func (f recordFormatFlag) String() string {
+  if f.format == nil {
+    return server.RecordCSV.String()
+  }
+  return f.format.String()
+}
+
+func (f recordFormatFlag) Set(name string) (err error) {
+  *f.format, err = server.ParseRecordFormat(name)
+  return err
+}
+
+// encodingFlag is a flag.Value setting an imei.Encoding by name.
+type encodingFlag struct {
+  encoding *imei.Encoding
+}
+
+func (f encodingFlag) String() string {
+  if f.encoding == nil || *f.encoding == 0 {
+    return imei.AnyDigits.String()
+  }
+  return f.encoding.String()
+}
+
+func (f encodingFlag) Set(name string) (err error) {
+  *f.encoding, err = imei.ParseEncoding(name)
+  return err
+}
+
+// lengthsFlag is a flag.Value setting the accepted login message lengths from a comma-separated
+// list.
+type lengthsFlag struct {
+  lengths *[]int
+}
+
+func (f lengthsFlag) String() string {
+  if f.lengths == nil || len(*f.lengths) == 0 {
+    return strconv.Itoa(imei.IMEI_LENGTH)
+  }
+  names := make([]string, len(*f.lengths))
+  for i, length := range *f.lengths {
+    names[i] = strconv.Itoa(length)
+  }
+  return strings.Join(names, ",")
+}
+
+func (f lengthsFlag) Set(list string) error {
+  var lengths []int
+  for _, name := range strings.Split(list, ",") {
+    length, err := strconv.Atoi(strings.TrimSpace(name))
+    if err != nil {
+      return err
+    }
+    if length != imei.IMEI_LENGTH && length != imei.IMEISV_LENGTH {
+      return fmt.Errorf("unsupported login length %d (must be %d or %d)", length,
+          imei.IMEI_LENGTH, imei.IMEISV_LENGTH)
+    }
+    lengths = append(lengths, length)
+  }
+  *f.lengths = lengths
+  return nil
 }
@@ -1,12 +1,37 @@
 package main
 
 import (
+  "context"
   "github.com/MarcKriguer/thermomatic/internal/client"
+  "github.com/MarcKriguer/thermomatic/internal/server"
+  "io/ioutil"
+  "os"
   "testing"
   "strings"
+  "time"
 )
 
-// Start the server (e.g. run "go run server.go") in a different window before running these tests.
+// TestMain runs a server on the default port for the duration of the tests.
+func TestMain(m *testing.M) {
+  srv := server.New(server.Options{Output: ioutil.Discard})
+  ready := make(chan error, 1)
+  go func() {
+    ready <- srv.Run(context.Background())
+  }()
+
+  // give the server a moment to start listening (or to fail doing so)
+  select {
+  case err := <-ready:
+    os.Stderr.WriteString("unable to start server: " + err.Error() + "\n")
+    os.Exit(1)
+  case <-time.After(100 * time.Millisecond):
+  }
+
+  code := m.Run()
+  srv.Shutdown(context.Background())
+  os.Exit(code)
+}
+
 func TestClientHappyPath(t *testing.T) {
   // It will send 10 randomly generated Readings. (The timeout delays specified before are all
   // within server limits, so all Readings should get sent successfully.
@@ -17,6 +42,47 @@ func TestClientHappyPath(t *testing.T) {
   }
 }
 
+// The same, speaking protocol version 2.
+func TestClientProtocolV2(t *testing.T) {
+  result := client.Config{Protocol: client.PROTOCOL_V2}.Connect(client.ValidImei, 200, 200, 10)
+
+  if result != "OK" {
+    t.Error("Server error: " + result)
+  }
+}
+
+// The same, with every Reading acknowledged by the server.
+func TestClientAcks(t *testing.T) {
+  cfg := client.Config{Protocol: client.PROTOCOL_V2, Acks: client.AckCumulative}
+  result := cfg.Connect(client.ValidImei, 200, 200, 10)
+
+  if result != "OK" {
+    t.Error("Server error: " + result)
+  }
+}
+
+// The same, from a device with extra sensors.
+func TestClientSensors(t *testing.T) {
+  cfg := client.Config{Protocol: client.PROTOCOL_V2, Acks: client.AckEach,
+      Sensors: []client.SensorID{client.SensorHumidity, client.SensorLight}}
+  result := cfg.Connect(client.ValidImei, 200, 200, 10)
+
+  if result != "OK" {
+    t.Error("Server error: " + result)
+  }
+}
+
+// The same, from a device catching up on the Readings it recorded while offline.
+func TestClientBacklog(t *testing.T) {
+  cfg := client.Config{Protocol: client.PROTOCOL_V2, Acks: client.AckCumulative, Backlog: 200,
+      Sensors: []client.SensorID{client.SensorHumidity}}
+  result := cfg.Connect(client.ValidImei, 200, 200, 2)
+
+  if result != "OK" {
+    t.Error("Server error: " + result)
+  }
+}
+
 // This tests specifying an invalid IMEI.
 func TestConnectionInvalidImei(t *testing.T) {
   invalidImei := []byte { 4, 9, 0, 1, 5, 4, 2, 0, 3, 2, 3, 7, 5, 1, 9}